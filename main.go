@@ -2,9 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -13,7 +19,11 @@ import (
 	"github.com/stryukovsky/go-backend-learn/trade/analytics"
 	"github.com/stryukovsky/go-backend-learn/trade/api"
 	"github.com/stryukovsky/go-backend-learn/trade/cache"
+	"github.com/stryukovsky/go-backend-learn/trade/chainlist"
 	"github.com/stryukovsky/go-backend-learn/trade/database"
+	"github.com/stryukovsky/go-backend-learn/trade/metrics"
+	"github.com/stryukovsky/go-backend-learn/trade/prices"
+	"github.com/stryukovsky/go-backend-learn/trade/replay"
 	"github.com/stryukovsky/go-backend-learn/trade/worker"
 	"github.com/urfave/cli/v3"
 	"gorm.io/driver/postgres"
@@ -21,13 +31,71 @@ import (
 	"gorm.io/gorm/logger"
 )
 
-func Api(db *gorm.DB, cm *cache.CacheManager) {
+// Time given to in-flight API requests to finish after shutdown signal
+const shutdownTimeout = 10 * time.Second
+
+func Api(ctx context.Context, db *gorm.DB, cm *cache.CacheManager) error {
 	router := gin.Default()
 	config := cors.DefaultConfig()
 	config.AllowOrigins = []string{"*"}
 	router.Use(cors.New(config))
 	api.CreateApi(router, db, cm)
-	router.Run()
+	server := &http.Server{Addr: ":8080", Handler: router}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	err := server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		slog.Info("API server stopped")
+		return nil
+	}
+	return err
+}
+
+// Starts metrics listener when --metrics-addr is given, so commands without API can be scraped too
+func serveMetrics(ctx context.Context, cmd *cli.Command) {
+	addr := cmd.String("metrics-addr")
+	if addr == "" {
+		return
+	}
+	go func() {
+		if err := metrics.Serve(ctx, addr); err != nil {
+			slog.Error(fmt.Sprintf("Metrics listener failed: %s", err.Error()))
+		}
+	}()
+}
+
+// Prepares process-wide sources of data given by flags common to all commands
+func before(ctx context.Context, cmd *cli.Command) (context.Context, error) {
+	err := useFixtures(cmd)
+	if err != nil {
+		return ctx, err
+	}
+	if path := cmd.String("static-prices"); path != "" {
+		err = prices.Static.Load(path)
+		if err != nil {
+			return ctx, err
+		}
+		slog.Info(fmt.Sprintf("Static prices are loaded from %s", path))
+	}
+	return ctx, nil
+}
+
+// Bounds of exported candles are dates or RFC 3339 times, dates are in UTC
+var archiveTimeConfig = cli.TimestampConfig{Timezone: time.UTC, Layouts: []string{time.DateOnly, time.RFC3339}}
+
+// Installs record or replay transport when fixtures flag is set, websocket subscriptions are not covered
+func useFixtures(cmd *cli.Command) error {
+	if dir := cmd.String("record-fixtures"); dir != "" {
+		return replay.Install(replay.Record, dir)
+	}
+	if dir := cmd.String("replay-fixtures"); dir != "" {
+		return replay.Install(replay.Replay, dir)
+	}
+	return nil
 }
 
 func instantiateCache(db *gorm.DB) (*cache.CacheManager, error) {
@@ -36,7 +104,28 @@ func instantiateCache(db *gorm.DB) (*cache.CacheManager, error) {
 	if result.Error != nil {
 		return nil, fmt.Errorf("No config")
 	}
-	return cache.NewCacheManager(config.BlockchainUrlsForCacheManager, "localhost:6379", "redis", 0)
+	return instantiateCacheOfWorker(db, config)
+}
+
+func instantiateCacheOfWorker(db *gorm.DB, config trade.Worker) (*cache.CacheManager, error) {
+	return cache.NewCacheManager(db, config.ChainId, config.BlockchainUrlsForCacheManager, config.RpcLimits, "localhost:6379", "redis", 0)
+}
+
+func instantiateCacheOfChain(db *gorm.DB, chainId string) (*cache.CacheManager, error) {
+	var config trade.Worker
+	result := db.First(&config, &trade.Worker{ChainId: chainId})
+	if result.Error != nil {
+		return nil, fmt.Errorf("No config for chain %s", chainId)
+	}
+	return instantiateCacheOfWorker(db, config)
+}
+
+func deadLetterIds(cmd *cli.Command) []uint {
+	ids := make([]uint, 0)
+	for _, id := range cmd.Uint64Slice("id") {
+		ids = append(ids, uint(id))
+	}
+	return ids
 }
 
 func main() {
@@ -57,6 +146,12 @@ func main() {
 	}
 
 	cmd := &cli.Command{
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "record-fixtures", Usage: "directory to save JSON RPC and Binance responses to as fixtures"},
+			&cli.StringFlag{Name: "replay-fixtures", Usage: "directory to serve JSON RPC and Binance responses from instead of network"},
+			&cli.StringFlag{Name: "static-prices", Usage: "CSV or JSON file of symbol, time and price rows used by static price source"},
+		},
+		Before: before,
 		Commands: []*cli.Command{
 			{
 				Name: "serve",
@@ -67,8 +162,7 @@ func main() {
 					if err != nil {
 						panic("Cannot instantiate cache manager " + err.Error())
 					}
-					Api(db, cm)
-					return nil
+					return Api(ctx, db, cm)
 				},
 			},
 			{
@@ -93,32 +187,272 @@ func main() {
 			{
 				Name:  "index",
 				Usage: "Index events",
+				Commands: []*cli.Command{
+					{
+						Name:  "backfill",
+						Usage: "Index history of wallets in block range using parallel shards",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "chain", Usage: "chain id", Required: true},
+							&cli.Uint64Flag{Name: "from", Usage: "first block of range", Required: true},
+							&cli.Uint64Flag{Name: "to", Usage: "last block of range", Required: true},
+							&cli.StringSliceFlag{Name: "wallet", Usage: "wallet address, can be repeated", Required: true},
+							&cli.IntFlag{Name: "parallel", Usage: "shards processed concurrently", Value: 4},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							cm, err := instantiateCacheOfChain(db, cmd.String("chain"))
+							if err != nil {
+								panic("Cannot instantiate cache manager " + err.Error())
+							}
+							return worker.Backfill(
+								ctx,
+								db,
+								cm,
+								cmd.String("chain"),
+								cmd.StringSlice("wallet"),
+								cmd.Uint64("from"),
+								cmd.Uint64("to"),
+								cmd.Int("parallel"),
+							)
+						},
+					},
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "metrics-addr", Usage: "address to serve /metrics on, e.g. :9100; disabled by default"},
+					&cli.BoolFlag{Name: "follow", Usage: "receive events via websocket log subscriptions, poll only when subscription is down"},
+					&cli.Uint64SliceFlag{Name: "worker", Usage: "id of worker config to run, can be repeated; all workers are run by default"},
+				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
-					cm, err := instantiateCache(db)
+					serveMetrics(ctx, cmd)
+					var configs []trade.Worker
+					query := db.Order("id")
+					if ids := cmd.Uint64Slice("worker"); len(ids) > 0 {
+						query = query.Where("id IN ?", ids)
+					}
+					err := query.Find(&configs).Error
 					if err != nil {
-						panic("Cannot instantiate cache manager " + err.Error())
+						return err
+					}
+					if len(configs) == 0 {
+						return fmt.Errorf("No worker configs to run")
 					}
-					for {
-						worker.Cycle(db, cm, 1)
-						time.Sleep(5 * time.Second)
+					var wg sync.WaitGroup
+					for _, config := range configs {
+						cm, err := instantiateCacheOfWorker(db, config)
+						if err != nil {
+							slog.Error(fmt.Sprintf("Cannot instantiate cache manager of worker %d: %s", config.ID, err.Error()))
+							continue
+						}
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							worker.Supervise(ctx, db, cm, config, cmd.Bool("follow"))
+						}()
 					}
+					wg.Wait()
+					slog.Info("All workers stopped")
+					return nil
+				},
+			},
+			{
+				Name:  "dead-letters",
+				Usage: "Manage block ranges and logs set aside after failed indexing",
+				Commands: []*cli.Command{
+					{
+						Name:  "list",
+						Usage: "List dead letters",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "chain", Usage: "chain id, all chains by default"},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							letters, err := worker.ListDeadLetters(db.WithContext(ctx), cmd.String("chain"))
+							if err != nil {
+								return err
+							}
+							for _, letter := range letters {
+								fmt.Printf(
+									"%d\tchain %s\t%s\t%s\tblocks %d - %d\tattempts %d\tnext retry %s\t%s\n",
+									letter.ID,
+									letter.ChainId,
+									letter.Handler,
+									letter.Kind,
+									letter.FromBlock,
+									letter.ToBlock,
+									letter.Attempts,
+									letter.NextRetryAt.Format(time.RFC3339),
+									letter.Error,
+								)
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "retry",
+						Usage: "Retry dead letters on the next cycle of their worker",
+						Flags: []cli.Flag{
+							&cli.Uint64SliceFlag{Name: "id", Usage: "id of dead letter, can be repeated", Required: true},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							count, err := worker.RetryDeadLetters(db.WithContext(ctx), deadLetterIds(cmd))
+							if err != nil {
+								return err
+							}
+							slog.Info(fmt.Sprintf("%d dead letters are scheduled for retry", count))
+							return nil
+						},
+					},
+					{
+						Name:  "discard",
+						Usage: "Drop dead letters for good",
+						Flags: []cli.Flag{
+							&cli.Uint64SliceFlag{Name: "id", Usage: "id of dead letter, can be repeated", Required: true},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							count, err := worker.DiscardDeadLetters(db.WithContext(ctx), deadLetterIds(cmd))
+							if err != nil {
+								return err
+							}
+							slog.Info(fmt.Sprintf("%d dead letters are discarded", count))
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "rpc",
+				Usage: "Manage JSON RPC URLs of workers",
+				Commands: []*cli.Command{
+					{
+						Name:  "discover",
+						Usage: "Probe JSON RPC URLs of chain listed by chainlist and write working ones to worker config",
+						Flags: []cli.Flag{
+							&cli.Uint64Flag{Name: "chain", Usage: "chain id", Required: true},
+							&cli.StringFlag{Name: "source", Usage: "URL or local file of chainlist rpcs.json", Value: chainlist.RpcsAddress},
+							&cli.IntFlag{Name: "parallel", Usage: "URLs probed concurrently", Value: 8},
+							&cli.BoolFlag{Name: "dry-run", Usage: "only print probing results, worker config is not changed"},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							chains, err := chainlist.Load(ctx, cmd.String("source"))
+							if err != nil {
+								return err
+							}
+							chainId := cmd.Uint64("chain")
+							urls, err := chainlist.Urls(chains, chainId)
+							if err != nil {
+								return err
+							}
+							results, err := chainlist.ProbeAll(ctx, urls, chainId, cmd.Int("parallel"))
+							if err != nil {
+								return err
+							}
+							for _, result := range results {
+								fmt.Printf(
+									"%s\tworking %t\tarchive %s\tlogs range %d\tlatency %d ms\t%s\n",
+									result.Url,
+									result.Working,
+									result.ArchiveState(),
+									result.LogsRange,
+									result.LatencyMs,
+									result.Error,
+								)
+							}
+							if cmd.Bool("dry-run") {
+								return nil
+							}
+							config, err := chainlist.SaveToWorker(db.WithContext(ctx), fmt.Sprintf("%d", chainId), results)
+							if err != nil {
+								return err
+							}
+							slog.Info(fmt.Sprintf("Worker %d of chain %s got %d URLs for cache manager and %d URLs for events", config.ID, config.ChainId, len(config.BlockchainUrlsForCacheManager), len(config.BlockchainUrlsForEvents)))
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "prices",
+				Usage: "Move archive of historical prices between environments",
+				Commands: []*cli.Command{
+					{
+						Name:  "export",
+						Usage: "Write archived candles to CSV",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "output", Usage: "CSV file to write, stdout by default"},
+							&cli.StringFlag{Name: "source", Usage: "price provider, all providers by default"},
+							&cli.StringSliceFlag{Name: "symbol", Usage: "market symbol, can be repeated; all symbols by default"},
+							&cli.TimestampFlag{Name: "from", Usage: "first interval start, date or RFC 3339 time", Config: archiveTimeConfig},
+							&cli.TimestampFlag{Name: "to", Usage: "interval start to stop before, date or RFC 3339 time", Config: archiveTimeConfig},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							output := os.Stdout
+							if path := cmd.String("output"); path != "" {
+								file, err := os.Create(path)
+								if err != nil {
+									return err
+								}
+								defer file.Close()
+								output = file
+							}
+							count, err := prices.Export(db.WithContext(ctx), output, prices.ArchiveFilter{
+								Source:  cmd.String("source"),
+								Symbols: cmd.StringSlice("symbol"),
+								From:    cmd.Timestamp("from"),
+								To:      cmd.Timestamp("to"),
+							})
+							if err != nil {
+								return err
+							}
+							slog.Info(fmt.Sprintf("%d candles are exported", count))
+							return nil
+						},
+					},
+					{
+						Name:  "import",
+						Usage: "Store candles of CSV written by export, archived candles are kept",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "input", Usage: "CSV file to read, stdin by default"},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							input := os.Stdin
+							if path := cmd.String("input"); path != "" {
+								file, err := os.Open(path)
+								if err != nil {
+									return err
+								}
+								defer file.Close()
+								input = file
+							}
+							read, stored, err := prices.Import(db.WithContext(ctx), input)
+							if err != nil {
+								return err
+							}
+							slog.Info(fmt.Sprintf("%d of %d candles are imported, the rest were archived already", stored, read))
+							return nil
+						},
+					},
 				},
 			},
 			{
 				Name:  "analyze",
 				Usage: "Analyze UniswapV3",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "metrics-addr", Usage: "address to serve /metrics on, e.g. :9100; disabled by default"},
+				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
+					serveMetrics(ctx, cmd)
 					cm, err := instantiateCache(db)
 					if err != nil {
 						panic("Cannot instantiate cache manager " + err.Error())
 					}
-					analytics.Analyze(1000000, db, cm)
+					analytics.Analyze(ctx, 1000000, db, cm)
 					return nil
 				},
 			},
 		},
 	}
-	if err := cmd.Run(context.Background(), os.Args); err != nil {
+	// SIGTERM stops scheduling new work; ranges being saved are committed or rolled back before exit
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := cmd.Run(ctx, os.Args); err != nil {
 		panic("Cannot parse command " + err.Error())
 	}
 }
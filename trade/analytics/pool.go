@@ -1,6 +1,7 @@
 package analytics
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"time"
@@ -8,6 +9,7 @@ import (
 	"github.com/samber/lo"
 	"github.com/stryukovsky/go-backend-learn/trade"
 	"github.com/stryukovsky/go-backend-learn/trade/cache"
+	"github.com/stryukovsky/go-backend-learn/trade/metrics"
 	"github.com/stryukovsky/go-backend-learn/trade/protocols/uniswapv3"
 	"github.com/stryukovsky/go-backend-learn/trade/web3client"
 	"gorm.io/gorm"
@@ -41,7 +43,25 @@ func progressiveSave[T any, S []T](db *gorm.DB, items S) S {
 	return saved
 }
 
+// Makes events reference their blocks stored while block timestamps were resolved
+func linkBlocks(db *gorm.DB, chainId string, events []trade.UniswapV3Event) error {
+	numbers := lo.Uniq(lo.Map(events, func(event trade.UniswapV3Event, _ int) uint64 { return event.BlockNumber }))
+	var blocks []trade.Block
+	err := db.Select("id", "number").Where("chain_id = ? AND number IN ?", chainId, numbers).Find(&blocks).Error
+	if err != nil {
+		return err
+	}
+	ids := lo.SliceToMap(blocks, func(block trade.Block) (uint64, uint) { return block.Number, block.ID })
+	for i := range events {
+		if id, ok := ids[events[i].BlockNumber]; ok {
+			events[i].LinkBlock(id)
+		}
+	}
+	return nil
+}
+
 func fetchInteractionsFromEthJSONRPC(
+	ctx context.Context,
 	chainId string,
 	db *gorm.DB,
 	startBlock uint64,
@@ -50,6 +70,7 @@ func fetchInteractionsFromEthJSONRPC(
 ) error {
 	var blockchainInteractions []trade.UniswapV3Event
 	blockchainInteractions, mintedPositions, err := handler.FetchLiquidityInteractions(
+		ctx,
 		chainId,
 		startBlock,
 		endBlock,
@@ -65,6 +86,11 @@ func fetchInteractionsFromEthJSONRPC(
 		slog.Warn(fmt.Sprintf("[%s] No blockchain interactions", handler.Name()))
 		return nil
 	}
+	err = linkBlocks(db, chainId, blockchainInteractions)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("[%s] Cannot find blocks of blockchain interactions: %s", handler.Name(), err.Error()))
+		return err
+	}
 	blockchainInteractions = progressiveSave(db, blockchainInteractions)
 	if len(blockchainInteractions) == 0 {
 		slog.Warn(fmt.Sprintf("[%s] No blockchain interactions saved to database", handler.Name()))
@@ -74,7 +100,7 @@ func fetchInteractionsFromEthJSONRPC(
 		"[%s] Found %d blockchain interactions where tracked wallets participated",
 		handler.Name(),
 		len(blockchainInteractions)))
-	financialInteractions, err := handler.PopulateWithFinanceInfoConcurrently(blockchainInteractions)
+	financialInteractions, err := handler.PopulateWithFinanceInfoConcurrently(ctx, blockchainInteractions)
 	if err != nil {
 		slog.Warn(fmt.Sprintf("[%s] Cannot fetch financial interactions: %s", handler.Name(), err.Error()))
 		return err
@@ -83,7 +109,16 @@ func fetchInteractionsFromEthJSONRPC(
 	return nil
 }
 
-func Analyze(blocksCount uint64, db *gorm.DB, cm *cache.CacheManager) {
+// Remembers error which stopped analytics worker for status API
+func saveError(db *gorm.DB, config *trade.AnalyticsWorker, err error) {
+	now := time.Now()
+	config.LastError = err.Error()
+	config.LastErrorAt = &now
+	db.Save(config)
+}
+
+// Indexes UniswapV3 pools until context is done
+func Analyze(ctx context.Context, blocksCount uint64, db *gorm.DB, cm *cache.CacheManager) {
 	slog.Info("Starting worker")
 	var config trade.AnalyticsWorker
 	result := db.First(&config)
@@ -94,13 +129,13 @@ func Analyze(blocksCount uint64, db *gorm.DB, cm *cache.CacheManager) {
 	startBlock := config.LastBlock
 	currentBlock := startBlock
 
-	client, err := web3client.NewMultiURLClient(config.BlockchainUrls)
+	client, err := web3client.NewMultiURLClient(config.BlockchainUrls, nil)
 	if err != nil {
 		slog.Error(fmt.Sprintf("Failed to connect to Ethereum node: %s", err.Error()))
 		return
 	}
 
-	chainId, err := client.ChainID()
+	chainId, err := client.ChainID(ctx)
 	if err != nil {
 		slog.Warn(fmt.Sprintf("Cannot fetch chain id: %s", err.Error()))
 		return
@@ -119,6 +154,7 @@ func Analyze(blocksCount uint64, db *gorm.DB, cm *cache.CacheManager) {
 	uniswapv3Handlers := make([]*uniswapv3.UniswapV3PoolHandler, 0, len(uniswapV3Pools))
 	for _, uv3pool := range uniswapV3Pools {
 		uniswapv3Handler, err := uniswapv3.NewUniswapV3PoolHandler(
+			ctx,
 			uv3pool,
 			client,
 			cm,
@@ -134,10 +170,13 @@ func Analyze(blocksCount uint64, db *gorm.DB, cm *cache.CacheManager) {
 		uniswapv3Handlers = append(uniswapv3Handlers, uniswapv3Handler)
 	}
 
-	for {
-		lastBlockInBlockchain, err := client.BlockNumber()
+	for ctx.Err() == nil {
+		cycleStarted := time.Now()
+		lastBlockInBlockchain, err := client.BlockNumber(ctx)
 		if err != nil {
 			slog.Warn(fmt.Sprintf("Cannot get last blockchain block: %s", err.Error()))
+			metrics.Cycle(metrics.AnalyticsWorker, chainId.String(), cycleStarted, err)
+			saveError(db, &config, err)
 			return
 		}
 		var tokensFromDB []trade.Token
@@ -149,29 +188,41 @@ func Analyze(blocksCount uint64, db *gorm.DB, cm *cache.CacheManager) {
 		endBlock := min(currentBlock+config.BlocksInterval, lastBlockInBlockchain)
 		if endBlock-startBlock < 50 {
 			slog.Info("Seems we've reached the top of blockchain. Sleep for 3 minutes")
-			time.Sleep(3 * time.Minute)
+			trade.Sleep(ctx, 3*time.Minute)
 			continue
 		}
 		dbTx := db
 		for _, uv3Handler := range uniswapv3Handlers {
 			err = fetchInteractionsFromEthJSONRPC(
+				ctx,
 				chainId.String(),
 				dbTx,
 				currentBlock,
 				endBlock,
 				uv3Handler,
 			)
-			time.Sleep(10 * time.Second)
+			trade.Sleep(ctx, 10*time.Second)
+		}
+		if ctx.Err() != nil {
+			break
 		}
 		if err != nil {
 			slog.Info(fmt.Sprintf("Cannot fetch UniswapV3 interactions due to %s", err.Error()))
+			metrics.Cycle(metrics.AnalyticsWorker, chainId.String(), cycleStarted, err)
+			saveError(db, &config, err)
 			return
 		} else {
 			slog.Info(fmt.Sprintf("Successfully fetched blockchain events so mark worker indexed on block %d", endBlock))
+			now := time.Now()
 			config.LastBlock = endBlock
+			config.HeadBlock = lastBlockInBlockchain
+			config.LastCycleAt = &now
 			db.Save(&config)
+			metrics.Cycle(metrics.AnalyticsWorker, chainId.String(), cycleStarted, nil)
+			metrics.LagBlocks(metrics.AnalyticsWorker, chainId.String(), lastBlockInBlockchain-endBlock)
 			currentBlock = endBlock + 1
 		}
-		time.Sleep(10 * time.Second)
+		trade.Sleep(ctx, 10*time.Second)
 	}
+	slog.Info("Analytics worker stopped")
 }
@@ -3,12 +3,21 @@ package api
 import (
 	"fmt"
 	"log/slog"
+	"maps"
+	"math/big"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/gin-gonic/gin"
 	"github.com/stryukovsky/go-backend-learn/trade"
 	"github.com/stryukovsky/go-backend-learn/trade/cache"
+	"github.com/stryukovsky/go-backend-learn/trade/metrics"
+	"github.com/stryukovsky/go-backend-learn/trade/prices"
+	"github.com/stryukovsky/go-backend-learn/trade/worker"
 	"gorm.io/gorm"
 )
 
@@ -16,9 +25,69 @@ func apiErr(ctx *gin.Context, err error) {
 	ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 }
 
+// Narrows query of events by ?status=pending or ?status=final, so pending and final activity can be shown separately
+// Returned query is a new session, so it can be reused for several finds
+func byConfirmation(ctx *gin.Context, query *gorm.DB, eventsTable string) (*gorm.DB, bool) {
+	switch ctx.Query("status") {
+	case "":
+		return query, true
+	case "pending":
+		return query.Where(eventsTable+".unconfirmed = ?", true).Session(&gorm.Session{}), true
+	case "final":
+		return query.Where(eventsTable+".unconfirmed = ?", false).Session(&gorm.Session{}), true
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown status %s, expected pending or final", ctx.Query("status"))})
+		return nil, false
+	}
+}
+
+// Currency of ?currency=, USD by default. Unknown currency is answered with bad request
+func byCurrency(ctx *gin.Context) (string, bool) {
+	if ctx.Query("currency") == "" {
+		return prices.USD, true
+	}
+	currency, ok := prices.ParseCurrency(ctx.Query("currency"))
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown currency %s, expected one of %s", ctx.Query("currency"), strings.Join(slices.Sorted(maps.Keys(prices.Currencies)), ", "))})
+		return "", false
+	}
+	return currency, true
+}
+
+// Financial interaction able to show its USD values in another currency
+type convertible interface {
+	Convert(currency string, rate *big.Rat, rateSource string)
+}
+
+// Converts financial interactions into currency at rates of times of their events, USD ones are left as is
+func convertAll[Interaction any, InteractionPtr interface {
+	*Interaction
+	convertible
+}](ctx *gin.Context, cm *cache.CacheManager, currency string, interactions []Interaction, timeOf func(Interaction) time.Time) error {
+	if currency == prices.USD || len(interactions) == 0 {
+		return nil
+	}
+	times := make([]time.Time, len(interactions))
+	for i, interaction := range interactions {
+		times[i] = timeOf(interaction)
+	}
+	rates, err := cm.GetCachedCurrencyRates(ctx.Request.Context(), currency, times)
+	if err != nil {
+		return err
+	}
+	for i := range interactions {
+		InteractionPtr(&interactions[i]).Convert(currency, rates[i].Price, rates[i].Source)
+	}
+	return nil
+}
+
 func BalanceByWallet(ctx *gin.Context, db *gorm.DB, cm *cache.CacheManager) {
 	walletAddress := common.HexToAddress(ctx.Param("wallet")).Hex()
-	balance, err := cm.GetCachedBalanceOfWallet(db, walletAddress)
+	currency, ok := byCurrency(ctx)
+	if !ok {
+		return
+	}
+	balance, err := cm.GetCachedBalanceOfWallet(ctx.Request.Context(), db, walletAddress, currency)
 	if err != nil {
 		apiErr(ctx, err)
 		return
@@ -30,7 +99,11 @@ func BalanceByWallet(ctx *gin.Context, db *gorm.DB, cm *cache.CacheManager) {
 func BalanceByWalletAndChain(ctx *gin.Context, db *gorm.DB, cm *cache.CacheManager) {
 	walletAddress := common.HexToAddress(ctx.Param("wallet")).Hex()
 	chainId := ctx.Param("chainId")
-	result, err := cm.GetCachedBalanceOfWalletOnChain(db, chainId, walletAddress)
+	currency, ok := byCurrency(ctx)
+	if !ok {
+		return
+	}
+	result, err := cm.GetCachedBalanceOfWalletOnChain(ctx.Request.Context(), db, chainId, walletAddress, currency)
 	if err != nil {
 		apiErr(ctx, err)
 		return
@@ -69,11 +142,19 @@ func ListChains(ctx *gin.Context, db *gorm.DB) {
 	ctx.JSON(http.StatusOK, chains)
 }
 
-func ListAaveInteractions(ctx *gin.Context, db *gorm.DB) {
+func ListAaveInteractions(ctx *gin.Context, db *gorm.DB, cm *cache.CacheManager) {
 	wallet := common.HexToAddress(ctx.Param("wallet")).Hex()
 	chainId := ctx.Param("chainId")
 	var aaveInteractions []trade.AaveInteraction
-	err := db.Preload("BlockchainEvent").
+	query, ok := byConfirmation(ctx, db, "aave_events")
+	if !ok {
+		return
+	}
+	currency, ok := byCurrency(ctx)
+	if !ok {
+		return
+	}
+	err := query.Preload("BlockchainEvent").
 		Joins("JOIN aave_events ON aave_events.id = aave_interactions.blockchain_event_id").
 		Where("aave_events.wallet_address = ? AND aave_events.chain_id = ?", wallet, chainId).
 		Find(&aaveInteractions).Error
@@ -81,14 +162,27 @@ func ListAaveInteractions(ctx *gin.Context, db *gorm.DB) {
 		apiErr(ctx, err)
 		return
 	}
+	err = convertAll(ctx, cm, currency, aaveInteractions, func(interaction trade.AaveInteraction) time.Time { return interaction.BlockchainEvent.Timestamp })
+	if err != nil {
+		apiErr(ctx, err)
+		return
+	}
 	ctx.JSON(http.StatusOK, aaveInteractions)
 }
 
-func ListCompound3Interactions(ctx *gin.Context, db *gorm.DB) {
+func ListCompound3Interactions(ctx *gin.Context, db *gorm.DB, cm *cache.CacheManager) {
 	wallet := common.HexToAddress(ctx.Param("wallet")).Hex()
 	chainId := ctx.Param("chainId")
 	var compoundInteractions []trade.Compound3Interaction
-	err := db.Preload("BlockchainEvent").
+	query, ok := byConfirmation(ctx, db, "compound3_events")
+	if !ok {
+		return
+	}
+	currency, ok := byCurrency(ctx)
+	if !ok {
+		return
+	}
+	err := query.Preload("BlockchainEvent").
 		Joins("JOIN compound3_events ON compound3_events.id = compound3_interactions.blockchain_event_id").
 		Where("compound3_events.wallet_address = ? AND compound3_events.chain_id = ?", wallet, chainId).
 		Find(&compoundInteractions).Error
@@ -96,13 +190,18 @@ func ListCompound3Interactions(ctx *gin.Context, db *gorm.DB) {
 		apiErr(ctx, err)
 		return
 	}
+	err = convertAll(ctx, cm, currency, compoundInteractions, func(interaction trade.Compound3Interaction) time.Time { return interaction.BlockchainEvent.Timestamp })
+	if err != nil {
+		apiErr(ctx, err)
+		return
+	}
 	ctx.JSON(http.StatusOK, compoundInteractions)
 }
 
 func GetTokenBalancesByChain(ctx *gin.Context, db *gorm.DB, cm *cache.CacheManager) {
 	chainId := ctx.Param("chainId")
 
-	tokenBalances, err := cm.GetCachedTokenBalancesByChain(db, chainId)
+	tokenBalances, err := cm.GetCachedTokenBalancesByChain(ctx.Request.Context(), db, chainId)
 	if err != nil {
 		apiErr(ctx, err)
 		return
@@ -112,11 +211,19 @@ func GetTokenBalancesByChain(ctx *gin.Context, db *gorm.DB, cm *cache.CacheManag
 	ctx.JSON(http.StatusOK, tokenBalances)
 }
 
-func ListUniswapV3Interactions(ctx *gin.Context, db *gorm.DB) {
+func ListUniswapV3Interactions(ctx *gin.Context, db *gorm.DB, cm *cache.CacheManager) {
 	wallet := common.HexToAddress(ctx.Param("wallet")).Hex()
 	chainId := ctx.Param("chainId")
 	var uniswapv3Interactions []trade.UniswapV3Deal
-	err := db.Preload("BlockchainEvent").
+	query, ok := byConfirmation(ctx, db, "uniswap_v3_events")
+	if !ok {
+		return
+	}
+	currency, ok := byCurrency(ctx)
+	if !ok {
+		return
+	}
+	err := query.Preload("BlockchainEvent").
 		Joins("JOIN uniswap_v3_events ON uniswap_v3_events.id = uniswap_v3_deals.blockchain_event_id").
 		Where("uniswap_v3_events.wallet_address = ? AND uniswap_v3_events.chain_id = ?", wallet, chainId).
 		Find(&uniswapv3Interactions).Error
@@ -124,15 +231,28 @@ func ListUniswapV3Interactions(ctx *gin.Context, db *gorm.DB) {
 		apiErr(ctx, err)
 		return
 	}
+	err = convertAll(ctx, cm, currency, uniswapv3Interactions, func(interaction trade.UniswapV3Deal) time.Time { return interaction.BlockchainEvent.Timestamp })
+	if err != nil {
+		apiErr(ctx, err)
+		return
+	}
 	ctx.JSON(http.StatusOK, uniswapv3Interactions)
 }
 
-func ListDealsByWalletAndChain(ctx *gin.Context, db *gorm.DB) {
+func ListDealsByWalletAndChain(ctx *gin.Context, db *gorm.DB, cm *cache.CacheManager) {
 	wallet := common.HexToAddress(ctx.Param("wallet")).Hex()
 	chainId := ctx.Param("chainId")
 
+	query, ok := byConfirmation(ctx, db, "erc20_transfers")
+	if !ok {
+		return
+	}
+	currency, ok := byCurrency(ctx)
+	if !ok {
+		return
+	}
 	dealsAsSender := []trade.Deal{}
-	err := db.Preload("BlockchainTransfer").
+	err := query.Preload("BlockchainTransfer").
 		Joins("JOIN erc20_transfers ON erc20_transfers.id = deals.blockchain_transfer_id").
 		Where("erc20_transfers.sender = ? AND erc20_transfers.chain_id = ?", wallet, chainId).
 		Find(&dealsAsSender).Error
@@ -142,7 +262,7 @@ func ListDealsByWalletAndChain(ctx *gin.Context, db *gorm.DB) {
 	}
 
 	dealsAsRecipient := []trade.Deal{}
-	err = db.Preload("BlockchainTransfer").
+	err = query.Preload("BlockchainTransfer").
 		Joins("JOIN erc20_transfers ON erc20_transfers.id = deals.blockchain_transfer_id").
 		Where("erc20_transfers.recipient = ? AND erc20_transfers.chain_id = ?", wallet, chainId).
 		Find(&dealsAsRecipient).Error
@@ -151,6 +271,18 @@ func ListDealsByWalletAndChain(ctx *gin.Context, db *gorm.DB) {
 		return
 	}
 
+	dealTime := func(deal trade.Deal) time.Time { return deal.BlockchainTransfer.Timestamp }
+	err = convertAll(ctx, cm, currency, dealsAsSender, dealTime)
+	if err != nil {
+		apiErr(ctx, err)
+		return
+	}
+	err = convertAll(ctx, cm, currency, dealsAsRecipient, dealTime)
+	if err != nil {
+		apiErr(ctx, err)
+		return
+	}
+
 	result := trade.NewDealsByWallet(wallet, dealsAsRecipient, dealsAsSender)
 	ctx.JSON(http.StatusOK, result)
 }
@@ -166,7 +298,53 @@ func ListTokensByChain(ctx *gin.Context, db *gorm.DB) {
 	ctx.JSON(http.StatusOK, tokens)
 }
 
+func ListDeadLetters(ctx *gin.Context, db *gorm.DB) {
+	letters, err := worker.ListDeadLetters(db.WithContext(ctx.Request.Context()), ctx.Query("chainId"))
+	if err != nil {
+		apiErr(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, letters)
+}
+
+func RetryDeadLetter(ctx *gin.Context, db *gorm.DB) {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	count, err := worker.RetryDeadLetters(db.WithContext(ctx.Request.Context()), []uint{uint(id)})
+	if err != nil {
+		apiErr(ctx, err)
+		return
+	}
+	if count == 0 {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("No dead letter %d", id)})
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+func DiscardDeadLetter(ctx *gin.Context, db *gorm.DB) {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	count, err := worker.DiscardDeadLetters(db.WithContext(ctx.Request.Context()), []uint{uint(id)})
+	if err != nil {
+		apiErr(ctx, err)
+		return
+	}
+	if count == 0 {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("No dead letter %d", id)})
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
 func CreateApi(router *gin.Engine, db *gorm.DB, cm *cache.CacheManager) {
+	router.GET("/metrics", gin.WrapH(metrics.Handler()))
 	router.GET("/api/wallets", func(ctx *gin.Context) {
 		ListWallets(ctx, db)
 	})
@@ -183,16 +361,16 @@ func CreateApi(router *gin.Engine, db *gorm.DB, cm *cache.CacheManager) {
 		BalanceByWallet(ctx, db, cm)
 	})
 	router.GET("/api/deals/:chainId/:wallet", func(ctx *gin.Context) {
-		ListDealsByWalletAndChain(ctx, db)
+		ListDealsByWalletAndChain(ctx, db, cm)
 	})
 	router.GET("/api/aave/:chainId/:wallet", func(ctx *gin.Context) {
-		ListAaveInteractions(ctx, db)
+		ListAaveInteractions(ctx, db, cm)
 	})
 	router.GET("/api/uniswapv3/:chainId/:wallet", func(ctx *gin.Context) {
-		ListUniswapV3Interactions(ctx, db)
+		ListUniswapV3Interactions(ctx, db, cm)
 	})
 	router.GET("/api/compound3/:chainId/:wallet", func(ctx *gin.Context) {
-		ListCompound3Interactions(ctx, db)
+		ListCompound3Interactions(ctx, db, cm)
 	})
 	router.GET("/api/chain/:chainId/token-balances", func(ctx *gin.Context) {
 		GetTokenBalancesByChain(ctx, db, cm)
@@ -200,4 +378,19 @@ func CreateApi(router *gin.Engine, db *gorm.DB, cm *cache.CacheManager) {
 	router.GET("/api/:chainId/tokens", func(ctx *gin.Context) {
 		ListTokensByChain(ctx, db)
 	})
+	router.GET("/api/status", func(ctx *gin.Context) {
+		GetStatus(ctx, db)
+	})
+	router.GET("/api/status/:chainId", func(ctx *gin.Context) {
+		GetChainStatus(ctx, db)
+	})
+	router.GET("/api/dead-letters", func(ctx *gin.Context) {
+		ListDeadLetters(ctx, db)
+	})
+	router.POST("/api/dead-letters/:id/retry", func(ctx *gin.Context) {
+		RetryDeadLetter(ctx, db)
+	})
+	router.DELETE("/api/dead-letters/:id", func(ctx *gin.Context) {
+		DiscardDeadLetter(ctx, db)
+	})
 }
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"gorm.io/gorm"
+)
+
+type WalletStatus struct {
+	Address   string `json:"address"`
+	LastBlock uint64 `json:"lastBlock"`
+	LagBlocks uint64 `json:"lagBlocks"`
+}
+
+type HandlerStatus struct {
+	Handler string `json:"handler"`
+	// Block reached by the slowest wallet of handler
+	LastBlock uint64         `json:"lastBlock"`
+	LagBlocks uint64         `json:"lagBlocks"`
+	Wallets   []WalletStatus `json:"wallets"`
+}
+
+type ChainStatus struct {
+	ChainId      string `json:"chainId"`
+	WorkerId     uint   `json:"workerId"`
+	HeadBlock    uint64 `json:"headBlock"`
+	FinalBlock   uint64 `json:"finalBlock"`
+	IndexedBlock uint64 `json:"indexedBlock"`
+	LagBlocks    uint64 `json:"lagBlocks"`
+	// Age of the indexed block, zero until the first successful cycle
+	LagSeconds     float64          `json:"lagSeconds"`
+	LastCycleAt    *time.Time       `json:"lastCycleAt"`
+	LastError      string           `json:"lastError"`
+	LastErrorAt    *time.Time       `json:"lastErrorAt"`
+	Wallets        []WalletStatus   `json:"wallets"`
+	Handlers       []HandlerStatus  `json:"handlers"`
+	Events         map[string]int64 `json:"events"`
+	UnpricedEvents map[string]int64 `json:"unpricedEvents"`
+	DeadLetters    int64            `json:"deadLetters"`
+}
+
+type AnalyticsStatus struct {
+	WorkerId    uint       `json:"workerId"`
+	HeadBlock   uint64     `json:"headBlock"`
+	LastBlock   uint64     `json:"lastBlock"`
+	LagBlocks   uint64     `json:"lagBlocks"`
+	LastCycleAt *time.Time `json:"lastCycleAt"`
+	LastError   string     `json:"lastError"`
+	LastErrorAt *time.Time `json:"lastErrorAt"`
+}
+
+type Status struct {
+	Chains    []ChainStatus     `json:"chains"`
+	Analytics []AnalyticsStatus `json:"analytics"`
+}
+
+// Event tables of protocols keyed by protocol name
+var protocolEvents = []struct {
+	protocol string
+	model    any
+}{
+	{"erc20", &trade.ERC20Transfer{}},
+	{"aave", &trade.AaveEvent{}},
+	{"compound3", &trade.Compound3Event{}},
+	{"uniswapv3", &trade.UniswapV3Event{}},
+}
+
+func lag(head uint64, block uint64) uint64 {
+	if head > block {
+		return head - block
+	}
+	return 0
+}
+
+func chainStatus(db *gorm.DB, config trade.Worker) (*ChainStatus, error) {
+	status := &ChainStatus{
+		ChainId:        config.ChainId,
+		WorkerId:       config.ID,
+		HeadBlock:      config.HeadBlock,
+		FinalBlock:     config.FinalBlock,
+		IndexedBlock:   config.IndexedBlock,
+		LagBlocks:      lag(config.FinalBlock, config.IndexedBlock),
+		LastCycleAt:    config.LastCycleAt,
+		LastError:      config.LastError,
+		LastErrorAt:    config.LastErrorAt,
+		Wallets:        make([]WalletStatus, 0),
+		Handlers:       make([]HandlerStatus, 0),
+		Events:         make(map[string]int64),
+		UnpricedEvents: make(map[string]int64),
+	}
+	if config.IndexedBlockTime != nil {
+		status.LagSeconds = time.Since(*config.IndexedBlockTime).Seconds()
+	}
+
+	var wallets []trade.TrackedWallet
+	err := db.Order("address").Find(&wallets, &trade.TrackedWallet{ChainId: config.ChainId}).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, wallet := range wallets {
+		status.Wallets = append(status.Wallets, WalletStatus{
+			Address:   wallet.Address,
+			LastBlock: wallet.LastBlock,
+			LagBlocks: lag(config.FinalBlock, wallet.LastBlock),
+		})
+	}
+
+	var checkpoints []trade.Checkpoint
+	err = db.Order("handler, wallet").Find(&checkpoints, &trade.Checkpoint{ChainId: config.ChainId}).Error
+	if err != nil {
+		return nil, err
+	}
+	handlers := make(map[string]*HandlerStatus)
+	for _, checkpoint := range checkpoints {
+		handler, ok := handlers[checkpoint.Handler]
+		if !ok {
+			handler = &HandlerStatus{Handler: checkpoint.Handler, LastBlock: checkpoint.LastBlock}
+			handlers[checkpoint.Handler] = handler
+		}
+		handler.LastBlock = min(handler.LastBlock, checkpoint.LastBlock)
+		handler.Wallets = append(handler.Wallets, WalletStatus{
+			Address:   checkpoint.Wallet,
+			LastBlock: checkpoint.LastBlock,
+			LagBlocks: lag(config.FinalBlock, checkpoint.LastBlock),
+		})
+	}
+	for _, handler := range handlers {
+		handler.LagBlocks = lag(config.FinalBlock, handler.LastBlock)
+		status.Handlers = append(status.Handlers, *handler)
+	}
+	sort.Slice(status.Handlers, func(i, j int) bool { return status.Handlers[i].Handler < status.Handlers[j].Handler })
+
+	for _, events := range protocolEvents {
+		var count, unpriced int64
+		err = db.Model(events.model).Where("chain_id = ?", config.ChainId).Count(&count).Error
+		if err != nil {
+			return nil, err
+		}
+		err = db.Model(events.model).Where("chain_id = ? AND unpriced", config.ChainId).Count(&unpriced).Error
+		if err != nil {
+			return nil, err
+		}
+		status.Events[events.protocol] = count
+		status.UnpricedEvents[events.protocol] = unpriced
+	}
+	err = db.Model(&trade.DeadLetter{}).Where("chain_id = ?", config.ChainId).Count(&status.DeadLetters).Error
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func GetStatus(ctx *gin.Context, db *gorm.DB) {
+	db = db.WithContext(ctx.Request.Context())
+	var workers []trade.Worker
+	err := db.Order("id").Find(&workers).Error
+	if err != nil {
+		apiErr(ctx, err)
+		return
+	}
+	result := Status{Chains: make([]ChainStatus, 0, len(workers)), Analytics: make([]AnalyticsStatus, 0)}
+	for _, config := range workers {
+		status, err := chainStatus(db, config)
+		if err != nil {
+			apiErr(ctx, err)
+			return
+		}
+		result.Chains = append(result.Chains, *status)
+	}
+	var analyticsWorkers []trade.AnalyticsWorker
+	err = db.Order("id").Find(&analyticsWorkers).Error
+	if err != nil {
+		apiErr(ctx, err)
+		return
+	}
+	for _, config := range analyticsWorkers {
+		result.Analytics = append(result.Analytics, AnalyticsStatus{
+			WorkerId:    config.ID,
+			HeadBlock:   config.HeadBlock,
+			LastBlock:   config.LastBlock,
+			LagBlocks:   lag(config.HeadBlock, config.LastBlock),
+			LastCycleAt: config.LastCycleAt,
+			LastError:   config.LastError,
+			LastErrorAt: config.LastErrorAt,
+		})
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+func GetChainStatus(ctx *gin.Context, db *gorm.DB) {
+	db = db.WithContext(ctx.Request.Context())
+	chainId := ctx.Param("chainId")
+	var config trade.Worker
+	err := db.First(&config, &trade.Worker{ChainId: chainId}).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("No worker for chain %s", chainId)})
+		return
+	}
+	if err != nil {
+		apiErr(ctx, err)
+		return
+	}
+	status, err := chainStatus(db, config)
+	if err != nil {
+		apiErr(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, status)
+}
@@ -1,6 +1,7 @@
 package binance
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,11 +12,16 @@ import (
 	"net/url"
 	"runtime/debug"
 	"time"
+
+	"github.com/stryukovsky/go-backend-learn/trade/metrics"
 )
 
 var BinanceAddress string = "https://api.binance.com"
 var QuoteEndpoint = "/api/v3/klines"
 
+// HTTP client of Binance requests, replaced to record or replay fixtures
+var HTTPClient = http.DefaultClient
+
 func GetQuoteId(tokenTicker string, baseTicker string) string {
 	return tokenTicker + baseTicker
 }
@@ -25,21 +31,55 @@ var (
 	MalformedPrice     error = errors.New("Malformed price string value")
 )
 
-func GetClosePrice(symbol string, instant *time.Time) (*big.Rat, error) {
-	if symbol == "USDT" {
-		return big.NewRat(1, 1), nil
+// Candles of a single klines request, the most Binance returns
+const MaxKlinesLimit = 1000
+
+var NoCandle error = errors.New("No candle since requested time")
+
+// 1 minute candle of pair, prices are in quote asset of pair
+type Kline struct {
+	OpenTime time.Time
+	Open     *big.Rat
+	High     *big.Rat
+	Low      *big.Rat
+	Close    *big.Rat
+}
+
+// Close price of the first 1 minute candle of pair starting at instant or later, in quote asset of pair
+func GetClosePrice(ctx context.Context, pair string, instant *time.Time) (*big.Rat, error) {
+	klines, err := GetKlines(ctx, pair, *instant, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(klines) == 0 {
+		return nil, NoCandle
 	}
+	return klines[0].Close, nil
+}
+
+// Up to limit consecutive 1 minute candles of pair from start on; minutes pair was not traded are missing
+func GetKlines(ctx context.Context, pair string, start time.Time, limit int) ([]Kline, error) {
+	klines, err := fetchKlines(ctx, pair, start, min(limit, MaxKlinesLimit))
+	metrics.BinanceRequest(err)
+	return klines, err
+}
+
+func fetchKlines(ctx context.Context, pair string, start time.Time, limit int) ([]Kline, error) {
 	params := url.Values{}
-	params.Add("symbol", GetQuoteId(symbol, "USDT"))
+	params.Add("symbol", pair)
 	params.Add("interval", "1m")
-	params.Add("startTime", fmt.Sprintf("%d", instant.UnixMilli()))
-	params.Add("limit", "1")
+	params.Add("startTime", fmt.Sprintf("%d", start.UnixMilli()))
+	params.Add("limit", fmt.Sprintf("%d", limit))
 	url, err := url.Parse(BinanceAddress + QuoteEndpoint + "?" + params.Encode())
 	if err != nil {
 		return nil, err
 	}
 	urlString := url.String()
-	response, err := http.Get(urlString)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, urlString, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := HTTPClient.Do(request)
 	if err != nil {
 		return nil, err
 	}
@@ -57,15 +97,47 @@ func GetClosePrice(symbol string, instant *time.Time) (*big.Rat, error) {
 		return nil, BinanceFetchFailed
 	}
 
-	var quote [][]any
-	err = json.Unmarshal(body, &quote)
+	var quotes [][]any
+	err = json.Unmarshal(body, &quotes)
 	if err != nil {
 		return nil, err
 	}
-	closePrice := big.NewRat(1, 1)
-	closePrice, success := closePrice.SetString(quote[0][4].(string))
-	if !success {
-		return nil, MalformedPrice
+	klines := make([]Kline, 0, len(quotes))
+	for _, quote := range quotes {
+		kline, err := parseKline(quote)
+		if err != nil {
+			return nil, err
+		}
+		klines = append(klines, kline)
+	}
+	return klines, nil
+}
+
+// Kline is an array of open time in ms, then open, high, low and close prices as strings, then fields not needed here
+func parseKline(quote []any) (Kline, error) {
+	if len(quote) < 5 {
+		return Kline{}, MalformedPrice
+	}
+	openTime, ok := quote[0].(float64)
+	if !ok {
+		return Kline{}, MalformedPrice
+	}
+	prices := make([]*big.Rat, 4)
+	for i := range prices {
+		value, ok := quote[i+1].(string)
+		if !ok {
+			return Kline{}, MalformedPrice
+		}
+		prices[i], ok = new(big.Rat).SetString(value)
+		if !ok {
+			return Kline{}, MalformedPrice
+		}
 	}
-	return closePrice, nil
+	return Kline{
+		OpenTime: time.UnixMilli(int64(openTime)),
+		Open:     prices[0],
+		High:     prices[1],
+		Low:      prices[2],
+		Close:    prices[3],
+	}, nil
 }
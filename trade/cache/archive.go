@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/prices"
+	"gorm.io/gorm/clause"
+)
+
+// Candle archived in database, price of the same moment is never fetched from provider twice
+type archivedCandle struct {
+	symbol string
+	start  int64
+}
+
+// Closes of archived candles of provider among wanted ones, queried symbol by symbol
+func (cm *CacheManager) archivedCloses(ctx context.Context, source string, wanted []archivedCandle) (map[archivedCandle]trade.DBNumeric, error) {
+	starts := make(map[string][]time.Time)
+	for _, candle := range wanted {
+		starts[candle.symbol] = append(starts[candle.symbol], time.UnixMilli(candle.start))
+	}
+	result := make(map[archivedCandle]trade.DBNumeric, len(wanted))
+	db := cm.db.WithContext(ctx)
+	for symbol, symbolStarts := range starts {
+		var stored []trade.Price
+		err := db.Where("source = ? AND symbol = ? AND interval_start IN ?", source, symbol, symbolStarts).Find(&stored).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, price := range stored {
+			result[archivedCandle{symbol: price.Symbol, start: price.IntervalStart.UnixMilli()}] = price.Close
+		}
+	}
+	return result, nil
+}
+
+// Stores fetched candles of provider; candle archived meanwhile by another worker wins, since candles of the past do not change
+func (cm *CacheManager) archiveCandles(ctx context.Context, source string, candles []prices.Candle) error {
+	if len(candles) == 0 {
+		return nil
+	}
+	rows := make([]trade.Price, len(candles))
+	for i, candle := range candles {
+		rows[i] = candle.Row(source)
+	}
+	return cm.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&rows, 500).Error
+}
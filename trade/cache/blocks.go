@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/metrics"
+	"gorm.io/gorm/clause"
+)
+
+func (cm *CacheManager) blockKey(block uint64) string {
+	return fmt.Sprintf("block:%s:%d", cm.chainId, block)
+}
+
+// Cached block is its timestamp and hash. Values cached before blocks were stored hold timestamp only and are treated as missing,
+// so every cached block is guaranteed to be stored in database
+func blockCacheValue(block trade.Block) string {
+	return fmt.Sprintf("%d:%s", block.Timestamp.Unix(), block.Hash)
+}
+
+func parseBlockCacheValue(value string) (time.Time, bool) {
+	timestampString, hash, found := strings.Cut(value, ":")
+	if !found || hash == "" {
+		return time.Time{}, false
+	}
+	timestamp, err := strconv.ParseInt(timestampString, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(timestamp, 0), true
+}
+
+// Timestamps of blocks read through cache, then database in one round trip each. Blocks missing in both are fetched
+// from blockchain with batched eth_getBlockByNumber requests, stored in database and then written to cache in one pipeline
+func (cm *CacheManager) GetCachedBlockTimestamps(ctx context.Context, blocks []uint64) (trade.BlockTimestamps, error) {
+	result := make(trade.BlockTimestamps, len(blocks))
+	if len(blocks) == 0 {
+		return result, nil
+	}
+	keys := make([]string, len(blocks))
+	for i, block := range blocks {
+		keys[i] = cm.blockKey(block)
+	}
+	cachedValues, err := cm.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		// cache is only read-through, blocks are served by database and blockchain while it is down
+		slog.Warn(fmt.Sprintf("[Cache] Cannot read %d blocks from cache: %s", len(keys), err.Error()))
+		cachedValues = make([]any, len(keys))
+	}
+	missing := make([]uint64, 0)
+	for i, value := range cachedValues {
+		valueString, _ := value.(string)
+		timestamp, ok := parseBlockCacheValue(valueString)
+		if !ok {
+			metrics.CacheMiss(keys[i])
+			missing = append(missing, blocks[i])
+			continue
+		}
+		metrics.CacheHit(keys[i])
+		result[blocks[i]] = timestamp
+	}
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	db := cm.db.WithContext(ctx)
+	var stored []trade.Block
+	err = db.Where("chain_id = ? AND number IN ?", cm.chainId, missing).Find(&stored).Error
+	if err != nil {
+		return nil, err
+	}
+	toCache := stored
+	for _, block := range stored {
+		result[block.Number] = block.Timestamp
+	}
+	unknown := make([]uint64, 0)
+	for _, block := range missing {
+		if _, ok := result[block]; !ok {
+			unknown = append(unknown, block)
+		}
+	}
+	if len(unknown) > 0 {
+		slog.Debug(fmt.Sprintf("[Cache] %d of %d blocks are new, fetching their headers from blockchain", len(unknown), len(blocks)))
+		headers, err := cm.client.BlockHeaders(ctx, unknown)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("[Cache] Cannot get headers of %d blocks: %s", len(unknown), err.Error()))
+			return nil, err
+		}
+		fetched := make([]trade.Block, len(headers))
+		for i, header := range headers {
+			fetched[i] = trade.NewBlock(cm.chainId, uint64(header.Number), header.Hash, header.ParentHash, uint64(header.Time))
+			result[fetched[i].Number] = fetched[i].Timestamp
+		}
+		// block stored meanwhile by another handler wins, reorganization detection sorts out differing hashes
+		err = db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&fetched, 500).Error
+		if err != nil {
+			return nil, err
+		}
+		toCache = append(toCache, fetched...)
+	}
+
+	pipe := cm.rdb.Pipeline()
+	for _, block := range toCache {
+		pipe.Set(ctx, cm.blockKey(block.Number), blockCacheValue(block), 0)
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		// blocks are stored already, they are read from database until cache is written next time
+		slog.Warn(fmt.Sprintf("[Cache] Cannot write %d blocks to cache: %s", len(toCache), err.Error()))
+	}
+	return result, nil
+}
+
+// Drops cached blocks, e.g. orphaned by chain reorganization, so they are read from database or blockchain again
+func (cm *CacheManager) ForgetBlocks(ctx context.Context, blocks []uint64) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+	pipe := cm.rdb.Pipeline()
+	for _, block := range blocks {
+		pipe.Del(ctx, cm.blockKey(block))
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
@@ -7,164 +7,131 @@ import (
 	"fmt"
 	"log/slog"
 	"math/big"
-	"strconv"
 	"time"
 
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/lib/pq"
 	"github.com/redis/go-redis/v9"
 	"github.com/stryukovsky/go-backend-learn/trade"
-	"github.com/stryukovsky/go-backend-learn/trade/binance"
+	"github.com/stryukovsky/go-backend-learn/trade/metrics"
+	"github.com/stryukovsky/go-backend-learn/trade/prices"
+	"github.com/stryukovsky/go-backend-learn/trade/web3client"
 	"gorm.io/gorm"
 )
 
 var BadRationalValue error = errors.New("Bad rational value stored in cache")
 
-type CacheEthJSONRPC struct {
-	RpcUrl string
-	Eth    ethclient.Client
-}
+const chainIdTimeout = 30 * time.Second
 
+// Cache of a single chain: block keys include chain id, since chains share redis.
+// Blocks are stored in database, cache is only a read-through tier in front of it
 type CacheManager struct {
-	clients []CacheEthJSONRPC
+	db      *gorm.DB
+	chainId string
+	client  *web3client.MultiURLClient
 	rdb     redis.Client
+	oracles prices.Chain
 }
 
-func NewCacheManager(ethereumUrls pq.StringArray, redisAddr, redisPassword string, redisDb int) (*CacheManager, error) {
-	clients := make([]CacheEthJSONRPC, 0)
-	for _, url := range ethereumUrls {
-		client, err := ethclient.Dial(url)
+// Block headers are fetched through the shared JSON RPC pool, so endpoints failing for indexing are avoided here too
+// and limits of providers are shared with handlers
+func NewCacheManager(db *gorm.DB, chainId string, ethereumUrls pq.StringArray, rpcLimits trade.RpcLimits, redisAddr, redisPassword string, redisDb int) (*CacheManager, error) {
+	client, err := web3client.NewMultiURLClient(ethereumUrls, rpcLimits)
+	if err != nil {
+		return nil, err
+	}
+	if chainId == "" {
+		chainId, err = resolveChainId(client)
 		if err != nil {
-			slog.Warn(fmt.Sprintf("Failed to connect to JSON RPC %s: %v", url, err))
-		} else {
-			clients = append(clients, CacheEthJSONRPC{Eth: *client, RpcUrl: url})
+			return nil, err
 		}
 	}
-	if len(clients) == 0 {
-		return nil, fmt.Errorf("No available JSON RPC found")
-	}
 	rdb := redis.NewClient(&redis.Options{
 		Addr:     redisAddr,
 		Password: redisPassword,
 		DB:       redisDb,
 	})
-	return &CacheManager{clients, *rdb}, nil
+	cm := &CacheManager{db: db, chainId: chainId, client: client, rdb: *rdb}
+	cm.oracles = prices.Chain{
+		prices.NewBinanceOracle(),
+		prices.NewChainlinkOracle(client, cm.lookupToken, cm.counterpartPrice),
+		prices.NewUniswapV3Oracle(client, cm.lookupToken, cm.counterpartPrice),
+		prices.Static,
+	}
+	return cm, nil
 }
 
-func (cm *CacheManager) GetBasicClient() *ethclient.Client {
-	return &cm.clients[0].Eth
+// Workers created before chain id was stored have it empty, chain id of their endpoints is used then,
+// so blocks of different chains are never mixed
+func resolveChainId(client *web3client.MultiURLClient) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), chainIdTimeout)
+	defer cancel()
+	chainId, err := client.ChainID(ctx)
+	if err != nil {
+		return "", fmt.Errorf("Cannot resolve chain id of cache: %w", err)
+	}
+	return chainId.String(), nil
 }
 
-func (cm *CacheManager) GetReadonlyClient() *CacheEthJSONRPC {
-	if len(cm.clients) > 1 {
-		result := trade.RandomChoice(cm.clients[1:])
-		return &result
-	} else if len(cm.clients) == 1 {
-		return &cm.clients[0]
-	} else {
-		panic("No eth clients for cache client")
-	}
+// Chain id of blocks and prices cached
+func (cm *CacheManager) ChainId() string {
+	return cm.chainId
 }
 
-func (cm *CacheManager) Set(key string, value any) error {
+func (cm *CacheManager) Set(ctx context.Context, key string, value any) error {
 	return cm.rdb.Set(ctx, key, value, 0).Err()
 }
 
-func (cm *CacheManager) SetWithTTL(key string, value any, ttl time.Duration) error {
+func (cm *CacheManager) SetWithTTL(ctx context.Context, key string, value any, ttl time.Duration) error {
 	return cm.rdb.Set(ctx, key, value, ttl).Err()
 }
 
-func (cm *CacheManager) Get(key string) (string, error) {
-	return cm.rdb.Get(ctx, key).Result()
+// Reads key, hits and misses are recorded in metrics by key family
+func (cm *CacheManager) Get(ctx context.Context, key string) (string, error) {
+	value, err := cm.rdb.Get(ctx, key).Result()
+	if err == nil {
+		metrics.CacheHit(key)
+	} else if err == redis.Nil {
+		metrics.CacheMiss(key)
+	}
+	return value, err
 }
 
-var ctx = context.Background()
-
-func (cm *CacheManager) GetCachedBlockTimestamp(block uint64) (*time.Time, error) {
-	blockIdentifierStr := fmt.Sprintf("block:%d", block)
-	timestampString, err := cm.Get(blockIdentifierStr)
-	if err != nil {
-		if err != redis.Nil {
-			return nil, err
+// Balance in currency: volume of each deal is converted at rate of time of its transfer, USD volumes are summed as is
+func (cm *CacheManager) calculateBalance(ctx context.Context, currency string, income []trade.Deal, outcome []trade.Deal) (string, error) {
+	deals := append(append(make([]trade.Deal, 0, len(income)+len(outcome)), income...), outcome...)
+	var rates []*prices.Quote
+	if currency != prices.USD {
+		times := make([]time.Time, len(deals))
+		for i, deal := range deals {
+			times[i] = deal.BlockchainTransfer.Timestamp
 		}
-		slog.Debug(fmt.Sprintf("[Cache] Block %s is new, fetching its date from blockchain", blockIdentifierStr))
-
-		client := cm.GetReadonlyClient()
-		blockHeader, err := client.Eth.HeaderByNumber(context.Background(), big.NewInt(int64(block)))
+		var err error
+		rates, err = cm.GetCachedCurrencyRates(ctx, currency, times)
 		if err != nil {
-			slog.Warn(fmt.Sprintf("[Cache] Cannot get block header for %d block using %s: %s", block, client.RpcUrl, err.Error()))
-			return nil, err
-		}
-		time.Sleep(time.Second * 1)
-		blockTimestamp := blockHeader.Time
-		if blockTimestamp <= 0 {
-			return nil, fmt.Errorf("[Cache] Invalid timestamp. Timestamp: %d", blockTimestamp)
+			return "", err
 		}
-		blockTimestampString := fmt.Sprintf("%d", blockTimestamp)
-		err = cm.Set(blockIdentifierStr, blockTimestampString)
-		if err != nil {
-			slog.Warn(fmt.Sprintf("[Cache] Cannot update value in cache %s=%s", blockIdentifierStr, blockTimestampString))
-			return nil, err
-		}
-		slog.Debug(fmt.Sprintf("[Cache] Written to cache pair %s = %s", blockIdentifierStr, blockTimestampString))
-		result := time.Unix(int64(blockTimestamp), 0)
-		return &result, nil
-	}
-	slog.Debug(fmt.Sprintf("[Cache] Block %d is already cached with unix timestamp %s", block, timestampString))
-	timestamp, err := strconv.ParseInt(timestampString, 10, 64)
-	if err != nil {
-		return nil, err
 	}
-	result := time.Unix(timestamp, 0)
-	return &result, nil
-}
-
-func (cm *CacheManager) GetCachedSymbolPriceAtTime(symbol string, instant *time.Time) (*big.Rat, error) {
-	truncated := instant.Truncate(5 * time.Minute)
-	instantString := fmt.Sprintf("%d", truncated.UnixMilli())
-	identifierStr := fmt.Sprintf("quote:%s:%s", symbol, instantString)
-	quoteString, err := cm.Get(identifierStr)
-	if err != nil {
-		if err == redis.Nil {
-			price, err := binance.GetClosePrice(symbol, &truncated)
-			if err != nil {
-				slog.Warn(fmt.Sprintf("[Cache] Cannot get price for symbol %s at instant %s: %s", symbol, instantString, err.Error()))
-				return nil, err
-			}
-			err = cm.Set(identifierStr, price.String())
-			if err != nil {
-				slog.Warn(fmt.Sprintf("[Cache] Cannot update in cache price of symbol %s at instant %s ms: %s", symbol, instantString, err.Error()))
-				return nil, err
-			}
-			return price, nil
-		}
-		return nil, err
-	}
-
-	slog.Debug(fmt.Sprintf("[Cache] Key already cached %s = %s", identifierStr, quoteString))
-	quote, success := new(big.Rat).SetString(quoteString)
-	if !success {
-		return nil, BadRationalValue
-	}
-	return quote, nil
-}
-
-func calculateBalance(income []trade.Deal, outcome []trade.Deal) string {
 	result := big.NewRat(0, 1)
-	for _, deal := range income {
-		result = result.Add(result, deal.VolumeUSD.Rat)
-	}
-	for _, deal := range outcome {
-		result = result.Sub(result, deal.VolumeUSD.Rat)
+	for i, deal := range deals {
+		volume := deal.VolumeUSD.Rat
+		if rates != nil {
+			volume = new(big.Rat).Quo(volume, rates[i].Price)
+		}
+		if i < len(income) {
+			result = result.Add(result, volume)
+		} else {
+			result = result.Sub(result, volume)
+		}
 	}
 
-	balance := result.FloatString(2)
-	return balance
+	balance := result.FloatString(prices.Currencies[currency])
+	return balance, nil
 }
 
-func (cm *CacheManager) GetCachedBalanceOfWallet(db *gorm.DB, walletAddress string) (*trade.BalanceAcrossAllChains, error) {
-	cacheKey := fmt.Sprintf("balanceAcrossAllChains:%s", walletAddress)
-	cachedBalance, err := cm.Get(cacheKey)
+func (cm *CacheManager) GetCachedBalanceOfWallet(ctx context.Context, db *gorm.DB, walletAddress string, currency string) (*trade.BalanceAcrossAllChains, error) {
+	db = db.WithContext(ctx)
+	cacheKey := fmt.Sprintf("balanceAcrossAllChains:%s:%s", walletAddress, currency)
+	cachedBalance, err := cm.Get(ctx, cacheKey)
 	if err != nil && err != redis.Nil {
 		return nil, err
 	}
@@ -188,10 +155,13 @@ func (cm *CacheManager) GetCachedBalanceOfWallet(db *gorm.DB, walletAddress stri
 		}
 		slog.Debug(fmt.Sprintf("Found %d income and %d outcome deals of %s", len(dealsIncome), len(dealsOutcome), walletAddress))
 
-		balance := calculateBalance(dealsIncome, dealsOutcome)
-		cachedData, _ := json.Marshal(trade.BalanceAcrossAllChains{Address: walletAddress, Balance: balance})
-		cm.SetWithTTL(cacheKey, cachedData, 5*time.Minute)
-		return trade.NewBalanceAcrossAllChains(walletAddress, balance), nil
+		balance, err := cm.calculateBalance(ctx, currency, dealsIncome, dealsOutcome)
+		if err != nil {
+			return nil, err
+		}
+		cachedData, _ := json.Marshal(trade.BalanceAcrossAllChains{Address: walletAddress, Balance: balance, Currency: currency})
+		cm.SetWithTTL(ctx, cacheKey, cachedData, 5*time.Minute)
+		return trade.NewBalanceAcrossAllChains(walletAddress, balance, currency), nil
 
 	} else {
 		var balanceAcrossAllChains trade.BalanceAcrossAllChains
@@ -203,9 +173,10 @@ func (cm *CacheManager) GetCachedBalanceOfWallet(db *gorm.DB, walletAddress stri
 	}
 }
 
-func (cm *CacheManager) GetCachedBalanceOfWalletOnChain(db *gorm.DB, chainId string, walletAddress string) (*trade.BalanceOnChain, error) {
-	key := fmt.Sprintf("BalanceOnChain:%s:%s", chainId, walletAddress)
-	cached, err := cm.Get(key)
+func (cm *CacheManager) GetCachedBalanceOfWalletOnChain(ctx context.Context, db *gorm.DB, chainId string, walletAddress string, currency string) (*trade.BalanceOnChain, error) {
+	db = db.WithContext(ctx)
+	key := fmt.Sprintf("BalanceOnChain:%s:%s:%s", chainId, walletAddress, currency)
+	cached, err := cm.Get(ctx, key)
 	if err != nil && err != redis.Nil {
 		return nil, err
 	}
@@ -237,10 +208,13 @@ func (cm *CacheManager) GetCachedBalanceOfWalletOnChain(db *gorm.DB, chainId str
 		return nil, err
 	}
 
-	balance := calculateBalance(dealsIncome, dealsOutcome)
+	balance, err := cm.calculateBalance(ctx, currency, dealsIncome, dealsOutcome)
+	if err != nil {
+		return nil, err
+	}
 
-	result := trade.NewBalanceOnChain(chainId, walletAddress, balance)
-	err = cm.SetWithTTL(key, result, 15*time.Minute)
+	result := trade.NewBalanceOnChain(chainId, walletAddress, balance, currency)
+	err = cm.SetWithTTL(ctx, key, result, 15*time.Minute)
 	if err != nil {
 		return nil, err
 	}
@@ -259,9 +233,10 @@ func calculateTokenBalance(income []trade.Deal, outcome []trade.Deal) string {
 	return balance
 }
 
-func (cm *CacheManager) GetCachedTokenBalancesByChain(db *gorm.DB, chainId string) ([]trade.TokenBalanceByChain, error) {
+func (cm *CacheManager) GetCachedTokenBalancesByChain(ctx context.Context, db *gorm.DB, chainId string) ([]trade.TokenBalanceByChain, error) {
+	db = db.WithContext(ctx)
 	cacheKey := fmt.Sprintf("tokenBalancesByChain:%s", chainId)
-	cachedData, err := cm.Get(cacheKey)
+	cachedData, err := cm.Get(ctx, cacheKey)
 
 	if err != nil && err != redis.Nil {
 		return nil, err
@@ -399,7 +374,7 @@ func (cm *CacheManager) GetCachedTokenBalancesByChain(db *gorm.DB, chainId strin
 	if err != nil {
 		slog.Warn(fmt.Sprintf("[Cache] Failed to marshal token balances for chain %s: %v", chainId, err))
 	} else {
-		err = cm.SetWithTTL(cacheKey, resultJSON, 10*time.Minute)
+		err = cm.SetWithTTL(ctx, cacheKey, resultJSON, 10*time.Minute)
 		if err != nil {
 			slog.Warn(fmt.Sprintf("[Cache] Failed to cache token balances for chain %s: %v", chainId, err))
 		}
@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/stryukovsky/go-backend-learn/trade/prices"
+)
+
+// USD prices of currency at times of events, in order of times. Rates of all times are prefetched at once,
+// so converting a long history costs a few pages of candles instead of a request per event
+func (cm *CacheManager) GetCachedCurrencyRates(ctx context.Context, currency string, times []time.Time) ([]*prices.Quote, error) {
+	token := prices.CurrencyToken(currency)
+	requests := make([]prices.Request, len(times))
+	for i, instant := range times {
+		requests[i] = prices.Request{Token: token, At: prices.At(instant, 0)}
+	}
+	err := cm.PrefetchPrices(ctx, requests)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("[Cache] Cannot prefetch %d rates of %s: %s", len(times), currency, err.Error()))
+	}
+	result := make([]*prices.Quote, len(times))
+	known := make(map[int64]*prices.Quote)
+	for i, instant := range times {
+		quote, ok := known[instant.UnixNano()]
+		if !ok {
+			quote, err = cm.GetCachedTokenPrice(ctx, token, prices.At(instant, 0))
+			if err != nil {
+				return nil, err
+			}
+			if quote.Price.Sign() <= 0 {
+				return nil, fmt.Errorf("Rate of %s at %s is not positive", currency, instant)
+			}
+			known[instant.UnixNano()] = quote
+		}
+		result[i] = quote
+	}
+	return result, nil
+}
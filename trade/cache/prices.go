@@ -0,0 +1,225 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math/big"
+	"slices"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/redis/go-redis/v9"
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/prices"
+)
+
+// USD price of token at moment of event from the first provider of token able to give it. Token is looked up
+// at providers through its mapping to market symbol, tokens pegged to USD are priced as 1
+// Prices are cached under keys of their providers, so price of one provider is never served as one of another
+func (cm *CacheManager) GetCachedTokenPrice(ctx context.Context, token trade.Token, at prices.Moment) (*prices.Quote, error) {
+	return cm.quote(ctx, cm.oracles, token, at)
+}
+
+func (cm *CacheManager) quote(ctx context.Context, chain prices.Chain, token trade.Token, at prices.Moment) (*prices.Quote, error) {
+	if prices.Pegged(token) {
+		return &prices.Quote{Price: big.NewRat(1, 1), Source: prices.SourcePeg}, nil
+	}
+	oracles, err := chain.For(token)
+	if err != nil {
+		return nil, err
+	}
+	failures := make([]error, 0)
+	for _, oracle := range oracles {
+		price, err := cm.cachedPrice(ctx, oracle, token, at)
+		if err == nil {
+			return &prices.Quote{Price: price, Source: oracle.Source()}, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, prices.ErrNotSupported) {
+			continue
+		}
+		slog.Warn(fmt.Sprintf("[Cache] Cannot get %s price of %s at %s: %s", oracle.Source(), token.Symbol, at.Time, err.Error()))
+		failures = append(failures, fmt.Errorf("%s: %w", oracle.Source(), err))
+	}
+	if len(failures) == 0 {
+		return nil, fmt.Errorf("No price source can price token %s", token.Symbol)
+	}
+	return nil, fmt.Errorf("Cannot price token %s at %s: %w", token.Symbol, at.Time, errors.Join(failures...))
+}
+
+// Fills cache with prices of batch before its events are priced one by one. Each token is prefetched from its first
+// provider if that provider fetches in bulk: prices missing in cache are read from archive, then the rest is fetched,
+// archived and written to cache in one pipeline. Prices it misses are left to GetCachedTokenPrice
+func (cm *CacheManager) PrefetchPrices(ctx context.Context, requests []prices.Request) error {
+	byOracle := make(map[prices.BulkOracle][]prices.Request)
+	keys := make([]string, 0, len(requests))
+	seen := make(map[string]bool)
+	for _, request := range requests {
+		if prices.Pegged(request.Token) {
+			continue
+		}
+		oracles, err := cm.oracles.For(request.Token)
+		if err != nil || len(oracles) == 0 {
+			continue
+		}
+		bulk, ok := oracles[0].(prices.BulkOracle)
+		if !ok {
+			continue
+		}
+		key := bulk.CacheKey(request.Token, request.At)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+		byOracle[bulk] = append(byOracle[bulk], request)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	cachedValues, err := cm.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return err
+	}
+	cached := make(map[string]bool, len(keys))
+	for i, value := range cachedValues {
+		if value != nil {
+			cached[keys[i]] = true
+		}
+	}
+
+	toCache := make(map[string]*big.Rat)
+	failures := make([]error, 0)
+	for oracle, oracleRequests := range byOracle {
+		missing := make([]prices.Request, 0, len(oracleRequests))
+		wanted := make([]archivedCandle, 0, len(oracleRequests))
+		for _, request := range oracleRequests {
+			if !cached[oracle.CacheKey(request.Token, request.At)] {
+				missing = append(missing, request)
+				wanted = append(wanted, candleOf(oracle, request))
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		archived, err := cm.archivedCloses(ctx, oracle.Source(), wanted)
+		if err != nil {
+			failures = append(failures, fmt.Errorf("%s archive: %w", oracle.Source(), err))
+			continue
+		}
+		unknown := make([]prices.Request, 0, len(missing))
+		for i, request := range missing {
+			if price, ok := archived[wanted[i]]; ok {
+				toCache[oracle.CacheKey(request.Token, request.At)] = price.Rat
+				continue
+			}
+			unknown = append(unknown, request)
+		}
+		if len(unknown) == 0 {
+			continue
+		}
+		// candles fetched before failure are still stored
+		candles, err := oracle.Candles(ctx, unknown)
+		if err != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", oracle.Source(), err))
+		}
+		slog.Debug(fmt.Sprintf("[Cache] Prefetched %d of %d missing %s prices, %d more were archived", len(candles), len(unknown), oracle.Source(), len(missing)-len(unknown)))
+		fetched := make(map[archivedCandle]prices.Candle, len(candles))
+		for key, candle := range candles {
+			fetched[archivedCandle{symbol: candle.Symbol, start: candle.Start.UnixMilli()}] = candle
+			toCache[key] = candle.Close
+		}
+		err = cm.archiveCandles(ctx, oracle.Source(), slices.Collect(maps.Values(fetched)))
+		if err != nil {
+			failures = append(failures, fmt.Errorf("Cannot archive %d %s candles: %w", len(fetched), oracle.Source(), err))
+		}
+	}
+	if len(toCache) > 0 {
+		pipe := cm.rdb.Pipeline()
+		for key, price := range toCache {
+			pipe.Set(ctx, key, price.String(), 0)
+		}
+		_, err = pipe.Exec(ctx)
+		if err != nil {
+			failures = append(failures, fmt.Errorf("Cannot write %d prices to cache: %w", len(toCache), err))
+		}
+	}
+	return errors.Join(failures...)
+}
+
+func candleOf(oracle prices.CandleOracle, request prices.Request) archivedCandle {
+	symbol, start := oracle.CandleOf(request.Token, request.At)
+	return archivedCandle{symbol: symbol, start: start.UnixMilli()}
+}
+
+func (cm *CacheManager) cachedPrice(ctx context.Context, oracle prices.PriceOracle, token trade.Token, at prices.Moment) (*big.Rat, error) {
+	key := oracle.CacheKey(token, at)
+	if key == "" {
+		return oracle.Price(ctx, token, at)
+	}
+	cached, err := cm.Get(ctx, key)
+	if err == nil {
+		price, ok := new(big.Rat).SetString(cached)
+		if !ok {
+			return nil, BadRationalValue
+		}
+		return price, nil
+	}
+	if err != redis.Nil {
+		return nil, err
+	}
+	var price *big.Rat
+	if candleOracle, ok := oracle.(prices.CandleOracle); ok {
+		price, err = cm.archivedPrice(ctx, candleOracle, token, at)
+	} else {
+		price, err = oracle.Price(ctx, token, at)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = cm.Set(ctx, key, price.String())
+	if err != nil {
+		slog.Warn(fmt.Sprintf("[Cache] Cannot update in cache price %s: %s", key, err.Error()))
+	}
+	return price, nil
+}
+
+// Close of candle read from archive, or fetched from provider and archived
+func (cm *CacheManager) archivedPrice(ctx context.Context, oracle prices.CandleOracle, token trade.Token, at prices.Moment) (*big.Rat, error) {
+	wanted := candleOf(oracle, prices.Request{Token: token, At: at})
+	archived, err := cm.archivedCloses(ctx, oracle.Source(), []archivedCandle{wanted})
+	if err != nil {
+		return nil, err
+	}
+	if price, ok := archived[wanted]; ok {
+		return price.Rat, nil
+	}
+	candle, err := oracle.Candle(ctx, token, at)
+	if err != nil {
+		return nil, err
+	}
+	err = cm.archiveCandles(ctx, oracle.Source(), []prices.Candle{candle})
+	if err != nil {
+		slog.Warn(fmt.Sprintf("[Cache] Cannot archive %s candle of %s at %s: %s", oracle.Source(), candle.Symbol, candle.Start, err.Error()))
+	}
+	return candle.Close, nil
+}
+
+func (cm *CacheManager) lookupToken(ctx context.Context, chainId string, address common.Address) (trade.Token, error) {
+	var token trade.Token
+	err := cm.db.WithContext(ctx).Where("chain_id = ? AND lower(address) = lower(?)", chainId, address.Hex()).First(&token).Error
+	return token, err
+}
+
+// Other token of pool deriving price is priced without pools, so two pools pricing each other do not go in circles
+func (cm *CacheManager) counterpartPrice(ctx context.Context, token trade.Token, at prices.Moment) (*big.Rat, error) {
+	quote, err := cm.quote(ctx, cm.oracles.Without(prices.SourceUniswapV3), token, at)
+	if err != nil {
+		return nil, err
+	}
+	return quote.Price, nil
+}
@@ -0,0 +1,93 @@
+package chainlist
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var RpcsAddress = "https://chainlist.org/rpcs.json"
+
+type Rpc struct {
+	Url          string `json:"url"`
+	Tracking     string `json:"tracking"`
+	IsOpenSource bool   `json:"isOpenSource"`
+}
+
+// Entries of rpcs.json are mostly objects, but some chains list plain URLs
+func (r *Rpc) UnmarshalJSON(data []byte) error {
+	var url string
+	if err := json.Unmarshal(data, &url); err == nil {
+		r.Url = url
+		return nil
+	}
+	type rpc Rpc
+	return json.Unmarshal(data, (*rpc)(r))
+}
+
+type Chain struct {
+	Name    string `json:"name"`
+	ChainId uint64 `json:"chainId"`
+	Rpc     []Rpc  `json:"rpc"`
+}
+
+// Reads chainlist rpcs.json from URL or from local file
+func Load(ctx context.Context, source string) ([]Chain, error) {
+	var body []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		body, err = download(ctx, source)
+	} else {
+		body, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read chainlist from %s: %w", source, err)
+	}
+	var chains []Chain
+	err = json.Unmarshal(body, &chains)
+	if err != nil {
+		return nil, fmt.Errorf("Malformed chainlist from %s: %w", source, err)
+	}
+	return chains, nil
+}
+
+func download(ctx context.Context, url string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Response status is %d", response.StatusCode)
+	}
+	return io.ReadAll(response.Body)
+}
+
+// URLs of chain usable without credentials; ones with API key placeholders are skipped
+func Urls(chains []Chain, chainId uint64) ([]string, error) {
+	for _, chain := range chains {
+		if chain.ChainId != chainId {
+			continue
+		}
+		urls := make([]string, 0, len(chain.Rpc))
+		seen := make(map[string]bool)
+		for _, rpc := range chain.Rpc {
+			url := strings.TrimRight(rpc.Url, "/")
+			if url == "" || strings.Contains(url, "${") || seen[url] {
+				continue
+			}
+			seen[url] = true
+			urls = append(urls, url)
+		}
+		return urls, nil
+	}
+	return nil, fmt.Errorf("No chain %d in chainlist", chainId)
+}
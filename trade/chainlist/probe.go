@@ -0,0 +1,232 @@
+package chainlist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/lib/pq"
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/web3client"
+	"golang.org/x/sync/errgroup"
+	"gorm.io/gorm"
+)
+
+// Timeout of every single probing call, slow endpoint is as useless as a dead one
+const probeTimeout = 15 * time.Second
+
+// Ranges of eth_getLogs tried from the widest one until endpoint accepts it
+var logsRanges = []uint64{100000, 50000, 10000, 5000, 2000, 1000, 500, 100}
+
+// Substrings of errors returned by nodes which do not keep state of old blocks
+var prunedStateMarkers = []string{
+	"missing trie node",
+	"state is not available",
+	"state not available",
+	"historical state",
+	"state histories",
+	"pruned",
+	"old data not available",
+}
+
+func isPrunedState(err error) bool {
+	message := strings.ToLower(err.Error())
+	for _, marker := range prunedStateMarkers {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// Outcome of probing JSON RPC endpoint
+type Result struct {
+	Url     string
+	Working bool
+	Error   string
+	trade.RpcCapability
+}
+
+// Checks that endpoint serves the chain, then finds whether it is archive and which eth_getLogs range it accepts.
+// Probing calls go straight to endpoint bypassing the shared pool, so they neither wait for nor affect health of URL
+func Probe(ctx context.Context, url string, chainId uint64) Result {
+	result := Result{Url: url}
+	result.CheckedAt = time.Now()
+	fail := func(err error) Result {
+		result.Error = err.Error()
+		return result
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	rpcClient, err := rpc.DialOptions(dialCtx, url, rpc.WithHTTPClient(web3client.HTTPClient))
+	if err != nil {
+		return fail(err)
+	}
+	client := ethclient.NewClient(rpcClient)
+	defer client.Close()
+
+	callCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	started := time.Now()
+	actualChainId, err := client.ChainID(callCtx)
+	if err != nil {
+		return fail(err)
+	}
+	result.LatencyMs = time.Since(started).Milliseconds()
+	if actualChainId.Uint64() != chainId {
+		return fail(fmt.Errorf("Chain id is %s, not %d", actualChainId.String(), chainId))
+	}
+	head, err := client.BlockNumber(callCtx)
+	if err != nil {
+		return fail(err)
+	}
+	result.Working = true
+
+	// state at half of the height is far below the recent blocks pruned nodes keep
+	archiveCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	_, err = client.BalanceAt(archiveCtx, common.Address{}, new(big.Int).SetUint64(max(head/2, 1)))
+	switch {
+	case err == nil:
+		result.Archive = true
+	case !isPrunedState(err):
+		// timeout, rate limit or dropped connection says nothing about state kept by node
+		result.ArchiveUnknown = true
+		slog.Debug(fmt.Sprintf("Cannot tell whether JSON RPC %s is archive: %s", url, err.Error()))
+	}
+
+	for _, blocksRange := range logsRanges {
+		if blocksRange > head {
+			continue
+		}
+		logsCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+		// zero address has no logs, so the answer is small and only the range itself is checked
+		_, err = client.FilterLogs(logsCtx, ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(head - blocksRange + 1),
+			ToBlock:   new(big.Int).SetUint64(head),
+			Addresses: []common.Address{{}},
+		})
+		cancel()
+		if err == nil {
+			result.LogsRange = blocksRange
+			break
+		}
+		if ctx.Err() != nil {
+			return fail(ctx.Err())
+		}
+	}
+	return result
+}
+
+// Whether endpoint is archive as shown to user: true, false or unknown
+func (r Result) ArchiveState() string {
+	if r.ArchiveUnknown {
+		return "unknown"
+	}
+	return strconv.FormatBool(r.Archive)
+}
+
+// Probes URLs concurrently. Results keep order of URLs
+func ProbeAll(ctx context.Context, urls []string, chainId uint64, parallelism int) ([]Result, error) {
+	results := make([]Result, len(urls))
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(max(parallelism, 1))
+	for i, url := range urls {
+		g.Go(func() error {
+			results[i] = Probe(gCtx, url, chainId)
+			if results[i].Working {
+				slog.Info(fmt.Sprintf("JSON RPC %s works: archive %s, logs range %d, latency %d ms", url, results[i].ArchiveState(), results[i].LogsRange, results[i].LatencyMs))
+			} else {
+				slog.Warn(fmt.Sprintf("JSON RPC %s does not work: %s", url, results[i].Error))
+			}
+			return gCtx.Err()
+		})
+	}
+	err := g.Wait()
+	return results, err
+}
+
+// Writes working URLs with their capabilities to worker of chain, worker is created when chain has none.
+// Cache manager gets all working URLs, archive and fast ones first; events are fetched from URLs accepting blocks interval of worker
+func SaveToWorker(db *gorm.DB, chainId string, results []Result) (*trade.Worker, error) {
+	working := make([]Result, 0, len(results))
+	for _, result := range results {
+		if result.Working {
+			working = append(working, result)
+		}
+	}
+	if len(working) == 0 {
+		return nil, fmt.Errorf("No working JSON RPC URL for chain %s", chainId)
+	}
+	var config trade.Worker
+	err := db.First(&config, &trade.Worker{ChainId: chainId}).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	// archive check which failed this time keeps the answer of the previous probe
+	for i, result := range working {
+		previous, ok := config.RpcCapabilities[result.Url]
+		if result.ArchiveUnknown && ok && !previous.ArchiveUnknown {
+			working[i].Archive = previous.Archive
+			working[i].ArchiveUnknown = false
+		}
+	}
+	// archive URLs go first, then the ones not known to be pruned
+	archiveRank := func(result Result) int {
+		if result.ArchiveUnknown {
+			return 1
+		}
+		if result.Archive {
+			return 0
+		}
+		return 2
+	}
+	sort.SliceStable(working, func(i, j int) bool {
+		if archiveRank(working[i]) != archiveRank(working[j]) {
+			return archiveRank(working[i]) < archiveRank(working[j])
+		}
+		return working[i].LatencyMs < working[j].LatencyMs
+	})
+	if config.BlocksInterval == 0 {
+		config.ChainId = chainId
+		for _, result := range working {
+			config.BlocksInterval = max(config.BlocksInterval, result.LogsRange)
+		}
+	}
+
+	cacheUrls := make(pq.StringArray, 0, len(working))
+	eventsUrls := make(pq.StringArray, 0, len(working))
+	capabilities := make(trade.RpcCapabilities, len(working))
+	for _, result := range working {
+		cacheUrls = append(cacheUrls, result.Url)
+		if config.BlocksInterval > 0 && result.LogsRange >= config.BlocksInterval {
+			eventsUrls = append(eventsUrls, result.Url)
+		}
+		capabilities[result.Url] = result.RpcCapability
+	}
+	if len(eventsUrls) == 0 && config.ID == 0 {
+		return nil, fmt.Errorf("No working JSON RPC URL of chain %s accepts eth_getLogs", chainId)
+	}
+	config.BlockchainUrlsForCacheManager = cacheUrls
+	config.RpcCapabilities = capabilities
+	if len(eventsUrls) > 0 {
+		config.BlockchainUrlsForEvents = eventsUrls
+	} else {
+		slog.Warn(fmt.Sprintf("No working JSON RPC URL of chain %s accepts eth_getLogs range of %d blocks, URLs for events are kept", chainId, config.BlocksInterval))
+	}
+	err = db.Save(&config).Error
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
@@ -20,7 +20,6 @@ func Arbitrum(db *gorm.DB) {
 	blockchainUrlsForCache = append(blockchainUrlsForCache, "https://1rpc.io/arb")
 	blockchainUrlsForCache = append(blockchainUrlsForCache, "https://arbitrum-one-rpc.publicnode.com")
 	blockchainUrlsForCache = append(blockchainUrlsForCache, "https://arbitrum-one-public.nodies.app")
-	blockchainUrlsForCache = append(blockchainUrlsForCache, "https://arb-mainnet.g.alchemy.com/v2/demo")
 	blockchainUrlsForCache = append(blockchainUrlsForCache, "https://arbitrum.public.blockpi.network/v1/rpc/public")
 	blockchainUrlsForCache = append(blockchainUrlsForCache, "https://arbitrum-one.public.blastapi.io")
 	blockchainUrlsForCache = append(blockchainUrlsForCache, "https://arbitrum-one-rpc.publicnode.com")
@@ -28,7 +27,6 @@ func Arbitrum(db *gorm.DB) {
 	blockchainUrlsForCache = append(blockchainUrlsForCache, "https://arbitrum.meowrpc.com")
 	blockchainUrlsForCache = append(blockchainUrlsForCache, "https://api.zan.top/arb-one")
 	blockchainUrlsForCache = append(blockchainUrlsForCache, "https://arbitrum.drpc.org")
-	blockchainUrlsForCache = append(blockchainUrlsForCache, "https://api.stateless.solutions/arbitrum-one/v1/demo")
 	blockchainUrlsForCache = append(blockchainUrlsForCache, "https://arbitrum.gateway.tenderly.co")
 	blockchainUrlsForCache = append(blockchainUrlsForCache, "https://endpoints.omniatech.io/v1/arbitrum/one/public")
 	blockchainUrlsForCache = append(blockchainUrlsForCache, "https://arb1.lava.build")
@@ -37,7 +35,7 @@ func Arbitrum(db *gorm.DB) {
 	blockchainUrlsForCache = append(blockchainUrlsForCache, "https://rpc.poolz.finance/arbitrum")
 	blockchainUrlsForCache = append(blockchainUrlsForCache, "https://arb-one.api.pocket.network")
 
-	db.Create(&trade.Worker{BlockchainUrlsForEvents: blockchainUrlsForEvents, BlockchainUrlsForCacheManager: blockchainUrlsForCache, BlocksInterval: 50000})
+	db.Create(&trade.Worker{ChainId: "42161", BlockchainUrlsForEvents: blockchainUrlsForEvents, BlockchainUrlsForCacheManager: blockchainUrlsForCache, BlocksInterval: 50000})
 	db.Create(
 		&trade.Token{
 			ChainId:  "42161",
@@ -47,10 +45,11 @@ func Arbitrum(db *gorm.DB) {
 		})
 	db.Create(
 		&trade.Token{
-			ChainId:  "42161",
-			Address:  "0x82aF49447D8a07e3bd95BD0d56f35241523fBab1",
-			Symbol:   "WETH",
-			Decimals: trade.NewDBInt(big.NewInt(18)),
+			ChainId:    "42161",
+			Address:    "0x82aF49447D8a07e3bd95BD0d56f35241523fBab1",
+			Symbol:     "WETH",
+			Decimals:   trade.NewDBInt(big.NewInt(18)),
+			PriceAsset: "ETH",
 		})
 	db.Create(
 		// Note: No direct EUR stablecoin equivalent found on Arbitrum
@@ -59,6 +58,7 @@ func Arbitrum(db *gorm.DB) {
 			Address:  "0xaf88d065e77c8cC2239327C5EDb3A432268e5831",
 			Symbol:   "USDC",
 			Decimals: trade.NewDBInt(big.NewInt(6)),
+			PricePeg: "USD",
 		})
 	// Note: BNB is not natively available on Arbitrum (it's a BSC token)
 	db.Create(
@@ -77,10 +77,11 @@ func Arbitrum(db *gorm.DB) {
 		})
 	db.Create(
 		&trade.Token{
-			ChainId:  "42161",
-			Address:  "0x2f2a2543B76A4166549F7aaB2e75Bef0aefC5B0f",
-			Symbol:   "WBTC",
-			Decimals: trade.NewDBInt(big.NewInt(8)),
+			ChainId:    "42161",
+			Address:    "0x2f2a2543B76A4166549F7aaB2e75Bef0aefC5B0f",
+			Symbol:     "WBTC",
+			Decimals:   trade.NewDBInt(big.NewInt(8)),
+			PriceAsset: "BTC",
 		})
 	db.Create(&trade.Chain{Name: "Arbitrum One", ChainId: "42161"})
 	db.Create(&trade.DeFiPlatform{Type: trade.Aave, ChainId: "42161", Address: "0x794a61358D6845594F94dc1DB02A252b5b4814aD"})
@@ -89,6 +90,11 @@ func Arbitrum(db *gorm.DB) {
 
 func Binance(db *gorm.DB) {
 	// BSC Chain ID is 56
+	blockchainUrls := make(pq.StringArray, 0)
+	blockchainUrls = append(blockchainUrls, "https://bsc-dataseed.bnbchain.org")
+	blockchainUrls = append(blockchainUrls, "https://bsc-rpc.publicnode.com")
+	blockchainUrls = append(blockchainUrls, "wss://bsc-rpc.publicnode.com")
+	db.Create(&trade.Worker{ChainId: "56", BlockchainUrlsForEvents: blockchainUrls, BlockchainUrlsForCacheManager: blockchainUrls, BlocksInterval: 5000})
 	db.Create(
 		&trade.Token{
 			ChainId:  "56",
@@ -109,6 +115,7 @@ func Binance(db *gorm.DB) {
 			Address:  "0xe9e7CEA3DedcA5984780Bafc599bD69ADd087D56",
 			Symbol:   "BUSD",
 			Decimals: trade.NewDBInt(big.NewInt(6)),
+			PricePeg: "USD",
 		})
 	db.Create(
 		&trade.Token{
@@ -116,6 +123,7 @@ func Binance(db *gorm.DB) {
 			Address:  "0x8AC76a51cc950d9822D68b83fE1Ad97B32Cd580d",
 			Symbol:   "USDC",
 			Decimals: trade.NewDBInt(big.NewInt(6)),
+			PricePeg: "USD",
 		})
 	db.Create(
 		&trade.Token{
@@ -140,10 +148,11 @@ func Binance(db *gorm.DB) {
 		})
 	db.Create(
 		&trade.Token{
-			ChainId:  "56",
-			Address:  "0x7130d2A12B9BCbFAe4f2634d864A1Ee1Ce3Ead9c",
-			Symbol:   "BTC",
-			Decimals: trade.NewDBInt(big.NewInt(8)),
+			ChainId:    "56",
+			Address:    "0x7130d2A12B9BCbFAe4f2634d864A1Ee1Ce3Ead9c",
+			Symbol:     "BTCB",
+			Decimals:   trade.NewDBInt(big.NewInt(8)),
+			PriceAsset: "BTC",
 		})
 	db.Create(&trade.Chain{Name: "BNB Smart Chain", ChainId: "56"})
 	db.Create(&trade.DeFiPlatform{Type: trade.Aave, ChainId: "56", Address: "0x6807dc923806fE8Fd134338EABCA509979a7e0cB"})
@@ -151,6 +160,11 @@ func Binance(db *gorm.DB) {
 
 func Base(db *gorm.DB) {
 	// Base Chain ID is 8453
+	blockchainUrls := make(pq.StringArray, 0)
+	blockchainUrls = append(blockchainUrls, "https://mainnet.base.org")
+	blockchainUrls = append(blockchainUrls, "https://base-rpc.publicnode.com")
+	blockchainUrls = append(blockchainUrls, "wss://base-rpc.publicnode.com")
+	db.Create(&trade.Worker{ChainId: "8453", BlockchainUrlsForEvents: blockchainUrls, BlockchainUrlsForCacheManager: blockchainUrls, BlocksInterval: 5000})
 	db.Create(
 		&trade.Token{
 			ChainId:  "8453",
@@ -160,10 +174,11 @@ func Base(db *gorm.DB) {
 		})
 	db.Create(
 		&trade.Token{
-			ChainId:  "8453",
-			Address:  "0x4200000000000000000000000000000000000006",
-			Symbol:   "ETH",
-			Decimals: trade.NewDBInt(big.NewInt(18)),
+			ChainId:    "8453",
+			Address:    "0x4200000000000000000000000000000000000006",
+			Symbol:     "WETH",
+			Decimals:   trade.NewDBInt(big.NewInt(18)),
+			PriceAsset: "ETH",
 		})
 	db.Create(
 		&trade.Token{
@@ -171,6 +186,7 @@ func Base(db *gorm.DB) {
 			Address:  "0x833589fcd6edb6e08f4c7c32d4f71b54bda02913",
 			Symbol:   "USDC",
 			Decimals: trade.NewDBInt(big.NewInt(6)),
+			PricePeg: "USD",
 		})
 	db.Create(
 		&trade.Token{
@@ -188,10 +204,11 @@ func Base(db *gorm.DB) {
 		})
 	db.Create(
 		&trade.Token{
-			ChainId:  "8453",
-			Address:  "0x0555E30da8f98308EdB960aa94C0Db47230d2B9c",
-			Symbol:   "BTC",
-			Decimals: trade.NewDBInt(big.NewInt(8)),
+			ChainId:    "8453",
+			Address:    "0x0555E30da8f98308EdB960aa94C0Db47230d2B9c",
+			Symbol:     "WBTC",
+			Decimals:   trade.NewDBInt(big.NewInt(8)),
+			PriceAsset: "BTC",
 		})
 	db.Create(&trade.Chain{Name: "Base", ChainId: "8453"})
 	db.Create(&trade.DeFiPlatform{Type: trade.Aave, ChainId: "8453", Address: "0xA4CF4740E5F564D2BFC7382352c61F202D894287"})
@@ -220,7 +237,7 @@ func Ethereum(db *gorm.DB) {
 	blockchainUrls := make(pq.StringArray, 1)
 	blockchainUrls[0] = url
 
-	db.Create(&trade.Worker{BlockchainUrlsForCacheManager: blockchainUrls, BlocksInterval: 1000})
+	db.Create(&trade.Worker{ChainId: "1", BlockchainUrlsForEvents: blockchainUrls, BlockchainUrlsForCacheManager: blockchainUrls, BlocksInterval: 1000})
 	db.Create(&trade.AnalyticsWorker{BlockchainUrls: blockchainUrls, BlocksInterval: 1000, LastBlock: 12369651})
 
 	db.Create(
@@ -232,17 +249,19 @@ func Ethereum(db *gorm.DB) {
 		})
 	db.Create(
 		&trade.Token{
-			ChainId:  "1",
-			Address:  "0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2",
-			Symbol:   "ETH",
-			Decimals: trade.NewDBInt(big.NewInt(18)),
+			ChainId:    "1",
+			Address:    "0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2",
+			Symbol:     "WETH",
+			Decimals:   trade.NewDBInt(big.NewInt(18)),
+			PriceAsset: "ETH",
 		})
 	db.Create(
 		&trade.Token{
 			ChainId:  "1",
 			Address:  "0x1aBaEA1f7C830bD89Acc67eC4af516284b1bC33c",
-			Symbol:   "EUR",
+			Symbol:   "EURC",
 			Decimals: trade.NewDBInt(big.NewInt(6)),
+			PricePeg: "EUR",
 		})
 	db.Create(
 		&trade.Token{
@@ -250,6 +269,7 @@ func Ethereum(db *gorm.DB) {
 			Address:  "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48",
 			Symbol:   "USDC",
 			Decimals: trade.NewDBInt(big.NewInt(6)),
+			PricePeg: "USD",
 		})
 	db.Create(
 		&trade.Token{
@@ -274,10 +294,11 @@ func Ethereum(db *gorm.DB) {
 		})
 	db.Create(
 		&trade.Token{
-			ChainId:  "1",
-			Address:  "0x2260FAC5E5542a773Aa44fBCfeDf7C193bc2C599",
-			Symbol:   "BTC",
-			Decimals: trade.NewDBInt(big.NewInt(8)),
+			ChainId:    "1",
+			Address:    "0x2260FAC5E5542a773Aa44fBCfeDf7C193bc2C599",
+			Symbol:     "WBTC",
+			Decimals:   trade.NewDBInt(big.NewInt(8)),
+			PriceAsset: "BTC",
 		})
 	db.Create(&trade.Chain{Name: "Ethereum mainnet", ChainId: "1"})
 	db.Create(&trade.DeFiPlatform{Type: trade.Aave, ChainId: "1", Address: "0x87870Bca3F3fD6335C3F4ce8392D69350B4fA4E2"})
@@ -0,0 +1,206 @@
+package database
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/protocols"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Display names older versions stored progress under. They are spelled out here rather than taken from handlers,
+// so renaming a handler does not break migration of rows named the old way
+const (
+	legacyAaveName      = "Aave on %s"
+	legacyCompound3Name = "Compound3 on %s"
+	legacyUniswapV3Name = "Uniswap V3 Pool %s - %s"
+)
+
+// Keys of handlers by their legacy names, per chain. Symbols of pool tokens are known from stored deals only:
+// pools without deals are kept apart, a legacy pool name may belong to any of them
+type handlerNames struct {
+	keys           map[string]map[string][]string
+	unnamedUniswap map[string][]string
+}
+
+func (n handlerNames) add(chainId string, name string, key string) {
+	if n.keys[chainId] == nil {
+		n.keys[chainId] = make(map[string][]string)
+	}
+	n.keys[chainId][name] = append(n.keys[chainId][name], key)
+}
+
+func (n handlerNames) lookup(chainId string, name string) []string {
+	if keys := n.keys[chainId][name]; len(keys) > 0 {
+		return keys
+	}
+	if strings.HasPrefix(name, strings.Split(legacyUniswapV3Name, "%")[0]) {
+		return n.unnamedUniswap[chainId]
+	}
+	return nil
+}
+
+func loadHandlerNames(db *gorm.DB) (handlerNames, error) {
+	names := handlerNames{keys: make(map[string]map[string][]string), unnamedUniswap: make(map[string][]string)}
+	var tokens []trade.Token
+	err := db.Find(&tokens).Error
+	if err != nil {
+		return names, err
+	}
+	for _, token := range tokens {
+		names.add(token.ChainId, token.Symbol, protocols.HandlerKey(protocols.ERC20, common.HexToAddress(token.Address)))
+	}
+	var platforms []trade.DeFiPlatform
+	err = db.Find(&platforms).Error
+	if err != nil {
+		return names, err
+	}
+	var pools []struct {
+		ChainId     string
+		PoolAddress string
+		SymbolA     string
+		SymbolB     string
+	}
+	err = db.Table("uniswap_v3_deals").
+		Select("DISTINCT uniswap_v3_events.chain_id, uniswap_v3_events.pool_address, uniswap_v3_deals.symbol_a, uniswap_v3_deals.symbol_b").
+		Joins("JOIN uniswap_v3_events ON uniswap_v3_events.id = uniswap_v3_deals.blockchain_event_id").
+		Scan(&pools).Error
+	if err != nil {
+		return names, err
+	}
+	poolNames := make(map[string]string, len(pools))
+	for _, pool := range pools {
+		poolNames[pool.ChainId+common.HexToAddress(pool.PoolAddress).Hex()] = fmt.Sprintf(legacyUniswapV3Name, pool.SymbolA, pool.SymbolB)
+	}
+	for _, platform := range platforms {
+		address := common.HexToAddress(platform.Address)
+		switch platform.Type {
+		case trade.Aave:
+			names.add(platform.ChainId, fmt.Sprintf(legacyAaveName, platform.Address), protocols.HandlerKey(trade.Aave, address))
+		case trade.Compound3:
+			names.add(platform.ChainId, fmt.Sprintf(legacyCompound3Name, platform.Address), protocols.HandlerKey(trade.Compound3, address))
+		case trade.UniswapV3:
+			key := protocols.HandlerKey(trade.UniswapV3, address)
+			if name, ok := poolNames[platform.ChainId+address.Hex()]; ok {
+				names.add(platform.ChainId, name, key)
+			} else {
+				names.unnamedUniswap[platform.ChainId] = append(names.unnamedUniswap[platform.ChainId], key)
+			}
+		}
+	}
+	return names, nil
+}
+
+// Progress stored before handlers had keys names its handler by display name. Rows of names of a single handler are moved
+// to its key. Names shared by several handlers, e.g. pools of the same tokens, cannot tell which of them made progress:
+// their checkpoints are dropped, so the handlers start over from tracked wallets, while their dead letters and shards
+// are copied to every handler of the name and retried, since indexing a range again is harmless
+func migrateHandlerKeys(db *gorm.DB) error {
+	type legacyHandler struct {
+		ChainId string
+		Handler string
+	}
+	legacy := make(map[legacyHandler]bool)
+	for _, table := range []string{"checkpoints", "dead_letters", "backfill_shards"} {
+		var found []legacyHandler
+		err := db.Table(table).Distinct("chain_id", "handler").Where("handler NOT LIKE ?", "%:0x%").Scan(&found).Error
+		if err != nil {
+			return err
+		}
+		for _, handler := range found {
+			legacy[handler] = true
+		}
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+	names, err := loadHandlerNames(db)
+	if err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for handler := range legacy {
+			keys := names.lookup(handler.ChainId, handler.Handler)
+			if len(keys) == 0 {
+				slog.Warn(fmt.Sprintf("[Chain %s] [%s] No handler has this name anymore, its progress is left as is", handler.ChainId, handler.Handler))
+				continue
+			}
+			err := moveToHandlerKeys(tx, handler.ChainId, handler.Handler, keys)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func moveToHandlerKeys(tx *gorm.DB, chainId string, name string, keys []string) error {
+	shared := len(keys) > 1
+	var checkpoints []trade.Checkpoint
+	err := tx.Find(&checkpoints, &trade.Checkpoint{ChainId: chainId, Handler: name}).Error
+	if err != nil {
+		return err
+	}
+	var letters []trade.DeadLetter
+	err = tx.Find(&letters, &trade.DeadLetter{ChainId: chainId, Handler: name}).Error
+	if err != nil {
+		return err
+	}
+	var shards []trade.BackfillShard
+	err = tx.Find(&shards, &trade.BackfillShard{ChainId: chainId, Handler: name}).Error
+	if err != nil {
+		return err
+	}
+	movedCheckpoints := make([]trade.Checkpoint, 0)
+	movedLetters := make([]trade.DeadLetter, 0)
+	movedShards := make([]trade.BackfillShard, 0)
+	for _, key := range keys {
+		for _, checkpoint := range checkpoints {
+			if !shared {
+				movedCheckpoints = append(movedCheckpoints, trade.NewCheckpoint(chainId, key, checkpoint.Wallet, checkpoint.LastBlock))
+			}
+		}
+		for _, letter := range letters {
+			letter.Model = gorm.Model{}
+			letter.Handler = key
+			movedLetters = append(movedLetters, letter)
+		}
+		for _, shard := range shards {
+			moved := trade.NewBackfillShard(chainId, shard.Wallet, key, shard.FromBlock, shard.ToBlock)
+			moved.Done = shard.Done && !shared
+			movedShards = append(movedShards, moved)
+		}
+	}
+	// progress stored under key meanwhile wins
+	create := func() *gorm.DB { return tx.Clauses(clause.OnConflict{DoNothing: true}) }
+	if len(movedCheckpoints) > 0 {
+		err = create().CreateInBatches(&movedCheckpoints, 500).Error
+	}
+	if err == nil && len(movedLetters) > 0 {
+		err = create().CreateInBatches(&movedLetters, 500).Error
+	}
+	if err == nil && len(movedShards) > 0 {
+		err = create().CreateInBatches(&movedShards, 500).Error
+	}
+	if err != nil {
+		return err
+	}
+	for _, model := range []any{&trade.Checkpoint{}, &trade.DeadLetter{}, &trade.BackfillShard{}} {
+		err = tx.Unscoped().Where("chain_id = ? AND handler = ?", chainId, name).Delete(model).Error
+		if err != nil {
+			return err
+		}
+	}
+	if shared && len(checkpoints) > 0 {
+		slog.Warn(fmt.Sprintf(
+			"[Chain %s] [%s] Checkpoints of %d wallets were shared by %d handlers %v and are dropped; backfill ranges these handlers may have missed",
+			chainId, name, len(checkpoints), len(keys), keys,
+		))
+	}
+	slog.Info(fmt.Sprintf("[Chain %s] [%s] Moved %d checkpoints, %d dead letters and %d backfill shards to handler keys %v", chainId, name, len(movedCheckpoints), len(movedLetters), len(movedShards), keys))
+	return nil
+}
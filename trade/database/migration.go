@@ -1,12 +1,105 @@
 package database
 
 import (
+	"fmt"
+	"log/slog"
+
 	"github.com/stryukovsky/go-backend-learn/trade"
 	"gorm.io/gorm"
 )
 
+// Financial interactions are unique per event, but older versions could price an event twice.
+// Duplicates are removed before the unique indexes are created, the earliest row of each event is kept
+func removeDuplicateInteractions(db *gorm.DB) error {
+	interactions := []struct {
+		table  string
+		column string
+	}{
+		{"deals", "blockchain_transfer_id"},
+		{"aave_interactions", "blockchain_event_id"},
+		{"compound3_interactions", "blockchain_event_id"},
+		{"uniswap_v3_deals", "blockchain_event_id"},
+	}
+	for _, interaction := range interactions {
+		if !db.Migrator().HasTable(interaction.table) {
+			continue
+		}
+		result := db.Exec(fmt.Sprintf(
+			"DELETE FROM %[1]s duplicate USING %[1]s kept WHERE duplicate.%[2]s = kept.%[2]s AND duplicate.id > kept.id",
+			interaction.table,
+			interaction.column,
+		))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			slog.Warn(fmt.Sprintf("Removed %d duplicate rows from %s", result.RowsAffected, interaction.table))
+		}
+	}
+	return nil
+}
+
+// Compound3 events had no unique index of their own, so a log could be stored twice. Interactions of removed duplicates
+// are moved to the kept event first, the duplicate interactions this makes are removed with the others afterwards
+func removeDuplicateEvents(db *gorm.DB) error {
+	events := []struct {
+		table        string
+		interactions string
+	}{
+		{"compound3_events", "compound3_interactions"},
+	}
+	for _, event := range events {
+		if !db.Migrator().HasTable(event.table) {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if tx.Migrator().HasTable(event.interactions) {
+				err := tx.Exec(fmt.Sprintf(
+					`UPDATE %[2]s interaction SET blockchain_event_id = kept.id
+					FROM %[1]s duplicate
+					JOIN (SELECT chain_id, tx_id, log_index, MIN(id) AS id FROM %[1]s GROUP BY chain_id, tx_id, log_index) kept
+					USING (chain_id, tx_id, log_index)
+					WHERE interaction.blockchain_event_id = duplicate.id AND duplicate.id <> kept.id`,
+					event.table,
+					event.interactions,
+				)).Error
+				if err != nil {
+					return err
+				}
+			}
+			result := tx.Exec(fmt.Sprintf(
+				`DELETE FROM %[1]s duplicate USING %[1]s kept
+				WHERE duplicate.chain_id = kept.chain_id AND duplicate.tx_id = kept.tx_id AND duplicate.log_index = kept.log_index
+				AND duplicate.id > kept.id`,
+				event.table,
+			))
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected > 0 {
+				slog.Warn(fmt.Sprintf("Removed %d duplicate rows from %s", result.RowsAffected, event.table))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func Migrate(db *gorm.DB) error {
-	err := db.AutoMigrate(
+	err := removeDuplicateEvents(db)
+	if err != nil {
+		return err
+	}
+	err = removeDuplicateInteractions(db)
+	if err != nil {
+		return err
+	}
+	err = db.AutoMigrate(
+		// events reference blocks
+		&trade.Block{},
 		&trade.Deal{},
 		&trade.ERC20Transfer{},
 		&trade.Worker{},
@@ -22,6 +115,13 @@ func Migrate(db *gorm.DB) error {
 		&trade.UniswapV3Deal{},
 		&trade.UniswapV3Position{},
 		&trade.AnalyticsWorker{},
+		&trade.Checkpoint{},
+		&trade.BackfillShard{},
+		&trade.DeadLetter{},
+		&trade.Price{},
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	return migrateHandlerKeys(db)
 }
@@ -0,0 +1,243 @@
+package trade
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+type logsLimitKind int
+
+const (
+	noLogsLimit logsLimitKind = iota
+	// provider refuses block ranges wider than some span regardless of the logs in it
+	blockRangeLimit
+	// provider refuses responses with too many logs, so only dense ranges need smaller spans
+	resultsLimit
+)
+
+// Substrings of errors returned by popular JSON RPC providers on eth_getLogs which is too heavy for them
+var (
+	blockRangeLimitMarkers = []string{
+		"block range",
+		"range is too large",
+		"range too large",
+		"range too wide",
+		"exceed maximum block range",
+		"exceeds the range",
+		"blocks range",
+		"max range",
+		"ranges over",
+	}
+	resultsLimitMarkers = []string{
+		"query returned more than",
+		"too many results",
+		"too many logs",
+		"log response size exceeded",
+		"response size exceeded",
+		"response size should not",
+		"exceeds max results",
+		"results limit",
+		"logs limit",
+		"query timeout exceeded",
+	}
+)
+
+func classifyLogsError(err error) logsLimitKind {
+	message := strings.ToLower(err.Error())
+	for _, marker := range blockRangeLimitMarkers {
+		if strings.Contains(message, marker) {
+			return blockRangeLimit
+		}
+	}
+	for _, marker := range resultsLimitMarkers {
+		if strings.Contains(message, marker) {
+			return resultsLimit
+		}
+	}
+	return noLogsLimit
+}
+
+// Tells whether eth_getLogs failed because of provider limits, so smaller block range may succeed
+func IsLogsLimitError(err error) bool {
+	return err != nil && classifyLogsError(err) != noLogsLimit
+}
+
+// Largest block span known to be accepted by eth_getLogs of each JSON RPC URL
+type LogsSpans struct {
+	mu    sync.RWMutex
+	spans map[string]uint64
+}
+
+func NewLogsSpans() *LogsSpans {
+	return &LogsSpans{spans: make(map[string]uint64)}
+}
+
+var KnownLogsSpans = NewLogsSpans()
+
+func (s *LogsSpans) Get(url string) (uint64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	span, ok := s.spans[url]
+	return span, ok
+}
+
+// Remembers span only if it is narrower than the already known one
+func (s *LogsSpans) Limit(url string, span uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if known, ok := s.spans[url]; !ok || span < known {
+		s.spans[url] = span
+	}
+}
+
+func bisectLogs[Event any](url string, fromBlock uint64, toBlock uint64, filter func(fromBlock uint64, toBlock uint64) ([]Event, error)) ([]Event, error) {
+	events, err := filter(fromBlock, toBlock)
+	if err == nil {
+		return events, nil
+	}
+	kind := classifyLogsError(err)
+	if kind == noLogsLimit || fromBlock == toBlock {
+		return nil, err
+	}
+	middle := fromBlock + (toBlock-fromBlock)/2
+	if kind == blockRangeLimit {
+		KnownLogsSpans.Limit(url, middle-fromBlock+1)
+	}
+	slog.Debug(fmt.Sprintf("Logs of blocks %d - %d are too heavy for %s, split them at block %d: %s", fromBlock, toBlock, url, middle, err.Error()))
+	left, err := bisectLogs(url, fromBlock, middle, filter)
+	if err != nil {
+		return nil, err
+	}
+	right, err := bisectLogs(url, middle+1, toBlock, filter)
+	if err != nil {
+		return nil, err
+	}
+	return append(left, right...), nil
+}
+
+// Runs eth_getLogs based filter over inclusive block range. Range is split to the span known to work for url
+// and is bisected recursively when provider still rejects it because of range or results limits
+func FilterLogsAdaptive[Event any](url string, fromBlock uint64, toBlock uint64, filter func(fromBlock uint64, toBlock uint64) ([]Event, error)) ([]Event, error) {
+	if toBlock < fromBlock {
+		return []Event{}, nil
+	}
+	span := toBlock - fromBlock + 1
+	if known, ok := KnownLogsSpans.Get(url); ok {
+		span = min(span, known)
+	}
+	result := make([]Event, 0)
+	for start := fromBlock; start <= toBlock; start += span {
+		end := min(start+span-1, toBlock)
+		events, err := bisectLogs(url, start, end, filter)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, events...)
+		if end == toBlock {
+			break
+		}
+		if known, ok := KnownLogsSpans.Get(url); ok {
+			span = min(span, known)
+		}
+	}
+	return result, nil
+}
+
+// Topic0 of event declared in ABI of generated binding. ABIs are embedded at compile time, so broken one is a programming error
+func EventTopic(metadata *bind.MetaData, name string) common.Hash {
+	parsed, err := metadata.GetAbi()
+	if err != nil {
+		panic(err)
+	}
+	event, ok := parsed.Events[name]
+	if !ok {
+		panic(fmt.Sprintf("No event %s in ABI", name))
+	}
+	return event.ID
+}
+
+// Log which event of generated binding was decoded from, it is kept in Raw field of every such event
+func RawLog(event any) (types.Log, bool) {
+	value := reflect.Indirect(reflect.ValueOf(event))
+	if value.Kind() != reflect.Struct {
+		return types.Log{}, false
+	}
+	raw := value.FieldByName("Raw")
+	if !raw.IsValid() {
+		return types.Log{}, false
+	}
+	log, ok := raw.Interface().(types.Log)
+	return log, ok
+}
+
+// Distinct numbers of blocks which events of generated bindings were emitted in
+func BlockNumbers[Event any](events []Event) []uint64 {
+	seen := make(map[uint64]bool, len(events))
+	blocks := make([]uint64, 0)
+	for _, event := range events {
+		log, ok := RawLog(event)
+		if !ok || seen[log.BlockNumber] {
+			continue
+		}
+		seen[log.BlockNumber] = true
+		blocks = append(blocks, log.BlockNumber)
+	}
+	return blocks
+}
+
+// Timestamps of blocks resolved in bulk before events are parsed
+type BlockTimestamps map[uint64]time.Time
+
+func (t BlockTimestamps) At(block uint64) (*time.Time, error) {
+	timestamp, ok := t[block]
+	if !ok {
+		return nil, fmt.Errorf("Timestamp of block %d is not resolved", block)
+	}
+	return &timestamp, nil
+}
+
+// Log which could not be parsed to event together with the reason
+type LogFailure struct {
+	Log types.Log
+	Err error
+}
+
+// Collects logs failed to be parsed, so caller can set them aside instead of failing the whole block range
+type LogFailures struct {
+	mu    sync.Mutex
+	items []LogFailure
+}
+
+type logFailuresKey struct{}
+
+// Context under which ParseEVMEvents reports failed logs to the returned collector and keeps going with the rest
+func WithLogFailures(ctx context.Context) (context.Context, *LogFailures) {
+	failures := &LogFailures{}
+	return context.WithValue(ctx, logFailuresKey{}, failures), failures
+}
+
+func logFailuresOf(ctx context.Context) *LogFailures {
+	failures, _ := ctx.Value(logFailuresKey{}).(*LogFailures)
+	return failures
+}
+
+func (f *LogFailures) add(log types.Log, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.items = append(f.items, LogFailure{Log: log, Err: err})
+}
+
+func (f *LogFailures) Items() []LogFailure {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]LogFailure{}, f.items...)
+}
@@ -0,0 +1,198 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "trade"
+
+// Kinds of workers whose cycles and lag are tracked
+const (
+	IndexWorker     = "index"
+	AnalyticsWorker = "analytics"
+)
+
+var (
+	rpcCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_calls_total",
+		Help:      "JSON RPC calls by URL and method, every attempt of a retried call is counted",
+	}, []string{"url", "method"})
+	rpcErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_errors_total",
+		Help:      "Failed JSON RPC calls by URL and method",
+	}, []string{"url", "method"})
+	rpcLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rpc_latency_seconds",
+		Help:      "Latency of JSON RPC calls by URL and method",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"url", "method"})
+	rpcRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_rate_limited_total",
+		Help:      "JSON RPC calls rejected by rate limit of provider by URL",
+	}, []string{"url"})
+	rpcCircuitOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rpc_circuit_open",
+		Help:      "1 while circuit of JSON RPC URL is open and it gets no calls",
+	}, []string{"url"})
+
+	cacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_hits_total",
+		Help:      "Redis cache hits by key family",
+	}, []string{"family"})
+	cacheMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_misses_total",
+		Help:      "Redis cache misses by key family",
+	}, []string{"family"})
+
+	binanceRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "binance_requests_total",
+		Help:      "Requests sent to Binance",
+	})
+	binanceFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "binance_failures_total",
+		Help:      "Requests to Binance failed or answered with unusable response",
+	})
+
+	eventsParsed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_parsed_total",
+		Help:      "Events fetched and parsed from logs by chain and handler",
+	}, []string{"chain", "handler"})
+	eventsSaved = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_saved_total",
+		Help:      "Events written to database by chain and handler, including ones stored before",
+	}, []string{"chain", "handler"})
+
+	cycleDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "cycle_duration_seconds",
+		Help:      "Duration of worker cycles by worker kind, chain and outcome",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+	}, []string{"worker", "chain", "outcome"})
+	lastCycle = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_successful_cycle_timestamp_seconds",
+		Help:      "Unix time of the last successful worker cycle by worker kind and chain, stalls show up as growing age",
+	}, []string{"worker", "chain"})
+	lagBlocks = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "chain_lag_blocks",
+		Help:      "Blocks between the head and the block indexed by worker kind and chain",
+	}, []string{"worker", "chain"})
+	lagSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "chain_lag_seconds",
+		Help:      "Age of the block indexed by worker kind and chain",
+	}, []string{"worker", "chain"})
+)
+
+// Records a single JSON RPC attempt
+func ObserveRPC(url string, method string, started time.Time, err error) {
+	rpcCalls.WithLabelValues(url, method).Inc()
+	rpcLatency.WithLabelValues(url, method).Observe(time.Since(started).Seconds())
+	if err != nil {
+		rpcErrors.WithLabelValues(url, method).Inc()
+	}
+}
+
+func RPCRateLimited(url string) {
+	rpcRateLimited.WithLabelValues(url).Inc()
+}
+
+func RPCCircuit(url string, open bool) {
+	value := 0.0
+	if open {
+		value = 1
+	}
+	rpcCircuitOpen.WithLabelValues(url).Set(value)
+}
+
+// Family of cache key is its first segment, e.g. block or quote, so chain, block and symbol do not blow up cardinality
+func KeyFamily(key string) string {
+	family, _, _ := strings.Cut(key, ":")
+	return family
+}
+
+func CacheHit(key string) {
+	cacheHits.WithLabelValues(KeyFamily(key)).Inc()
+}
+
+func CacheMiss(key string) {
+	cacheMisses.WithLabelValues(KeyFamily(key)).Inc()
+}
+
+func BinanceRequest(err error) {
+	binanceRequests.Inc()
+	if err != nil {
+		binanceFailures.Inc()
+	}
+}
+
+func EventsParsed(chainId string, handler string, count int) {
+	eventsParsed.WithLabelValues(chainId, handler).Add(float64(count))
+}
+
+func EventsSaved(chainId string, handler string, count int) {
+	eventsSaved.WithLabelValues(chainId, handler).Add(float64(count))
+}
+
+// Records duration of worker cycle, successful one also moves the last cycle timestamp
+func Cycle(worker string, chainId string, started time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	cycleDuration.WithLabelValues(worker, chainId, outcome).Observe(time.Since(started).Seconds())
+	if err == nil {
+		lastCycle.WithLabelValues(worker, chainId).SetToCurrentTime()
+	}
+}
+
+func LagBlocks(worker string, chainId string, blocks uint64) {
+	lagBlocks.WithLabelValues(worker, chainId).Set(float64(blocks))
+}
+
+func LagSeconds(worker string, chainId string, age time.Duration) {
+	lagSeconds.WithLabelValues(worker, chainId).Set(age.Seconds())
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Serves /metrics on given address until ctx is done. Commands without API use it to be scraped
+func Serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	slog.Info(fmt.Sprintf("Metrics are served on %s/metrics", addr))
+	err := server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
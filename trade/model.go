@@ -108,18 +108,59 @@ func (DBInt) GormDataType() string {
 	return "numeric" // PostgreSQL numeric type
 }
 
+// Identity of EVM log within a chain, same as uniqueness index of every event table
+type EventKey struct {
+	TxId     string
+	LogIndex uint
+}
+
+// Processing state shared by all event tables. Events are stored raw first and priced later,
+// so failure of price source never blocks indexing
+type EventState struct {
+	// Event is above the final head of worker and may still be orphaned
+	Unconfirmed bool `json:"unconfirmed" gorm:"index"`
+	// Financial interaction is not created yet
+	Unpriced        bool      `json:"unpriced" gorm:"index"`
+	PricingAttempts uint      `json:"pricingAttempts"`
+	NextPricingAt   time.Time `json:"-"`
+	// Block event was emitted in, empty only for events indexed before blocks were stored
+	BlockId     *uint  `json:"blockId" gorm:"index"`
+	BlockHeader *Block `json:"-" gorm:"foreignKey:BlockId"`
+}
+
+func (s *EventState) MarkUnconfirmed() { s.Unconfirmed = true }
+
+func (s *EventState) MarkUnpriced() { s.Unpriced = true }
+
+func (s *EventState) LinkBlock(id uint) { s.BlockId = &id }
+
 type AaveInteraction struct {
 	gorm.Model
 	Price             DBNumeric `json:"price" binding:"required"`
+	PriceSource       string    `json:"priceSource"`
 	VolumeTokens      DBNumeric `json:"volumeTokens" binding:"required"`
 	VolumeUSD         DBNumeric `json:"volumeUSD" binding:"required"`
-	BlockchainEventID int
+	BlockchainEventID int       `gorm:"uniqueIndex"`
 	BlockchainEvent   AaveEvent `json:"blockchainEvent" binding:"required"`
+	// Set on request of values in currency other than USD
+	Converted *Conversion `json:"converted,omitempty" gorm:"-"`
+}
+
+func (i AaveInteraction) SourceEvent() AaveEvent { return i.BlockchainEvent }
+
+func (i *AaveInteraction) Convert(currency string, rate *big.Rat, rateSource string) {
+	i.Converted = NewConversion(currency, rate, rateSource, i.Price.Rat, i.VolumeUSD.Rat)
+}
+
+func (i *AaveInteraction) LinkSourceEvent(id uint) {
+	i.BlockchainEventID = int(id)
+	i.BlockchainEvent.ID = id
 }
 
 type AaveEvent struct {
 	gorm.Model
 	ChainId       string    `json:"chainId" binding:"required" gorm:"uniqueIndex:aave_idx_event_uniqueness"`
+	PoolAddress   string    `json:"poolAddress"`
 	Direction     string    `json:"direction" binding:"required"`
 	WalletAddress string    `json:"walletAddress" binding:"required"`
 	TokenAddress  string    `json:"tokenAddress" binding:"required"`
@@ -127,10 +168,17 @@ type AaveEvent struct {
 	Timestamp     time.Time `json:"timestamp" binding:"required"`
 	TxId          string    `json:"txId" binding:"required" gorm:"uniqueIndex:aave_idx_event_uniqueness"`
 	LogIndex      uint      `json:"logIndex" binding:"required" gorm:"uniqueIndex:aave_idx_event_uniqueness"`
+	BlockNumber   uint64    `json:"blockNumber" binding:"required"`
+	EventState
 }
 
+func (e AaveEvent) Key() EventKey { return EventKey{TxId: e.TxId, LogIndex: e.LogIndex} }
+
+func (e AaveEvent) Height() uint64 { return e.BlockNumber }
+
 func NewAaveEvent(
 	chainId string,
+	poolAddress common.Address,
 	direction string,
 	walletAddress common.Address,
 	tokenAddress common.Address,
@@ -138,9 +186,11 @@ func NewAaveEvent(
 	timestamp time.Time,
 	txId string,
 	logIndex uint,
+	blockNumber uint64,
 ) AaveEvent {
 	return AaveEvent{
 		ChainId:       chainId,
+		PoolAddress:   poolAddress.Hex(),
 		Direction:     direction,
 		WalletAddress: walletAddress.Hex(),
 		TokenAddress:  tokenAddress.Hex(),
@@ -148,32 +198,55 @@ func NewAaveEvent(
 		Timestamp:     timestamp,
 		TxId:          txId,
 		LogIndex:      logIndex,
+		BlockNumber:   blockNumber,
 	}
 }
 
 type Compound3Interaction struct {
 	gorm.Model
-	Price             DBNumeric `json:"price" binding:"required"`
-	VolumeTokens      DBNumeric `json:"volumeTokens" binding:"required"`
-	VolumeUSD         DBNumeric `json:"volumeUSD" binding:"required"`
-	BlockchainEventID int
+	Price             DBNumeric      `json:"price" binding:"required"`
+	PriceSource       string         `json:"priceSource"`
+	VolumeTokens      DBNumeric      `json:"volumeTokens" binding:"required"`
+	VolumeUSD         DBNumeric      `json:"volumeUSD" binding:"required"`
+	BlockchainEventID int            `gorm:"uniqueIndex"`
 	BlockchainEvent   Compound3Event `json:"blockchainEvent" binding:"required"`
+	// Set on request of values in currency other than USD
+	Converted *Conversion `json:"converted,omitempty" gorm:"-"`
+}
+
+func (i Compound3Interaction) SourceEvent() Compound3Event { return i.BlockchainEvent }
+
+func (i *Compound3Interaction) Convert(currency string, rate *big.Rat, rateSource string) {
+	i.Converted = NewConversion(currency, rate, rateSource, i.Price.Rat, i.VolumeUSD.Rat)
+}
+
+func (i *Compound3Interaction) LinkSourceEvent(id uint) {
+	i.BlockchainEventID = int(id)
+	i.BlockchainEvent.ID = id
 }
 
 type Compound3Event struct {
 	gorm.Model
-	ChainId       string    `json:"chainId" binding:"required" gorm:"uniqueIndex:aave_idx_event_uniqueness"`
+	ChainId       string    `json:"chainId" binding:"required" gorm:"uniqueIndex:compound3_idx_event_uniqueness"`
+	CometAddress  string    `json:"cometAddress"`
 	Direction     string    `json:"direction" binding:"required"`
 	WalletAddress string    `json:"walletAddress" binding:"required"`
 	TokenAddress  string    `json:"tokenAddress" binding:"required"`
 	Amount        DBInt     `json:"amount" binding:"required"`
 	Timestamp     time.Time `json:"timestamp" binding:"required"`
-	TxId          string    `json:"txId" binding:"required" gorm:"uniqueIndex:aave_idx_event_uniqueness"`
-	LogIndex      uint      `json:"logIndex" binding:"required" gorm:"uniqueIndex:aave_idx_event_uniqueness"`
+	TxId          string    `json:"txId" binding:"required" gorm:"uniqueIndex:compound3_idx_event_uniqueness"`
+	LogIndex      uint      `json:"logIndex" binding:"required" gorm:"uniqueIndex:compound3_idx_event_uniqueness"`
+	BlockNumber   uint64    `json:"blockNumber" binding:"required"`
+	EventState
 }
 
+func (e Compound3Event) Key() EventKey { return EventKey{TxId: e.TxId, LogIndex: e.LogIndex} }
+
+func (e Compound3Event) Height() uint64 { return e.BlockNumber }
+
 func NewCompound3Event(
 	chainId string,
+	cometAddress common.Address,
 	direction string,
 	walletAddress common.Address,
 	tokenAddress common.Address,
@@ -181,9 +254,11 @@ func NewCompound3Event(
 	timestamp time.Time,
 	txId string,
 	logIndex uint,
+	blockNumber uint64,
 ) Compound3Event {
 	return Compound3Event{
 		ChainId:       chainId,
+		CometAddress:  cometAddress.Hex(),
 		Direction:     direction,
 		WalletAddress: walletAddress.Hex(),
 		TokenAddress:  tokenAddress.Hex(),
@@ -191,6 +266,7 @@ func NewCompound3Event(
 		Timestamp:     timestamp,
 		TxId:          txId,
 		LogIndex:      logIndex,
+		BlockNumber:   blockNumber,
 	}
 }
 
@@ -217,8 +293,13 @@ type UniswapV3Event struct {
 	TxId            string    `json:"txId" binding:"required" gorm:"uniqueIndex:uniswap_v3_idx_event_uniqueness"`
 	LogIndex        uint      `json:"logIndex" binding:"required" gorm:"uniqueIndex:uniswap_v3_idx_event_uniqueness"`
 	BlockNumber     uint64    `json:"blockNumber" binding:"required"`
+	EventState
 }
 
+func (e UniswapV3Event) Key() EventKey { return EventKey{TxId: e.TxId, LogIndex: e.LogIndex} }
+
+func (e UniswapV3Event) Height() uint64 { return e.BlockNumber }
+
 func NewUniswapV3Event(
 	chainId string,
 	eventType string,
@@ -252,17 +333,41 @@ func NewUniswapV3Event(
 
 type UniswapV3Deal struct {
 	gorm.Model
-	SymbolA            string    `json:"symbolA" binding:"required"`
-	SymbolB            string    `json:"symbolB" binding:"required"`
-	PriceTokenA        DBNumeric `json:"priceTokenA" binding:"required"`
-	PriceTokenB        DBNumeric `json:"priceTokenB" binding:"required"`
-	VolumeTokensAInUSD DBNumeric `json:"volumeTokensAInUSD" binding:"required"`
-	VolumeTokensBInUSD DBNumeric `json:"volumeTokensBInUSD" binding:"required"`
-	VolumeTokensA      DBNumeric `json:"volumeTokensA" binding:"required"`
-	VolumeTokensB      DBNumeric `json:"volumeTokensB" binding:"required"`
-	VolumeTotalUSD     DBNumeric `json:"volumeTotalUSD" binding:"required"`
-	BlockchainEventID  int
+	SymbolA            string         `json:"symbolA" binding:"required"`
+	SymbolB            string         `json:"symbolB" binding:"required"`
+	PriceTokenA        DBNumeric      `json:"priceTokenA" binding:"required"`
+	PriceTokenB        DBNumeric      `json:"priceTokenB" binding:"required"`
+	PriceSourceA       string         `json:"priceSourceA"`
+	PriceSourceB       string         `json:"priceSourceB"`
+	VolumeTokensAInUSD DBNumeric      `json:"volumeTokensAInUSD" binding:"required"`
+	VolumeTokensBInUSD DBNumeric      `json:"volumeTokensBInUSD" binding:"required"`
+	VolumeTokensA      DBNumeric      `json:"volumeTokensA" binding:"required"`
+	VolumeTokensB      DBNumeric      `json:"volumeTokensB" binding:"required"`
+	VolumeTotalUSD     DBNumeric      `json:"volumeTotalUSD" binding:"required"`
+	BlockchainEventID  int            `gorm:"uniqueIndex"`
 	BlockchainEvent    UniswapV3Event `json:"blockchainEvent" binding:"required"`
+	// Set on request of values in currency other than USD
+	Converted *UniswapV3Conversion `json:"converted,omitempty" gorm:"-"`
+}
+
+func (d UniswapV3Deal) SourceEvent() UniswapV3Event { return d.BlockchainEvent }
+
+func (d *UniswapV3Deal) Convert(currency string, rate *big.Rat, rateSource string) {
+	d.Converted = &UniswapV3Conversion{
+		Currency:                currency,
+		Rate:                    NewDBNumeric(rate),
+		RateSource:              rateSource,
+		PriceTokenA:             NewDBNumeric(new(big.Rat).Quo(d.PriceTokenA.Rat, rate)),
+		PriceTokenB:             NewDBNumeric(new(big.Rat).Quo(d.PriceTokenB.Rat, rate)),
+		VolumeTokensAInCurrency: NewDBNumeric(new(big.Rat).Quo(d.VolumeTokensAInUSD.Rat, rate)),
+		VolumeTokensBInCurrency: NewDBNumeric(new(big.Rat).Quo(d.VolumeTokensBInUSD.Rat, rate)),
+		VolumeTotal:             NewDBNumeric(new(big.Rat).Quo(d.VolumeTotalUSD.Rat, rate)),
+	}
+}
+
+func (d *UniswapV3Deal) LinkSourceEvent(id uint) {
+	d.BlockchainEventID = int(id)
+	d.BlockchainEvent.ID = id
 }
 
 func NewUniswapV3Deal(
@@ -270,6 +375,8 @@ func NewUniswapV3Deal(
 	tickerB string,
 	priceTokenA *big.Rat,
 	priceTokenB *big.Rat,
+	priceSourceA string,
+	priceSourceB string,
 	volumeTokensAInUSD *big.Rat,
 	volumeTokensBInUSD *big.Rat,
 	volumeTokensA *big.Rat,
@@ -282,6 +389,8 @@ func NewUniswapV3Deal(
 		SymbolB:            tickerB,
 		PriceTokenA:        NewDBNumeric(priceTokenA),
 		PriceTokenB:        NewDBNumeric(priceTokenB),
+		PriceSourceA:       priceSourceA,
+		PriceSourceB:       priceSourceB,
 		VolumeTokensAInUSD: NewDBNumeric(volumeTokensAInUSD),
 		VolumeTokensBInUSD: NewDBNumeric(volumeTokensBInUSD),
 		VolumeTokensA:      NewDBNumeric(volumeTokensA),
@@ -310,11 +419,58 @@ func NewUniswapV3Position(chainId string, uniswapPositionsManager common.Address
 
 type Deal struct {
 	gorm.Model
-	Price                DBNumeric `json:"price" binding:"required"`
-	VolumeTokens         DBNumeric `json:"volumeTokens" binding:"required"`
-	VolumeUSD            DBNumeric `json:"volumeUSD" binding:"required"`
-	BlockchainTransferID int
+	Price                DBNumeric     `json:"price" binding:"required"`
+	PriceSource          string        `json:"priceSource"`
+	VolumeTokens         DBNumeric     `json:"volumeTokens" binding:"required"`
+	VolumeUSD            DBNumeric     `json:"volumeUSD" binding:"required"`
+	BlockchainTransferID int           `gorm:"uniqueIndex"`
 	BlockchainTransfer   ERC20Transfer `json:"blockchainTransfer" binding:"required"`
+	// Set on request of values in currency other than USD
+	Converted *Conversion `json:"converted,omitempty" gorm:"-"`
+}
+
+func (d Deal) SourceEvent() ERC20Transfer { return d.BlockchainTransfer }
+
+func (d *Deal) Convert(currency string, rate *big.Rat, rateSource string) {
+	d.Converted = NewConversion(currency, rate, rateSource, d.Price.Rat, d.VolumeUSD.Rat)
+}
+
+// Price and volume of financial interaction in currency other than USD, converted at USD price of currency
+// at time of event rather than the current one
+type Conversion struct {
+	Currency string `json:"currency"`
+	// USD price of currency at time of event
+	Rate       DBNumeric `json:"rate"`
+	RateSource string    `json:"rateSource"`
+	Price      DBNumeric `json:"price"`
+	Volume     DBNumeric `json:"volume"`
+}
+
+func NewConversion(currency string, rate *big.Rat, rateSource string, priceUSD *big.Rat, volumeUSD *big.Rat) *Conversion {
+	return &Conversion{
+		Currency:   currency,
+		Rate:       NewDBNumeric(rate),
+		RateSource: rateSource,
+		Price:      NewDBNumeric(new(big.Rat).Quo(priceUSD, rate)),
+		Volume:     NewDBNumeric(new(big.Rat).Quo(volumeUSD, rate)),
+	}
+}
+
+// Prices and volumes of Uniswap V3 deal in currency other than USD, converted at USD price of currency at time of event
+type UniswapV3Conversion struct {
+	Currency                string    `json:"currency"`
+	Rate                    DBNumeric `json:"rate"`
+	RateSource              string    `json:"rateSource"`
+	PriceTokenA             DBNumeric `json:"priceTokenA"`
+	PriceTokenB             DBNumeric `json:"priceTokenB"`
+	VolumeTokensAInCurrency DBNumeric `json:"volumeTokensAInCurrency"`
+	VolumeTokensBInCurrency DBNumeric `json:"volumeTokensBInCurrency"`
+	VolumeTotal             DBNumeric `json:"volumeTotal"`
+}
+
+func (d *Deal) LinkSourceEvent(id uint) {
+	d.BlockchainTransferID = int(id)
+	d.BlockchainTransfer.ID = id
 }
 
 type Chain struct {
@@ -335,8 +491,13 @@ type ERC20Transfer struct {
 	Timestamp    time.Time `json:"timestamp" binding:"required"`
 	TxId         string    `json:"txId" binding:"required" gorm:"uniqueIndex:erc20_idx_event_uniqueness"`
 	LogIndex     uint      `json:"logIndex" binding:"required" gorm:"uniqueIndex:erc20_idx_event_uniqueness"`
+	EventState
 }
 
+func (t ERC20Transfer) Key() EventKey { return EventKey{TxId: t.TxId, LogIndex: t.LogIndex} }
+
+func (t ERC20Transfer) Height() uint64 { return t.Block.Uint64() }
+
 func NewERC20Transfer(
 	address string,
 	sender string,
@@ -361,11 +522,162 @@ func NewERC20Transfer(
 	}
 }
 
+// Header of a block the indexer has reached or seen events in. Source of truth for block timestamps,
+// also kept to detect chain reorganizations
+type Block struct {
+	gorm.Model
+	ChainId    string    `json:"chainId" binding:"required" gorm:"uniqueIndex:idx_block_uniqueness"`
+	Number     uint64    `json:"number" binding:"required" gorm:"uniqueIndex:idx_block_uniqueness"`
+	Hash       string    `json:"hash" binding:"required"`
+	ParentHash string    `json:"parentHash" binding:"required"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// Candle of market symbol at price provider. Table is the authoritative store of fetched prices, cache only holds
+// closes of candles in front of it, so history survives flush of cache and is moved between environments as CSV
+type Price struct {
+	gorm.Model
+	Source        string    `json:"source" binding:"required" gorm:"uniqueIndex:idx_price_uniqueness"`
+	Symbol        string    `json:"symbol" binding:"required" gorm:"uniqueIndex:idx_price_uniqueness"`
+	IntervalStart time.Time `json:"intervalStart" binding:"required" gorm:"uniqueIndex:idx_price_uniqueness"`
+	Open          DBNumeric `json:"open" binding:"required"`
+	High          DBNumeric `json:"high" binding:"required"`
+	Low           DBNumeric `json:"low" binding:"required"`
+	Close         DBNumeric `json:"close" binding:"required"`
+}
+
+func NewBlock(chainId string, number uint64, hash common.Hash, parentHash common.Hash, timestamp uint64) Block {
+	return Block{
+		ChainId:    chainId,
+		Number:     number,
+		Hash:       hash.Hex(),
+		ParentHash: parentHash.Hex(),
+		Timestamp:  time.Unix(int64(timestamp), 0),
+	}
+}
+
+// Limits of JSON RPC provider, zero means no limit
+type RpcLimit struct {
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	MaxConcurrency    int     `json:"maxConcurrency"`
+}
+
+// Limits of JSON RPC providers keyed by URL, stored as jsonb
+type RpcLimits map[string]RpcLimit
+
+func (l *RpcLimits) Scan(value any) error {
+	if value == nil {
+		*l = nil
+		return nil
+	}
+	var data []byte
+	switch v := value.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("failed to scan RpcLimits: expected json, got %T", value)
+	}
+	return json.Unmarshal(data, l)
+}
+
+func (l RpcLimits) Value() (driver.Value, error) {
+	if l == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (RpcLimits) GormDataType() string {
+	return "jsonb"
+}
+
+// Capabilities of JSON RPC endpoint found by probing it
+type RpcCapability struct {
+	// State of blocks deep in history is served, not only of the recent ones
+	Archive bool `json:"archive"`
+	// Archive check failed for reasons other than pruned state, e.g. timeout or rate limit, so Archive tells nothing
+	ArchiveUnknown bool `json:"archiveUnknown,omitempty"`
+	// Widest block range of eth_getLogs accepted, zero when none of probed ranges is
+	LogsRange uint64    `json:"logsRange"`
+	LatencyMs int64     `json:"latencyMs"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// Capabilities of JSON RPC endpoints keyed by URL, stored as jsonb
+type RpcCapabilities map[string]RpcCapability
+
+func (c *RpcCapabilities) Scan(value any) error {
+	if value == nil {
+		*c = nil
+		return nil
+	}
+	var data []byte
+	switch v := value.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("failed to scan RpcCapabilities: expected json, got %T", value)
+	}
+	return json.Unmarshal(data, c)
+}
+
+func (c RpcCapabilities) Value() (driver.Value, error) {
+	if c == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (RpcCapabilities) GormDataType() string {
+	return "jsonb"
+}
+
 type Worker struct {
 	gorm.Model
+	ChainId                       string         `json:"chainId"`
 	BlockchainUrlsForCacheManager pq.StringArray `json:"blockchainUrlsForCacheManager" binding:"required" gorm:"type:text[]"`
 	BlockchainUrlsForEvents       pq.StringArray `json:"blockchainUrlsForEvents" binding:"required" gorm:"type:text[]"`
 	BlocksInterval                uint64         `json:"blocksInterval" binding:"required"`
+	// Published limits of providers, enforced for calls to URL from all handlers and cache manager of process
+	RpcLimits RpcLimits `json:"rpcLimits"`
+	// Found by rpc discover for URLs of both lists
+	RpcCapabilities RpcCapabilities `json:"rpcCapabilities"`
+	// Which head is treated as final, one of Finality* constants; empty one means confirmation depth
+	Finality          string `json:"finality"`
+	ConfirmationDepth uint64 `json:"confirmationDepth"`
+	// Index blocks above the final head too, their events are flagged unconfirmed until the final head passes them
+	IndexUnconfirmed bool `json:"indexUnconfirmed"`
+	// Progress maintained by indexing cycles: heads seen by the last successful cycle and the slowest tracked wallet
+	HeadBlock        uint64     `json:"headBlock"`
+	FinalBlock       uint64     `json:"finalBlock"`
+	IndexedBlock     uint64     `json:"indexedBlock"`
+	IndexedBlockTime *time.Time `json:"indexedBlockTime"`
+	LastCycleAt      *time.Time `json:"lastCycleAt"`
+	LastError        string     `json:"lastError"`
+	LastErrorAt      *time.Time `json:"lastErrorAt"`
+}
+
+const (
+	FinalityDepth     = "depth"
+	FinalitySafe      = "safe"
+	FinalityFinalized = "finalized"
+)
+
+// Whether the latest block is final right away, i.e. confirmation depth of zero
+func (w Worker) FinalAtLatest() bool {
+	return (w.Finality == "" || w.Finality == FinalityDepth) && w.ConfirmationDepth == 0
 }
 
 type AnalyticsWorker struct {
@@ -373,6 +685,46 @@ type AnalyticsWorker struct {
 	BlockchainUrls pq.StringArray `json:"blockchainUrl" binding:"required" gorm:"type:text[]"`
 	BlocksInterval uint64         `json:"blocksInterval" binding:"required"`
 	LastBlock      uint64         `json:"lastBlock" binding:"required"`
+	// Progress maintained by Analyze
+	HeadBlock   uint64     `json:"headBlock"`
+	LastCycleAt *time.Time `json:"lastCycleAt"`
+	LastError   string     `json:"lastError"`
+	LastErrorAt *time.Time `json:"lastErrorAt"`
+}
+
+// Pairs of token keyed by price provider, stored as jsonb
+type PricePairs map[string]string
+
+func (p *PricePairs) Scan(value any) error {
+	if value == nil {
+		*p = nil
+		return nil
+	}
+	var data []byte
+	switch v := value.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("failed to scan PricePairs: expected json, got %T", value)
+	}
+	return json.Unmarshal(data, p)
+}
+
+func (p PricePairs) Value() (driver.Value, error) {
+	if p == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (PricePairs) GormDataType() string {
+	return "jsonb"
 }
 
 type Token struct {
@@ -381,6 +733,20 @@ type Token struct {
 	Symbol   string `json:"symbol" binding:"required" gorm:"uniqueIndex:idx_token_uniqueness"`
 	Address  string `json:"address" binding:"required" gorm:"uniqueIndex:idx_token_uniqueness"`
 	Decimals DBInt  `json:"decimals" binding:"required"`
+	// Price providers asked in order, all of them in default order when empty
+	PriceSources pq.StringArray `json:"priceSources" gorm:"type:text[]"`
+	// Asset token is priced as at markets, e.g. ETH for WETH; symbol of token when empty
+	PriceAsset string `json:"priceAsset"`
+	// Currency token is pegged to, e.g. USD for USDC. USD peg is priced as 1, other pegs are priced as assets
+	PricePeg string `json:"pricePeg"`
+	// Pairs of token at providers overriding asset, e.g. binance: ETHUSDC
+	PricePairs PricePairs `json:"pricePairs"`
+	// Chainlink feed of token price, configured per chain since token is
+	ChainlinkFeed string `json:"chainlinkFeed"`
+	// Address of token feed answers in, e.g. WETH of wstETH / ETH feed; empty one means USD
+	ChainlinkDenomination string `json:"chainlinkDenomination"`
+	// Uniswap V3 pool pricing token against its other token
+	PricePool string `json:"pricePool"`
 }
 
 const (
@@ -404,33 +770,112 @@ type TrackedWallet struct {
 	LastBlock uint64 `json:"lastBlock" binding:"required"`
 }
 
+// Last block indexed by protocol handler for tracked wallet. Handlers are identified by their keys, not display names
+type Checkpoint struct {
+	gorm.Model
+	ChainId   string `json:"chainId" binding:"required" gorm:"uniqueIndex:idx_checkpoint_uniqueness"`
+	Handler   string `json:"handler" binding:"required" gorm:"uniqueIndex:idx_checkpoint_uniqueness"`
+	Wallet    string `json:"wallet" binding:"required" gorm:"uniqueIndex:idx_checkpoint_uniqueness"`
+	LastBlock uint64 `json:"lastBlock" binding:"required"`
+}
+
+func NewCheckpoint(chainId string, handler string, wallet string, lastBlock uint64) Checkpoint {
+	return Checkpoint{
+		ChainId:   chainId,
+		Handler:   handler,
+		Wallet:    wallet,
+		LastBlock: lastBlock,
+	}
+}
+
+const (
+	DeadLetterRange = "range"
+	DeadLetterLog   = "log"
+)
+
+// Unit of indexing work which failed: block range of handler, identified by its key, or single log which could not be parsed.
+// It is set aside and retried with backoff, so it does not hold back checkpoints of its wallets
+type DeadLetter struct {
+	gorm.Model
+	ChainId   string         `json:"chainId" binding:"required" gorm:"index"`
+	Handler   string         `json:"handler" binding:"required"`
+	Kind      string         `json:"kind" binding:"required"`
+	FromBlock uint64         `json:"fromBlock" binding:"required"`
+	ToBlock   uint64         `json:"toBlock" binding:"required"`
+	Wallets   pq.StringArray `json:"wallets" binding:"required" gorm:"type:text[]"`
+	// Set for logs only
+	TxId        string    `json:"txId"`
+	LogIndex    uint      `json:"logIndex"`
+	Error       string    `json:"error" binding:"required"`
+	Attempts    uint      `json:"attempts" binding:"required"`
+	NextRetryAt time.Time `json:"nextRetryAt" binding:"required"`
+}
+
+func NewDeadLetter(chainId string, handler string, kind string, fromBlock uint64, toBlock uint64, wallets []string, err error) DeadLetter {
+	return DeadLetter{
+		ChainId:   chainId,
+		Handler:   handler,
+		Kind:      kind,
+		FromBlock: fromBlock,
+		ToBlock:   toBlock,
+		Wallets:   wallets,
+		Error:     err.Error(),
+		Attempts:  1,
+	}
+}
+
+// Block range of historical backfill processed by single handler, identified by its key
+type BackfillShard struct {
+	gorm.Model
+	ChainId   string `json:"chainId" binding:"required" gorm:"uniqueIndex:idx_backfill_shard_uniqueness"`
+	Wallet    string `json:"wallet" binding:"required" gorm:"uniqueIndex:idx_backfill_shard_uniqueness"`
+	Handler   string `json:"handler" binding:"required" gorm:"uniqueIndex:idx_backfill_shard_uniqueness"`
+	FromBlock uint64 `json:"fromBlock" binding:"required" gorm:"uniqueIndex:idx_backfill_shard_uniqueness"`
+	ToBlock   uint64 `json:"toBlock" binding:"required" gorm:"uniqueIndex:idx_backfill_shard_uniqueness"`
+	Done      bool   `json:"done" binding:"required"`
+}
+
+func NewBackfillShard(chainId string, wallet string, handler string, fromBlock uint64, toBlock uint64) BackfillShard {
+	return BackfillShard{
+		ChainId:   chainId,
+		Wallet:    wallet,
+		Handler:   handler,
+		FromBlock: fromBlock,
+		ToBlock:   toBlock,
+	}
+}
+
 type BalanceAcrossAllChains struct {
-	Address string `json:"address" binding:"required"`
-	Balance string `json:"balance" binding:"required"`
+	Address  string `json:"address" binding:"required"`
+	Balance  string `json:"balance" binding:"required"`
+	Currency string `json:"currency"`
 }
 
-func NewBalanceAcrossAllChains(address string, balance string) *BalanceAcrossAllChains {
+func NewBalanceAcrossAllChains(address string, balance string, currency string) *BalanceAcrossAllChains {
 	return &BalanceAcrossAllChains{
-		Address: address,
-		Balance: balance,
+		Address:  address,
+		Balance:  balance,
+		Currency: currency,
 	}
 }
 
 type BalanceOnChain struct {
-	ChainId string `json:"chainId" binding:"required"`
-	Address string `json:"address" binding:"required"`
-	Balance string `json:"balance" binding:"required"`
+	ChainId  string `json:"chainId" binding:"required"`
+	Address  string `json:"address" binding:"required"`
+	Balance  string `json:"balance" binding:"required"`
+	Currency string `json:"currency"`
 }
 
 func (b *BalanceOnChain) MarshalBinary() ([]byte, error) {
 	return json.Marshal(b)
 }
 
-func NewBalanceOnChain(chainId string, address string, balance string) *BalanceOnChain {
+func NewBalanceOnChain(chainId string, address string, balance string, currency string) *BalanceOnChain {
 	return &BalanceOnChain{
-		Address: address,
-		Balance: balance,
-		ChainId: chainId,
+		Address:  address,
+		Balance:  balance,
+		ChainId:  chainId,
+		Currency: currency,
 	}
 }
 
@@ -449,24 +894,24 @@ func NewDealsByWallet(wallet string, dealsIn []Deal, dealsOut []Deal) *DealsByWa
 }
 
 type TokenBalanceByChain struct {
-    ChainId      string `json:"chainId" binding:"required"`
-    TokenAddress string `json:"tokenAddress" binding:"required"`
-    TokenSymbol  string `json:"tokenSymbol" binding:"required"`
-    TotalBalance string `json:"totalBalance" binding:"required"`
-    Wallets      []WalletBalance `json:"wallets" binding:"required"`
+	ChainId      string          `json:"chainId" binding:"required"`
+	TokenAddress string          `json:"tokenAddress" binding:"required"`
+	TokenSymbol  string          `json:"tokenSymbol" binding:"required"`
+	TotalBalance string          `json:"totalBalance" binding:"required"`
+	Wallets      []WalletBalance `json:"wallets" binding:"required"`
 }
 
 type WalletBalance struct {
-    WalletAddress string `json:"walletAddress" binding:"required"`
-    Balance       string `json:"balance" binding:"required"`
+	WalletAddress string `json:"walletAddress" binding:"required"`
+	Balance       string `json:"balance" binding:"required"`
 }
 
 func NewTokenBalanceByChain(chainId string, tokenAddress string, tokenSymbol string, totalBalance string, wallets []WalletBalance) *TokenBalanceByChain {
-    return &TokenBalanceByChain{
-        ChainId:      chainId,
-        TokenAddress: tokenAddress,
-        TokenSymbol:  tokenSymbol,
-        TotalBalance: totalBalance,
-        Wallets:      wallets,
-    }
+	return &TokenBalanceByChain{
+		ChainId:      chainId,
+		TokenAddress: tokenAddress,
+		TokenSymbol:  tokenSymbol,
+		TotalBalance: totalBalance,
+		Wallets:      wallets,
+	}
 }
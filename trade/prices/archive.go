@@ -0,0 +1,188 @@
+package prices
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Header of CSV archive of candles, written by export and expected by import
+var archiveHeader = []string{"source", "symbol", "interval_start", "open", "high", "low", "close"}
+
+// Rows of archive imported in one statement
+const archiveBatchSize = 1000
+
+// Row of archive of provider
+func (c Candle) Row(source string) trade.Price {
+	return trade.Price{
+		Source:        source,
+		Symbol:        c.Symbol,
+		IntervalStart: c.Start,
+		Open:          trade.NewDBNumeric(c.Open),
+		High:          trade.NewDBNumeric(c.High),
+		Low:           trade.NewDBNumeric(c.Low),
+		Close:         trade.NewDBNumeric(c.Close),
+	}
+}
+
+// Candles of archive to export; empty fields match all
+type ArchiveFilter struct {
+	Source  string
+	Symbols []string
+	From    time.Time
+	To      time.Time
+}
+
+// Export order of the last candle written, the next page starts after it
+type archiveCursor struct {
+	source string
+	symbol string
+	start  time.Time
+}
+
+// Writes archived candles matching filter as CSV, ordered by source, symbol and time. Returns number of candles written
+func Export(db *gorm.DB, writer io.Writer, filter ArchiveFilter) (int, error) {
+	query := db.Model(&trade.Price{})
+	if filter.Source != "" {
+		query = query.Where("source = ?", filter.Source)
+	}
+	if len(filter.Symbols) > 0 {
+		query = query.Where("symbol IN ?", filter.Symbols)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("interval_start >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("interval_start < ?", filter.To)
+	}
+	query = query.Session(&gorm.Session{})
+	// pages are sought by key of export order, paging by id would skip and repeat candles not ordered by id
+	return writeArchive(writer, func(after *archiveCursor) ([]trade.Price, error) {
+		page := query
+		if after != nil {
+			page = page.Where("(source, symbol, interval_start) > (?, ?, ?)", after.source, after.symbol, after.start)
+		}
+		var rows []trade.Price
+		err := page.Order("source, symbol, interval_start").Limit(archiveBatchSize).Find(&rows).Error
+		return rows, err
+	})
+}
+
+// Writes pages of candles as CSV until a page is shorter than a batch
+func writeArchive(writer io.Writer, nextPage func(after *archiveCursor) ([]trade.Price, error)) (int, error) {
+	csvWriter := csv.NewWriter(writer)
+	err := csvWriter.Write(archiveHeader)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	var after *archiveCursor
+	for {
+		rows, err := nextPage(after)
+		if err != nil {
+			return count, err
+		}
+		for _, row := range rows {
+			err := csvWriter.Write([]string{
+				row.Source,
+				row.Symbol,
+				row.IntervalStart.UTC().Format(time.RFC3339),
+				decimal(row.Open.Rat),
+				decimal(row.High.Rat),
+				decimal(row.Low.Rat),
+				decimal(row.Close.Rat),
+			})
+			if err != nil {
+				return count, err
+			}
+		}
+		count += len(rows)
+		if len(rows) < archiveBatchSize {
+			break
+		}
+		last := rows[len(rows)-1]
+		after = &archiveCursor{source: last.Source, symbol: last.Symbol, start: last.IntervalStart}
+	}
+	csvWriter.Flush()
+	return count, csvWriter.Error()
+}
+
+// Stores candles of CSV written by Export. Candles archived already are kept, since candles of the past do not change.
+// Returns numbers of candles read and stored
+func Import(db *gorm.DB, reader io.Reader) (int, int, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = len(archiveHeader)
+	header, err := csvReader.Read()
+	if err != nil {
+		return 0, 0, fmt.Errorf("Cannot read header of archive: %w", err)
+	}
+	if !strings.EqualFold(strings.Join(header, ","), strings.Join(archiveHeader, ",")) {
+		return 0, 0, fmt.Errorf("Header of archive is %v, expected %v", header, archiveHeader)
+	}
+	read, stored := 0, 0
+	batch := make([]trade.Price, 0, archiveBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&batch)
+		if result.Error != nil {
+			return result.Error
+		}
+		stored += int(result.RowsAffected)
+		batch = batch[:0]
+		return nil
+	}
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return read, stored, err
+		}
+		read++
+		row, err := parseArchiveRecord(record)
+		if err != nil {
+			return read, stored, fmt.Errorf("Malformed candle on line %d: %w", read+1, err)
+		}
+		batch = append(batch, row)
+		if len(batch) == archiveBatchSize {
+			err = flush()
+			if err != nil {
+				return read, stored, err
+			}
+		}
+	}
+	return read, stored, flush()
+}
+
+func parseArchiveRecord(record []string) (trade.Price, error) {
+	start, err := time.Parse(time.RFC3339, record[2])
+	if err != nil {
+		return trade.Price{}, err
+	}
+	values := make([]*big.Rat, 4)
+	for i := range values {
+		value, ok := new(big.Rat).SetString(record[i+3])
+		if !ok {
+			return trade.Price{}, fmt.Errorf("Malformed %s %s", archiveHeader[i+3], record[i+3])
+		}
+		values[i] = value
+	}
+	candle := Candle{Symbol: record[1], Start: start, Open: values[0], High: values[1], Low: values[2], Close: values[3]}
+	return candle.Row(record[0]), nil
+}
+
+// Decimal with precision of database and without trailing zeros
+func decimal(value *big.Rat) string {
+	result := value.FloatString(20)
+	return strings.TrimSuffix(strings.TrimRight(result, "0"), ".")
+}
@@ -0,0 +1,98 @@
+package prices
+
+import (
+	"bytes"
+	"encoding/csv"
+	"math/big"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stryukovsky/go-backend-learn/trade"
+)
+
+// Candles in export order, ids are given in reverse of it as rows inserted out of order get them
+func archivedRows(count int) []trade.Price {
+	rows := make([]trade.Price, 0, count)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range count {
+		symbol := []string{"BTC", "ETH", "LINK"}[i%3]
+		candle := Candle{
+			Symbol: symbol,
+			Start:  start.Add(time.Duration(i/3) * binanceBucket),
+			Open:   big.NewRat(int64(i), 1),
+			High:   big.NewRat(int64(i)+2, 1),
+			Low:    big.NewRat(int64(i)-1, 1),
+			Close:  big.NewRat(int64(i)+1, 2),
+		}
+		row := candle.Row(SourceBinance)
+		row.ID = uint(count - i)
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return lessInExportOrder(rows[i], rows[j]) })
+	return rows
+}
+
+func lessInExportOrder(left trade.Price, right trade.Price) bool {
+	if left.Source != right.Source {
+		return left.Source < right.Source
+	}
+	if left.Symbol != right.Symbol {
+		return left.Symbol < right.Symbol
+	}
+	return left.IntervalStart.Before(right.IntervalStart)
+}
+
+func TestExportOfSeveralBatches(t *testing.T) {
+	rows := archivedRows(2*archiveBatchSize + 500)
+	// pages sought by key as the database does
+	nextPage := func(after *archiveCursor) ([]trade.Price, error) {
+		first := 0
+		if after != nil {
+			cursor := trade.Price{Source: after.source, Symbol: after.symbol, IntervalStart: after.start}
+			first = sort.Search(len(rows), func(i int) bool { return lessInExportOrder(cursor, rows[i]) })
+		}
+		return rows[first:min(first+archiveBatchSize, len(rows))], nil
+	}
+	var output bytes.Buffer
+	count, err := writeArchive(&output, nextPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(rows) {
+		t.Fatalf("Exported %d candles, expected %d", count, len(rows))
+	}
+	records, err := csv.NewReader(&output).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(rows)+1 {
+		t.Fatalf("Archive has %d lines, expected %d", len(records), len(rows)+1)
+	}
+	seen := make(map[string]bool, len(rows))
+	for i, record := range records[1:] {
+		row, err := parseArchiveRecord(record)
+		if err != nil {
+			t.Fatalf("Malformed candle on line %d: %s", i+2, err.Error())
+		}
+		key := row.Symbol + row.IntervalStart.String()
+		if seen[key] {
+			t.Fatalf("Candle %s %s is exported twice", row.Symbol, row.IntervalStart)
+		}
+		seen[key] = true
+		if row.Close.Rat.Cmp(rows[i].Close.Rat) != 0 || !row.IntervalStart.Equal(rows[i].IntervalStart) {
+			t.Fatalf("Line %d is candle of %s %s, expected %s %s", i+2, row.Symbol, row.IntervalStart, rows[i].Symbol, rows[i].IntervalStart)
+		}
+	}
+}
+
+func TestExportOfEmptyArchive(t *testing.T) {
+	var output bytes.Buffer
+	count, err := writeArchive(&output, func(after *archiveCursor) ([]trade.Price, error) { return nil, nil })
+	if err != nil || count != 0 {
+		t.Fatalf("Exported %d candles of empty archive: %v", count, err)
+	}
+	if output.String() != "source,symbol,interval_start,open,high,low,close\n" {
+		t.Errorf("Archive of no candles is %q", output.String())
+	}
+}
@@ -0,0 +1,162 @@
+package prices
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/binance"
+)
+
+// Candles are shared by events of the same 5 minutes
+const binanceBucket = 5 * time.Minute
+
+// Quote currency of Binance pairs, priced by the inverted pair of another stablecoin instead of being taken as 1
+const (
+	binanceQuote        = "USDT"
+	binanceQuoteCounter = "USDC"
+)
+
+// Close price of token in USDT from Binance klines. Token is traded as its market symbol against USDT unless its pair is overridden
+type BinanceOracle struct{}
+
+func NewBinanceOracle() *BinanceOracle {
+	return &BinanceOracle{}
+}
+
+func (o *BinanceOracle) Source() string { return SourceBinance }
+
+func (o *BinanceOracle) CacheKey(token trade.Token, at Moment) string {
+	symbol, start := o.CandleOf(token, at)
+	return fmt.Sprintf("quote:%s:%d", symbol, start.UnixMilli())
+}
+
+func (o *BinanceOracle) CandleOf(token trade.Token, at Moment) (string, time.Time) {
+	return MarketSymbol(token, SourceBinance), at.Time.Truncate(binanceBucket)
+}
+
+func (o *BinanceOracle) Price(ctx context.Context, token trade.Token, at Moment) (*big.Rat, error) {
+	candle, err := o.Candle(ctx, token, at)
+	if err != nil {
+		return nil, err
+	}
+	return candle.Close, nil
+}
+
+// The first 1 minute kline since start of bucket of moment
+func (o *BinanceOracle) Candle(ctx context.Context, token trade.Token, at Moment) (Candle, error) {
+	symbol, start := o.CandleOf(token, at)
+	pair, inverted := binancePair(token)
+	klines, err := binance.GetKlines(ctx, pair, start, 1)
+	if err != nil {
+		return Candle{}, err
+	}
+	if len(klines) == 0 {
+		return Candle{}, binance.NoCandle
+	}
+	return binanceCandle(symbol, start, pair, klines[0], inverted)
+}
+
+// Candles of (pair, 5 minute bucket) pairs needed by requests, fetched as contiguous pages of 1 minute klines.
+// Buckets of a pair closer than a page to the first bucket of page share it, so a page covers up to 200 buckets
+func (o *BinanceOracle) Candles(ctx context.Context, requests []Request) (map[string]Candle, error) {
+	// tokens sharing a pair may differ in market symbol, their candles are archived under their own symbols
+	type bucketRequest struct {
+		key      string
+		symbol   string
+		inverted bool
+	}
+	pairs := make(map[string]map[int64][]bucketRequest)
+	for _, request := range requests {
+		pair, inverted := binancePair(request.Token)
+		symbol, start := o.CandleOf(request.Token, request.At)
+		if _, ok := pairs[pair]; !ok {
+			pairs[pair] = make(map[int64][]bucketRequest)
+		}
+		bucket := start.UnixMilli()
+		pairs[pair][bucket] = append(pairs[pair][bucket], bucketRequest{
+			key:      o.CacheKey(request.Token, request.At),
+			symbol:   symbol,
+			inverted: inverted,
+		})
+	}
+	result := make(map[string]Candle)
+	for pair, requested := range pairs {
+		buckets := make([]int64, 0, len(requested))
+		for bucket := range requested {
+			buckets = append(buckets, bucket)
+		}
+		slices.Sort(buckets)
+		for _, page := range binancePages(buckets) {
+			start, last := page[0], page[len(page)-1]
+			limit := int((last-start)/time.Minute.Milliseconds()) + 1
+			klines, err := binance.GetKlines(ctx, pair, time.UnixMilli(start), limit)
+			if err != nil {
+				return result, fmt.Errorf("Cannot fetch klines of %s from %s: %w", pair, time.UnixMilli(start), err)
+			}
+			for _, bucket := range page {
+				// the first candle since bucket, as single price lookup takes it
+				i := sort.Search(len(klines), func(i int) bool { return klines[i].OpenTime.UnixMilli() >= bucket })
+				if i == len(klines) {
+					continue
+				}
+				for _, bucketRequest := range requested[bucket] {
+					candle, err := binanceCandle(bucketRequest.symbol, time.UnixMilli(bucket), pair, klines[i], bucketRequest.inverted)
+					if err != nil {
+						return result, err
+					}
+					result[bucketRequest.key] = candle
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// Sorted buckets split into runs fitting a single klines request each
+func binancePages(buckets []int64) [][]int64 {
+	span := int64(binance.MaxKlinesLimit-1) * time.Minute.Milliseconds()
+	pages := make([][]int64, 0)
+	for _, bucket := range buckets {
+		if len(pages) > 0 && bucket-pages[len(pages)-1][0] <= span {
+			pages[len(pages)-1] = append(pages[len(pages)-1], bucket)
+			continue
+		}
+		pages = append(pages, []int64{bucket})
+	}
+	return pages
+}
+
+// Pair token is priced by and whether its price is the inverted price of pair, as for the quote currency itself
+func binancePair(token trade.Token) (string, bool) {
+	if pair := token.PricePairs[SourceBinance]; pair != "" {
+		return pair, false
+	}
+	symbol := MarketSymbol(token, SourceBinance)
+	if symbol != binanceQuote {
+		return binance.GetQuoteId(symbol, binanceQuote), false
+	}
+	return binance.GetQuoteId(binanceQuoteCounter, binanceQuote), true
+}
+
+// Candle of bucket from kline of pair; inverted kline swaps its high and low
+func binanceCandle(symbol string, start time.Time, pair string, kline binance.Kline, inverted bool) (Candle, error) {
+	candle := Candle{Symbol: symbol, Start: start, Open: kline.Open, High: kline.High, Low: kline.Low, Close: kline.Close}
+	if !inverted {
+		return candle, nil
+	}
+	for _, price := range []*big.Rat{kline.Open, kline.High, kline.Low, kline.Close} {
+		if price.Sign() <= 0 {
+			return Candle{}, fmt.Errorf("Price of %s is not positive", pair)
+		}
+	}
+	candle.Open = new(big.Rat).Inv(kline.Open)
+	candle.High = new(big.Rat).Inv(kline.Low)
+	candle.Low = new(big.Rat).Inv(kline.High)
+	candle.Close = new(big.Rat).Inv(kline.Close)
+	return candle, nil
+}
@@ -0,0 +1,273 @@
+package prices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/web3client"
+)
+
+const aggregatorABI = `[
+	{"name":"decimals","type":"function","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint8"}]},
+	{"name":"latestRoundData","type":"function","stateMutability":"view","inputs":[],"outputs":[
+		{"name":"roundId","type":"uint80"},
+		{"name":"answer","type":"int256"},
+		{"name":"startedAt","type":"uint256"},
+		{"name":"updatedAt","type":"uint256"},
+		{"name":"answeredInRound","type":"uint80"}
+	]},
+	{"name":"getRoundData","type":"function","stateMutability":"view","inputs":[{"name":"_roundId","type":"uint80"}],"outputs":[
+		{"name":"roundId","type":"uint80"},
+		{"name":"answer","type":"int256"},
+		{"name":"startedAt","type":"uint256"},
+		{"name":"updatedAt","type":"uint256"},
+		{"name":"answeredInRound","type":"uint80"}
+	]},
+	{"name":"phaseAggregators","type":"function","stateMutability":"view","inputs":[{"name":"","type":"uint16"}],"outputs":[{"name":"","type":"address"}]},
+	{"name":"latestRound","type":"function","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint256"}]}
+]`
+
+var aggregator = mustABI(aggregatorABI)
+
+const (
+	// Answer older than this at moment of event is stale; feeds are updated at least daily on deviation or heartbeat
+	maxRoundAge = 25 * time.Hour
+	// Round id of proxy is phase id shifted by this many bits with round id of phase aggregator
+	phaseOffset = 64
+)
+
+// Round of Chainlink feed
+type round struct {
+	id        *big.Int
+	answer    *big.Int
+	updatedAt time.Time
+}
+
+func parseRound(outputs []any) round {
+	return round{
+		id:        outputs[0].(*big.Int),
+		answer:    outputs[1].(*big.Int),
+		updatedAt: time.Unix(outputs[3].(*big.Int).Int64(), 0),
+	}
+}
+
+// Answer of Chainlink feed of token at block of event. Nodes without state of the block are served by round history:
+// the last round updated before the event is searched among rounds of feed read at the latest block.
+// Feed answering in another token, e.g. ETH, is multiplied by USD price of that token
+type ChainlinkOracle struct {
+	client      *web3client.MultiURLClient
+	lookup      TokenLookup
+	counterpart CounterpartPrice
+	// decimals of feeds never change, so they are read once
+	mu       sync.Mutex
+	decimals map[common.Address]uint8
+}
+
+func NewChainlinkOracle(client *web3client.MultiURLClient, lookup TokenLookup, counterpart CounterpartPrice) *ChainlinkOracle {
+	return &ChainlinkOracle{
+		client:      client,
+		lookup:      lookup,
+		counterpart: counterpart,
+		decimals:    make(map[common.Address]uint8),
+	}
+}
+
+func (o *ChainlinkOracle) Source() string { return SourceChainlink }
+
+// Tokens without feed are not supported, their prices are not looked up in cache
+func (o *ChainlinkOracle) CacheKey(token trade.Token, at Moment) string {
+	if token.ChainlinkFeed == "" {
+		return ""
+	}
+	return fmt.Sprintf("quote:%s:%s:%s:%d", SourceChainlink, token.ChainId, strings.ToLower(token.ChainlinkFeed), at.Block)
+}
+
+func (o *ChainlinkOracle) Price(ctx context.Context, token trade.Token, at Moment) (*big.Rat, error) {
+	if token.ChainlinkFeed == "" {
+		return nil, ErrNotSupported
+	}
+	feed := common.HexToAddress(token.ChainlinkFeed)
+	answer, err := o.Answer(ctx, feed, at)
+	if err != nil {
+		return nil, err
+	}
+	if token.ChainlinkDenomination == "" {
+		return answer, nil
+	}
+	denomination, err := o.lookup(ctx, token.ChainId, common.HexToAddress(token.ChainlinkDenomination))
+	if err != nil {
+		return nil, fmt.Errorf("Denomination %s of feed %s is unknown: %w", token.ChainlinkDenomination, feed.Hex(), err)
+	}
+	if denomination.ChainlinkDenomination != "" {
+		return nil, fmt.Errorf("Denomination %s of feed %s is denominated itself, feeds are chained at most once", denomination.Symbol, feed.Hex())
+	}
+	denominationPrice, err := o.counterpart(ctx, denomination, at)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot price denomination %s of feed %s: %w", denomination.Symbol, feed.Hex(), err)
+	}
+	return answer.Mul(answer, denominationPrice), nil
+}
+
+// Answer of feed at moment scaled by its decimals
+func (o *ChainlinkOracle) Answer(ctx context.Context, feed common.Address, at Moment) (*big.Rat, error) {
+	decimals, err := o.feedDecimals(ctx, feed)
+	if err != nil {
+		return nil, err
+	}
+	var result round
+	var blockErr error
+	if at.Block > 0 {
+		var outputs []any
+		outputs, blockErr = call(ctx, o.client, aggregator, feed, at.Block, "latestRoundData")
+		if blockErr == nil {
+			result = parseRound(outputs)
+		}
+	}
+	if at.Block == 0 || blockErr != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		result, err = o.RoundAt(ctx, feed, at.Time)
+		if err != nil {
+			return nil, errors.Join(blockErr, err)
+		}
+	}
+	if result.answer.Sign() <= 0 {
+		return nil, fmt.Errorf("Chainlink feed %s answered %s in round %s", feed.Hex(), result.answer.String(), result.id.String())
+	}
+	if !at.Time.IsZero() && at.Time.Sub(result.updatedAt) > maxRoundAge {
+		return nil, fmt.Errorf("Chainlink feed %s round %s updated at %s is stale at %s", feed.Hex(), result.id.String(), result.updatedAt, at.Time)
+	}
+	return new(big.Rat).SetFrac(result.answer, pow10(big.NewInt(int64(decimals)))), nil
+}
+
+// Last round of feed updated not after instant, searched in round history read at the latest block.
+// Proxy feeds are searched phase by phase from the current one back
+func (o *ChainlinkOracle) RoundAt(ctx context.Context, feed common.Address, instant time.Time) (round, error) {
+	if instant.IsZero() {
+		return round{}, fmt.Errorf("Neither block nor time of event is known")
+	}
+	outputs, err := call(ctx, o.client, aggregator, feed, 0, "latestRoundData")
+	if err != nil {
+		return round{}, err
+	}
+	latest := parseRound(outputs)
+	phase := new(big.Int).Rsh(latest.id, phaseOffset).Uint64()
+	last := new(big.Int).Sub(latest.id, new(big.Int).Lsh(new(big.Int).SetUint64(phase), phaseOffset)).Uint64()
+	for {
+		found, ok, err := o.searchPhase(ctx, feed, phase, last, instant)
+		if err != nil {
+			return round{}, err
+		}
+		if ok {
+			return found, nil
+		}
+		if phase <= 1 {
+			break
+		}
+		phase--
+		outputs, err := call(ctx, o.client, aggregator, feed, 0, "phaseAggregators", uint16(phase))
+		if err != nil {
+			return round{}, err
+		}
+		phaseAggregator := outputs[0].(common.Address)
+		if phaseAggregator == (common.Address{}) {
+			break
+		}
+		outputs, err = call(ctx, o.client, aggregator, phaseAggregator, 0, "latestRound")
+		if err != nil {
+			return round{}, err
+		}
+		last = outputs[0].(*big.Int).Uint64()
+	}
+	return round{}, fmt.Errorf("No round of Chainlink feed %s before %s", feed.Hex(), instant)
+}
+
+// Binary search of the last round of phase updated not after instant among rounds 1 to last
+func (o *ChainlinkOracle) searchPhase(ctx context.Context, feed common.Address, phase uint64, last uint64, instant time.Time) (round, bool, error) {
+	roundAt := func(number uint64) (round, error) {
+		id := new(big.Int).Or(new(big.Int).Lsh(new(big.Int).SetUint64(phase), phaseOffset), new(big.Int).SetUint64(number))
+		outputs, err := call(ctx, o.client, aggregator, feed, 0, "getRoundData", id)
+		if err != nil {
+			return round{}, err
+		}
+		return parseRound(outputs), nil
+	}
+	if last == 0 {
+		return round{}, false, nil
+	}
+	first, err := roundAt(1)
+	if err != nil {
+		return round{}, false, err
+	}
+	if first.updatedAt.After(instant) {
+		return round{}, false, nil
+	}
+	// found is always the round low points to
+	low, high, found := uint64(1), last, first
+	for low < high {
+		middle := low + (high-low+1)/2
+		candidate, err := roundAt(middle)
+		if err != nil {
+			return round{}, false, err
+		}
+		if candidate.updatedAt.After(instant) {
+			high = middle - 1
+		} else {
+			low, found = middle, candidate
+		}
+	}
+	return found, true, nil
+}
+
+func (o *ChainlinkOracle) feedDecimals(ctx context.Context, feed common.Address) (uint8, error) {
+	o.mu.Lock()
+	decimals, ok := o.decimals[feed]
+	o.mu.Unlock()
+	if ok {
+		return decimals, nil
+	}
+	outputs, err := call(ctx, o.client, aggregator, feed, 0, "decimals")
+	if err != nil {
+		return 0, err
+	}
+	decimals = outputs[0].(uint8)
+	o.mu.Lock()
+	o.decimals[feed] = decimals
+	o.mu.Unlock()
+	return decimals, nil
+}
+
+func mustABI(definition string) abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(definition))
+	if err != nil {
+		panic("Malformed ABI " + err.Error())
+	}
+	return parsed
+}
+
+// Calls view method of contract at block and unpacks its outputs, zero block means the latest one
+func call(ctx context.Context, client *web3client.MultiURLClient, contract abi.ABI, address common.Address, block uint64, method string, args ...any) ([]any, error) {
+	data, err := contract.Pack(method, args...)
+	if err != nil {
+		return nil, err
+	}
+	var blockNumber *big.Int
+	if block > 0 {
+		blockNumber = new(big.Int).SetUint64(block)
+	}
+	result, err := client.CallContract(ctx, ethereum.CallMsg{To: &address, Data: data}, blockNumber)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot call %s of %s at block %d: %w", method, address.Hex(), block, err)
+	}
+	return contract.Unpack(method, result)
+}
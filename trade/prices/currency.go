@@ -0,0 +1,32 @@
+package prices
+
+import (
+	"strings"
+
+	"github.com/stryukovsky/go-backend-learn/trade"
+)
+
+// Currencies values are reported in, with decimals balances in them are rounded to.
+// Values are priced in USD, other currencies are converted at their USD price at time of event
+var Currencies = map[string]int{
+	USD:   2,
+	"EUR": 2,
+	"ETH": 8,
+	"BTC": 8,
+}
+
+// Known currency of symbol in any case
+func ParseCurrency(symbol string) (string, bool) {
+	currency := strings.ToUpper(symbol)
+	_, ok := Currencies[currency]
+	return currency, ok
+}
+
+// Currency priced by providers as token traded under its symbol, e.g. EURUSDT at Binance or static EUR rows
+func CurrencyToken(currency string) trade.Token {
+	token := trade.Token{Symbol: currency}
+	if currency == USD {
+		token.PricePeg = USD
+	}
+	return token
+}
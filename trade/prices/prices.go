@@ -0,0 +1,135 @@
+package prices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/stryukovsky/go-backend-learn/trade"
+)
+
+// Names of price providers, recorded as price source of priced rows and listed in Token.PriceSources
+const (
+	SourceBinance   = "binance"
+	SourceChainlink = "chainlink"
+	SourceUniswapV3 = "uniswapv3"
+	SourceStatic    = "static"
+	// Token pegged to USD by configuration
+	SourcePeg = "peg"
+)
+
+// Currency of prices; tokens pegged to it are priced as 1 without asking providers
+const USD = "USD"
+
+// Provider has nothing configured to price the token, so the next provider is asked without logging a failure
+var ErrNotSupported = errors.New("Price provider does not support token")
+
+// Moment of event to price: on-chain providers read state at block, off-chain ones take time
+type Moment struct {
+	Time  time.Time
+	Block uint64
+}
+
+func At(timestamp time.Time, block uint64) Moment {
+	return Moment{Time: timestamp, Block: block}
+}
+
+// Provider of USD price of token at moment of event
+type PriceOracle interface {
+	Source() string
+	// Key of price in cache, moments sharing key share the price; empty key means price is not cached
+	CacheKey(token trade.Token, at Moment) string
+	Price(ctx context.Context, token trade.Token, at Moment) (*big.Rat, error)
+}
+
+// Token to price at moment of event, one of a batch priced at once
+type Request struct {
+	Token trade.Token
+	At    Moment
+}
+
+// Candle of market symbol at provider, prices of candle providers are closes of their candles
+type Candle struct {
+	Symbol string
+	Start  time.Time
+	Open   *big.Rat
+	High   *big.Rat
+	Low    *big.Rat
+	Close  *big.Rat
+}
+
+// Provider whose prices are closes of candles, so they are archived in database as candles and survive loss of cache
+type CandleOracle interface {
+	PriceOracle
+	// Market symbol and start of candle whose close is price of token at moment
+	CandleOf(token trade.Token, at Moment) (string, time.Time)
+	Candle(ctx context.Context, token trade.Token, at Moment) (Candle, error)
+}
+
+// Provider able to fetch candles of many moments with few requests, e.g. by pages of klines.
+// Candles are keyed by CacheKey of their requests; requests it cannot serve are left out
+type BulkOracle interface {
+	CandleOracle
+	Candles(ctx context.Context, requests []Request) (map[string]Candle, error)
+}
+
+// Symbol token is traded under at provider: pair override of provider, then underlying asset, then peg, then symbol of token
+func MarketSymbol(token trade.Token, source string) string {
+	if pair := token.PricePairs[source]; pair != "" {
+		return pair
+	}
+	if token.PriceAsset != "" {
+		return token.PriceAsset
+	}
+	if token.PricePeg != "" {
+		return token.PricePeg
+	}
+	return token.Symbol
+}
+
+// Token pegged to currency of prices is worth exactly 1 of it
+func Pegged(token trade.Token) bool {
+	return strings.EqualFold(token.PricePeg, USD)
+}
+
+// Price with provider which produced it
+type Quote struct {
+	Price  *big.Rat
+	Source string
+}
+
+// Providers in default order. Token may pick and reorder them by listing their sources in Token.PriceSources
+type Chain []PriceOracle
+
+// Providers asked for price of token in order. Sources of token missing in chain are skipped
+func (c Chain) For(token trade.Token) ([]PriceOracle, error) {
+	if len(token.PriceSources) == 0 {
+		return c, nil
+	}
+	result := make([]PriceOracle, 0, len(token.PriceSources))
+	for _, source := range token.PriceSources {
+		for _, oracle := range c {
+			if oracle.Source() == source {
+				result = append(result, oracle)
+			}
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("No price source of %v can price token %s", token.PriceSources, token.Symbol)
+	}
+	return result, nil
+}
+
+// Chain without given provider, used to price counterparts of derived prices without going in circles
+func (c Chain) Without(source string) Chain {
+	result := make(Chain, 0, len(c))
+	for _, oracle := range c {
+		if oracle.Source() != source {
+			result = append(result, oracle)
+		}
+	}
+	return result
+}
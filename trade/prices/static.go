@@ -0,0 +1,136 @@
+package prices
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stryukovsky/go-backend-learn/trade"
+)
+
+// Price of market symbol or address of token from time on, until the next row of the same symbol
+type StaticPrice struct {
+	Symbol string `json:"symbol"`
+	Time   string `json:"time"`
+	Price  string `json:"price"`
+}
+
+type staticRow struct {
+	from  time.Time
+	price *big.Rat
+}
+
+// Prices from CSV or JSON file, e.g. for pegged assets or tokens without market
+type StaticOracle struct {
+	mu   sync.RWMutex
+	rows map[string][]staticRow
+}
+
+func NewStaticOracle() *StaticOracle {
+	return &StaticOracle{rows: make(map[string][]staticRow)}
+}
+
+// Static prices of process, loaded once from file given on start
+var Static = NewStaticOracle()
+
+func (o *StaticOracle) Source() string { return SourceStatic }
+
+// Static prices are in memory already
+func (o *StaticOracle) CacheKey(token trade.Token, at Moment) string { return "" }
+
+func (o *StaticOracle) Price(ctx context.Context, token trade.Token, at Moment) (*big.Rat, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	rows, ok := o.rows[strings.ToLower(token.Address)]
+	if !ok {
+		rows, ok = o.rows[strings.ToUpper(MarketSymbol(token, SourceStatic))]
+	}
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	i := sort.Search(len(rows), func(i int) bool { return rows[i].from.After(at.Time) })
+	if i == 0 {
+		return nil, fmt.Errorf("No static price of %s before %s", token.Symbol, rows[0].from.Format(time.RFC3339))
+	}
+	return new(big.Rat).Set(rows[i-1].price), nil
+}
+
+// Replaces prices with ones of CSV file with symbol,time,price header or JSON array of StaticPrice.
+// Time is RFC 3339, date or unix seconds; symbol may be token address instead
+func (o *StaticOracle) Load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var prices []StaticPrice
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.NewDecoder(file).Decode(&prices)
+	} else {
+		prices, err = readStaticCSV(file)
+	}
+	if err != nil {
+		return fmt.Errorf("Malformed static prices %s: %w", path, err)
+	}
+	rows := make(map[string][]staticRow)
+	for _, price := range prices {
+		from, err := parseStaticTime(price.Time)
+		if err != nil {
+			return fmt.Errorf("Malformed time %s of %s: %w", price.Time, price.Symbol, err)
+		}
+		value, ok := new(big.Rat).SetString(price.Price)
+		if !ok {
+			return fmt.Errorf("Malformed price %s of %s", price.Price, price.Symbol)
+		}
+		key := strings.ToUpper(price.Symbol)
+		if strings.HasPrefix(price.Symbol, "0x") {
+			key = strings.ToLower(price.Symbol)
+		}
+		rows[key] = append(rows[key], staticRow{from: from, price: value})
+	}
+	for _, symbolRows := range rows {
+		sort.Slice(symbolRows, func(i, j int) bool { return symbolRows[i].from.Before(symbolRows[j].from) })
+	}
+	o.mu.Lock()
+	o.rows = rows
+	o.mu.Unlock()
+	return nil
+}
+
+func readStaticCSV(reader io.Reader) ([]StaticPrice, error) {
+	records, err := csv.NewReader(reader).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	prices := make([]StaticPrice, 0, len(records))
+	for i, record := range records {
+		if len(record) != 3 {
+			return nil, fmt.Errorf("Line %d has %d fields, expected symbol,time,price", i+1, len(record))
+		}
+		if i == 0 && strings.EqualFold(record[0], "symbol") {
+			continue
+		}
+		prices = append(prices, StaticPrice{Symbol: record[0], Time: record[1], Price: record[2]})
+	}
+	return prices, nil
+}
+
+func parseStaticTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	if date, err := time.Parse(time.DateOnly, value); err == nil {
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,136 @@
+package prices
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/web3client"
+)
+
+const poolABI = `[
+	{"name":"token0","type":"function","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"address"}]},
+	{"name":"token1","type":"function","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"address"}]},
+	{"name":"slot0","type":"function","stateMutability":"view","inputs":[],"outputs":[
+		{"name":"sqrtPriceX96","type":"uint160"},
+		{"name":"tick","type":"int24"},
+		{"name":"observationIndex","type":"uint16"},
+		{"name":"observationCardinality","type":"uint16"},
+		{"name":"observationCardinalityNext","type":"uint16"},
+		{"name":"feeProtocol","type":"uint8"},
+		{"name":"unlocked","type":"bool"}
+	]}
+]`
+
+var pool = mustABI(poolABI)
+
+// Token known to database by chain and address
+type TokenLookup func(ctx context.Context, chainId string, address common.Address) (trade.Token, error)
+
+// USD price of token from providers other than the derived one
+type CounterpartPrice func(ctx context.Context, token trade.Token, at Moment) (*big.Rat, error)
+
+// Price of token in its Uniswap V3 pool at block of event, multiplied by USD price of the other token of pool
+type UniswapV3Oracle struct {
+	client      *web3client.MultiURLClient
+	lookup      TokenLookup
+	counterpart CounterpartPrice
+	// tokens of pools never change, so they are read once
+	mu     sync.Mutex
+	tokens map[common.Address][2]common.Address
+}
+
+func NewUniswapV3Oracle(client *web3client.MultiURLClient, lookup TokenLookup, counterpart CounterpartPrice) *UniswapV3Oracle {
+	return &UniswapV3Oracle{
+		client:      client,
+		lookup:      lookup,
+		counterpart: counterpart,
+		tokens:      make(map[common.Address][2]common.Address),
+	}
+}
+
+func (o *UniswapV3Oracle) Source() string { return SourceUniswapV3 }
+
+func (o *UniswapV3Oracle) CacheKey(token trade.Token, at Moment) string {
+	return fmt.Sprintf("quote:%s:%s:%s:%s:%d", SourceUniswapV3, token.ChainId, strings.ToLower(token.PricePool), strings.ToLower(token.Address), at.Block)
+}
+
+func (o *UniswapV3Oracle) Price(ctx context.Context, token trade.Token, at Moment) (*big.Rat, error) {
+	if token.PricePool == "" {
+		return nil, ErrNotSupported
+	}
+	poolAddress := common.HexToAddress(token.PricePool)
+	tokens, err := o.poolTokens(ctx, poolAddress)
+	if err != nil {
+		return nil, err
+	}
+	tokenAddress := common.HexToAddress(token.Address)
+	var other common.Address
+	switch tokenAddress {
+	case tokens[0]:
+		other = tokens[1]
+	case tokens[1]:
+		other = tokens[0]
+	default:
+		return nil, fmt.Errorf("Pool %s does not trade token %s", poolAddress.Hex(), token.Symbol)
+	}
+	otherToken, err := o.lookup(ctx, token.ChainId, other)
+	if err != nil {
+		return nil, fmt.Errorf("Other token %s of pool %s is unknown: %w", other.Hex(), poolAddress.Hex(), err)
+	}
+	otherPrice, err := o.counterpart(ctx, otherToken, at)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot price other token %s of pool %s: %w", otherToken.Symbol, poolAddress.Hex(), err)
+	}
+
+	outputs, err := call(ctx, o.client, pool, poolAddress, at.Block, "slot0")
+	if err != nil {
+		return nil, err
+	}
+	sqrtPriceX96 := outputs[0].(*big.Int)
+	if sqrtPriceX96.Sign() == 0 {
+		return nil, fmt.Errorf("Pool %s is not initialized at block %d", poolAddress.Hex(), at.Block)
+	}
+	// amount of token1 per token0 in raw units is sqrtPriceX96^2 / 2^192
+	rawPrice := new(big.Rat).SetFrac(
+		new(big.Int).Mul(sqrtPriceX96, sqrtPriceX96),
+		new(big.Int).Lsh(big.NewInt(1), 192),
+	)
+	decimals0, decimals1 := token.Decimals.Int, otherToken.Decimals.Int
+	if tokenAddress == tokens[1] {
+		decimals0, decimals1 = otherToken.Decimals.Int, token.Decimals.Int
+	}
+	price0In1 := rawPrice.Mul(rawPrice, new(big.Rat).SetFrac(pow10(decimals0), pow10(decimals1)))
+	if tokenAddress == tokens[0] {
+		return price0In1.Mul(price0In1, otherPrice), nil
+	}
+	return new(big.Rat).Quo(otherPrice, price0In1), nil
+}
+
+func (o *UniswapV3Oracle) poolTokens(ctx context.Context, poolAddress common.Address) ([2]common.Address, error) {
+	o.mu.Lock()
+	tokens, ok := o.tokens[poolAddress]
+	o.mu.Unlock()
+	if ok {
+		return tokens, nil
+	}
+	for i, method := range []string{"token0", "token1"} {
+		outputs, err := call(ctx, o.client, pool, poolAddress, 0, method)
+		if err != nil {
+			return tokens, err
+		}
+		tokens[i] = outputs[0].(common.Address)
+	}
+	o.mu.Lock()
+	o.tokens[poolAddress] = tokens
+	o.mu.Unlock()
+	return tokens, nil
+}
+
+func pow10(exponent *big.Int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), exponent, nil)
+}
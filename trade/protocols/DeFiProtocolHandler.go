@@ -1,12 +1,56 @@
 package protocols
 
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/prices"
+	"gorm.io/gorm"
+)
+
 type DeFiProtocolHandler[BlockchainInteraction any, FinanceInteraction any] interface {
 	FetchBlockchainInteractions(
+		ctx context.Context,
 		chainId string,
 		participants []string,
 		fromBlock uint64,
 		toBlock uint64,
 	) ([]BlockchainInteraction, error)
-	PopulateWithFinanceInfo(interactions []BlockchainInteraction) ([]FinanceInteraction, error)
+	PopulateWithFinanceInfo(ctx context.Context, interactions []BlockchainInteraction) ([]FinanceInteraction, error)
+	// Narrows query of stored events to the ones emitted by contracts of handler, since handlers of a protocol share table
+	OwnEvents(query *gorm.DB) *gorm.DB
+	// Unique key of handler on chain, e.g. for progress of handler; pools of the same tokens share name but not key
+	Key() string
+	// Display name of handler for logs and metrics
 	Name() string
 }
+
+// Block timestamps and token prices handlers parse and price events with, cache.CacheManager in production
+type Cache interface {
+	GetCachedBlockTimestamps(ctx context.Context, blocks []uint64) (trade.BlockTimestamps, error)
+	GetCachedTokenPrice(ctx context.Context, token trade.Token, at prices.Moment) (*prices.Quote, error)
+}
+
+// Protocol of token transfers handlers, other protocols are named by their platform types
+const ERC20 = "ERC20"
+
+// Key of handler of protocol contract
+func HandlerKey(protocol string, contract common.Address) string {
+	return fmt.Sprintf("%s:%s", protocol, contract.Hex())
+}
+
+// Handler which is able to decode logs pushed by eth_subscribe instead of fetching them with eth_getLogs
+type LogsSubscriber[BlockchainInteraction any] interface {
+	// Contracts whose logs are needed by handler
+	LogsAddresses() []common.Address
+	// Decodes logs of handler contracts, logs of other contracts and events are skipped
+	ParseLogs(ctx context.Context, chainId string, participants []string, logs []types.Log) ([]BlockchainInteraction, error)
+}
+
+// Handler which tells tokens and moments it prices, so prices of a batch are fetched at once before it is priced
+type PriceRequester[BlockchainInteraction any] interface {
+	PriceRequests(interactions []BlockchainInteraction) []prices.Request
+}
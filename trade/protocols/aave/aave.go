@@ -1,10 +1,12 @@
 package aave
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/stryukovsky/go-backend-learn/trade"
 	"github.com/stryukovsky/go-backend-learn/trade/web3client"
 )
@@ -37,31 +39,75 @@ type MultiURLAaveFilterer struct {
 }
 
 func (m *MultiURLAaveFilterer) FilterSupply(
-	opts *bind.FilterOpts,
+	ctx context.Context,
+	fromBlock uint64,
+	toBlock uint64,
 	reserve []common.Address,
 	onBehalfOf []common.Address,
 	referralCode []uint16,
-) (*PoolSupplyIterator, error) {
-	return trade.RetryEthCall(
+) ([]PoolSupply, error) {
+	return web3client.RetryEthCall(
+		ctx,
+		"eth_getLogs",
 		func() []*AaveFiltererWithURL { return m.filterers },
-		func(filterer *AaveFiltererWithURL) (*PoolSupplyIterator, error) {
-			return filterer.filterer.FilterSupply(opts, reserve, onBehalfOf, referralCode)
+		func(f *AaveFiltererWithURL) ([]PoolSupply, error) {
+			return trade.FilterLogsAdaptive(f.url, fromBlock, toBlock, func(fromBlock uint64, toBlock uint64) ([]PoolSupply, error) {
+				iter, err := f.filterer.FilterSupply(&bind.FilterOpts{Start: fromBlock, End: &toBlock, Context: ctx}, reserve, onBehalfOf, referralCode)
+				if err != nil {
+					return nil, err
+				}
+				defer iter.Close()
+				events := make([]PoolSupply, 0)
+				for iter.Next() {
+					events = append(events, *iter.Event)
+				}
+				return events, iter.Error()
+			})
 		})
 }
 
 func (m *MultiURLAaveFilterer) FilterWithdraw(
-	opts *bind.FilterOpts,
+	ctx context.Context,
+	fromBlock uint64,
+	toBlock uint64,
 	reserve []common.Address,
 	to []common.Address,
 	repayFromAToken []common.Address,
-) (*PoolWithdrawIterator, error) {
-	return trade.RetryEthCall(
+) ([]PoolWithdraw, error) {
+	return web3client.RetryEthCall(
+		ctx,
+		"eth_getLogs",
 		func() []*AaveFiltererWithURL { return m.filterers },
-		func(filterer *AaveFiltererWithURL) (*PoolWithdrawIterator, error) {
-			return filterer.filterer.FilterWithdraw(opts, reserve, to, repayFromAToken)
+		func(f *AaveFiltererWithURL) ([]PoolWithdraw, error) {
+			return trade.FilterLogsAdaptive(f.url, fromBlock, toBlock, func(fromBlock uint64, toBlock uint64) ([]PoolWithdraw, error) {
+				iter, err := f.filterer.FilterWithdraw(&bind.FilterOpts{Start: fromBlock, End: &toBlock, Context: ctx}, reserve, to, repayFromAToken)
+				if err != nil {
+					return nil, err
+				}
+				defer iter.Close()
+				events := make([]PoolWithdraw, 0)
+				for iter.Next() {
+					events = append(events, *iter.Event)
+				}
+				return events, iter.Error()
+			})
 		})
 }
 
+var (
+	supplyTopic   = trade.EventTopic(PoolMetaData, "Supply")
+	withdrawTopic = trade.EventTopic(PoolMetaData, "Withdraw")
+)
+
+// Decoding of log needs no JSON RPC, so any filterer fits
+func (m *MultiURLAaveFilterer) ParseSupply(log types.Log) (*PoolSupply, error) {
+	return m.filterers[0].filterer.ParseSupply(log)
+}
+
+func (m *MultiURLAaveFilterer) ParseWithdraw(log types.Log) (*PoolWithdraw, error) {
+	return m.filterers[0].filterer.ParseWithdraw(log)
+}
+
 // --- Main AavePool struct using multi-url clients ---
 
 type AavePool struct {
@@ -1,22 +1,24 @@
 package aave
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"math/big"
 	"strings"
 
-	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/stryukovsky/go-backend-learn/trade"
-	"github.com/stryukovsky/go-backend-learn/trade/cache"
+	"github.com/stryukovsky/go-backend-learn/trade/prices"
+	"github.com/stryukovsky/go-backend-learn/trade/protocols"
 	"github.com/stryukovsky/go-backend-learn/trade/web3client"
 	"gorm.io/gorm"
 )
 
 type AaveHandler struct {
 	pool           AavePool
-	cm             *cache.CacheManager
+	cm             protocols.Cache
 	db             *gorm.DB
 	name           string
 	tokens         []trade.Token
@@ -28,7 +30,7 @@ func (h *AaveHandler) ParallelFactor() int { return h.parallelFactor }
 func NewAaveHandler(
 	instance trade.DeFiPlatform,
 	client *web3client.MultiURLClient,
-	rdb *cache.CacheManager,
+	rdb protocols.Cache,
 	tokens []trade.Token,
 	parallelFactor int,
 ) (*AaveHandler, error) {
@@ -45,8 +47,13 @@ func NewAaveHandler(
 	}, nil
 }
 
-func (h *AaveHandler) parseAaveEvents(chainId string, events []any) ([]trade.AaveEvent, error) {
-	return trade.ParseEVMEvents(h.ParallelFactor(),
+func (h *AaveHandler) parseAaveEvents(ctx context.Context, chainId string, events []any) ([]trade.AaveEvent, error) {
+	timestamps, err := h.cm.GetCachedBlockTimestamps(ctx, trade.BlockNumbers(events))
+	if err != nil {
+		return nil, err
+	}
+	return trade.ParseEVMEvents(ctx,
+		h.ParallelFactor(),
 		h.Name(),
 		chainId,
 		events,
@@ -58,13 +65,14 @@ func (h *AaveHandler) parseAaveEvents(chainId string, events []any) ([]trade.Aav
 				return fmt.Errorf("[%s] Unexpected event type %s in chunk of Supply Events", h.Name(), generalEvent)
 			case PoolSupply:
 				var event PoolSupply = generalEvent
-				timestamp, err := h.cm.GetCachedBlockTimestamp(event.Raw.BlockNumber)
+				timestamp, err := timestamps.At(event.Raw.BlockNumber)
 				if err != nil {
 					slog.Warn(fmt.Sprintf("[%s] Failure on parsing Supply event %s", h.Name(), err.Error()))
 					return err
 				}
 				item := trade.NewAaveEvent(
 					chainId,
+					h.pool.Address,
 					"supply",
 					event.OnBehalfOf,
 					event.Reserve,
@@ -72,17 +80,19 @@ func (h *AaveHandler) parseAaveEvents(chainId string, events []any) ([]trade.Aav
 					*timestamp,
 					event.Raw.TxHash.Hex(),
 					event.Raw.Index,
+					event.Raw.BlockNumber,
 				)
 				task.ValuesCh <- item
 			case PoolWithdraw:
 				var event PoolWithdraw = generalEvent
-				timestamp, err := h.cm.GetCachedBlockTimestamp(event.Raw.BlockNumber)
+				timestamp, err := timestamps.At(event.Raw.BlockNumber)
 				if err != nil {
 					slog.Warn(fmt.Sprintf("[%s] Failure on parsing Withdraw event %s", h.Name(), err.Error()))
 					return err
 				}
 				item := trade.NewAaveEvent(
 					chainId,
+					h.pool.Address,
 					"withdraw",
 					event.To,
 					event.Reserve,
@@ -90,6 +100,7 @@ func (h *AaveHandler) parseAaveEvents(chainId string, events []any) ([]trade.Aav
 					*timestamp,
 					event.Raw.TxHash.Hex(),
 					event.Raw.Index,
+					event.Raw.BlockNumber,
 				)
 				task.ValuesCh <- item
 			}
@@ -98,6 +109,7 @@ func (h *AaveHandler) parseAaveEvents(chainId string, events []any) ([]trade.Aav
 }
 
 func (h *AaveHandler) FetchBlockchainInteractions(
+	ctx context.Context,
 	chainId string,
 	participants []string,
 	fromBlock uint64,
@@ -107,8 +119,10 @@ func (h *AaveHandler) FetchBlockchainInteractions(
 	for i, p := range participants {
 		formattedParticipants[i] = common.HexToAddress(p)
 	}
-	supplyEventsIter, err := h.pool.filterer.FilterSupply(
-		&bind.FilterOpts{Start: fromBlock, End: &toBlock},
+	supplyEvents, err := h.pool.filterer.FilterSupply(
+		ctx,
+		fromBlock,
+		toBlock,
 		[]common.Address{},
 		formattedParticipants,
 		[]uint16{},
@@ -116,28 +130,18 @@ func (h *AaveHandler) FetchBlockchainInteractions(
 	if err != nil {
 		return nil, err
 	}
-	defer supplyEventsIter.Close()
-	withdrawEventsIter, err := h.pool.filterer.FilterWithdraw(
-		&bind.FilterOpts{Start: fromBlock, End: &toBlock}, []common.Address{}, []common.Address{}, formattedParticipants)
+	withdrawEvents, err := h.pool.filterer.FilterWithdraw(ctx, fromBlock, toBlock, []common.Address{}, []common.Address{}, formattedParticipants)
 	if err != nil {
 		return nil, err
 	}
-	defer withdrawEventsIter.Close()
 
 	// any is because go do not support generic methods, we have two types for each event: Supply and Withdraw
-	eventsRaw := make([]any, 0)
-	for supplyEventsIter.Next() {
-		if err = supplyEventsIter.Error(); err != nil {
-			return nil, err
-		}
-		eventsRaw = append(eventsRaw, *supplyEventsIter.Event)
+	eventsRaw := make([]any, 0, len(supplyEvents)+len(withdrawEvents))
+	for _, event := range supplyEvents {
+		eventsRaw = append(eventsRaw, event)
 	}
-	for withdrawEventsIter.Next() {
-		err := withdrawEventsIter.Error()
-		if err != nil {
-			return nil, err
-		}
-		eventsRaw = append(eventsRaw, *withdrawEventsIter.Event)
+	for _, event := range withdrawEvents {
+		eventsRaw = append(eventsRaw, event)
 	}
 	if len(eventsRaw) == 0 {
 		slog.Info(fmt.Sprintf("[%s] no events in block range %d - %d", h.Name(), fromBlock, toBlock))
@@ -145,33 +149,84 @@ func (h *AaveHandler) FetchBlockchainInteractions(
 	} else {
 		slog.Info(fmt.Sprintf("[%s] found %d events in block range %d - %d", h.Name(), len(eventsRaw), fromBlock, toBlock))
 	}
-	events, err := h.parseAaveEvents(chainId, eventsRaw)
+	events, err := h.parseAaveEvents(ctx, chainId, eventsRaw)
 	if err != nil {
 		return nil, err
 	}
 	return events, nil
 }
 
-func (h *AaveHandler) PopulateWithFinanceInfo(interactions []trade.AaveEvent) ([]trade.AaveInteraction, error) {
-	result := make([]trade.AaveInteraction, 0, len(interactions))
-	for _, interaction := range interactions {
-		tokenAddress := common.HexToAddress(interaction.TokenAddress)
-		token := trade.Token{}
-		for _, t := range h.tokens {
-			if strings.EqualFold(t.Address, tokenAddress.Hex()) {
-				token = t
+func (h *AaveHandler) LogsAddresses() []common.Address { return []common.Address{h.pool.Address} }
+
+func (h *AaveHandler) ParseLogs(ctx context.Context, chainId string, participants []string, logs []types.Log) ([]trade.AaveEvent, error) {
+	tracked := trade.AddressSet(participants)
+	eventsRaw := make([]any, 0)
+	for _, log := range logs {
+		if log.Address != h.pool.Address || len(log.Topics) == 0 {
+			continue
+		}
+		switch log.Topics[0] {
+		case supplyTopic:
+			event, err := h.pool.filterer.ParseSupply(log)
+			if err != nil {
+				return nil, err
+			}
+			if tracked[event.OnBehalfOf] {
+				eventsRaw = append(eventsRaw, *event)
+			}
+		case withdrawTopic:
+			event, err := h.pool.filterer.ParseWithdraw(log)
+			if err != nil {
+				return nil, err
+			}
+			if tracked[event.To] {
+				eventsRaw = append(eventsRaw, *event)
 			}
 		}
+	}
+	if len(eventsRaw) == 0 {
+		return make([]trade.AaveEvent, 0), nil
+	}
+	return h.parseAaveEvents(ctx, chainId, eventsRaw)
+}
+
+// Known token of handler with address, events of other tokens are skipped on pricing
+func (h *AaveHandler) tokenOf(address common.Address) (trade.Token, bool) {
+	for _, token := range h.tokens {
+		if strings.EqualFold(token.Address, address.Hex()) {
+			return token, true
+		}
+	}
+	return trade.Token{}, false
+}
 
-		if len(token.Address) == 0 {
+// Tokens and moments priced by PopulateWithFinanceInfo, so their prices are fetched for whole batch at once
+func (h *AaveHandler) PriceRequests(interactions []trade.AaveEvent) []prices.Request {
+	result := make([]prices.Request, 0, len(interactions))
+	for _, interaction := range interactions {
+		token, ok := h.tokenOf(common.HexToAddress(interaction.TokenAddress))
+		if ok {
+			result = append(result, prices.Request{Token: token, At: prices.At(interaction.Timestamp, interaction.BlockNumber)})
+		}
+	}
+	return result
+}
+
+func (h *AaveHandler) PopulateWithFinanceInfo(ctx context.Context, interactions []trade.AaveEvent) ([]trade.AaveInteraction, error) {
+	result := make([]trade.AaveInteraction, 0, len(interactions))
+	for _, interaction := range interactions {
+		tokenAddress := common.HexToAddress(interaction.TokenAddress)
+		token, ok := h.tokenOf(tokenAddress)
+		if !ok {
 			slog.Warn(fmt.Sprintf("Found aave interaction with unknown token address %s", tokenAddress))
 			continue
 		}
 
-		closePrice, err := h.cm.GetCachedSymbolPriceAtTime(token.Symbol, &interaction.Timestamp)
+		quote, err := h.cm.GetCachedTokenPrice(ctx, token, prices.At(interaction.Timestamp, interaction.BlockNumber))
 		if err != nil {
 			return nil, err
 		}
+		closePrice := quote.Price
 
 		volumeToken := big.NewRat(1, 1)
 		decimalsMultiplier := new(big.Int).Exp(big.NewInt(10), token.Decimals.Int, nil)
@@ -180,6 +235,7 @@ func (h *AaveHandler) PopulateWithFinanceInfo(interactions []trade.AaveEvent) ([
 		volumeUSD := new(big.Rat).Mul(volumeToken, closePrice)
 		deal := trade.AaveInteraction{
 			Price:           trade.NewDBNumeric(closePrice),
+			PriceSource:     quote.Source,
 			VolumeTokens:    trade.NewDBNumeric(volumeToken),
 			VolumeUSD:       trade.NewDBNumeric(volumeUSD),
 			BlockchainEvent: interaction,
@@ -188,4 +244,10 @@ func (h *AaveHandler) PopulateWithFinanceInfo(interactions []trade.AaveEvent) ([
 	}
 	return result, nil
 }
+func (h *AaveHandler) OwnEvents(query *gorm.DB) *gorm.DB {
+	return query.Where("pool_address = ?", h.pool.Address.Hex())
+}
+
+func (h *AaveHandler) Key() string { return protocols.HandlerKey(trade.Aave, h.pool.Address) }
+
 func (h *AaveHandler) Name() string { return h.name }
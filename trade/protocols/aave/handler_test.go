@@ -0,0 +1,68 @@
+package aave
+
+import (
+	"context"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/replay/replaytest"
+)
+
+// Supplies and withdrawals of every wallet at Aave V3 pool on Arbitrum One
+const (
+	arbitrumChainId   = "42161"
+	arbitrumFromBlock = 250000000
+	arbitrumToBlock   = 250000999
+	arbitrumPool      = "0x794a61358D6845594F94dc1DB02A252b5b4814aD"
+)
+
+var arbitrumTokens = []trade.Token{
+	{ChainId: arbitrumChainId, Symbol: "WETH", Address: "0x82aF49447D8a07e3bd95BD0d56f35241523fBab1", Decimals: trade.NewDBInt(big.NewInt(18))},
+	{ChainId: arbitrumChainId, Symbol: "USDC", Address: "0xaf88d065e77c8cC2239327C5EDb3A432268e5831", Decimals: trade.NewDBInt(big.NewInt(6))},
+	{ChainId: arbitrumChainId, Symbol: "USDT", Address: "0xFd086bC7CD5C481DCC9C85ebE478A1C0b69FCbb9", Decimals: trade.NewDBInt(big.NewInt(6))},
+}
+
+func TestHandlerOnArbitrum(t *testing.T) {
+	dir := filepath.Join("testdata", "arbitrum")
+	client := replaytest.Client(t, dir)
+	cm := replaytest.NewCache(client)
+	instance := trade.DeFiPlatform{ChainId: arbitrumChainId, Address: arbitrumPool, Type: trade.Aave}
+	handler, err := NewAaveHandler(instance, client, cm, arbitrumTokens, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// no participants match every wallet
+	events, err := handler.FetchBlockchainInteractions(ctx, arbitrumChainId, []string{}, arbitrumFromBlock, arbitrumToBlock)
+	if err != nil {
+		t.Fatalf("Cannot fetch events: %s", err.Error())
+	}
+	if len(events) == 0 {
+		t.Fatalf("No events in blocks %d - %d, fixtures should be recorded for range with events of pool", arbitrumFromBlock, arbitrumToBlock)
+	}
+	events = replaytest.Sorted(t, events)
+	for _, event := range events {
+		if event.BlockNumber < arbitrumFromBlock || event.BlockNumber > arbitrumToBlock {
+			t.Errorf("Event %s is in block %d out of fetched range", event.TxId, event.BlockNumber)
+		}
+		if event.PoolAddress != arbitrumPool {
+			t.Errorf("Event %s is of pool %s", event.TxId, event.PoolAddress)
+		}
+		if event.Direction != "supply" && event.Direction != "withdraw" {
+			t.Errorf("Event %s has unexpected direction %s", event.TxId, event.Direction)
+		}
+		if event.Timestamp.IsZero() {
+			t.Errorf("Event %s has no timestamp", event.TxId)
+		}
+	}
+	replaytest.Golden(t, filepath.Join(dir, "events.golden.json"), events)
+
+	interactions, err := handler.PopulateWithFinanceInfo(ctx, events)
+	if err != nil {
+		t.Fatalf("Cannot price events: %s", err.Error())
+	}
+	replaytest.Golden(t, filepath.Join(dir, "interactions.golden.json"), interactions)
+}
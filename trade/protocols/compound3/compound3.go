@@ -1,10 +1,12 @@
 package compound3
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/stryukovsky/go-backend-learn/trade"
 	"github.com/stryukovsky/go-backend-learn/trade/web3client"
 )
@@ -24,7 +26,9 @@ type MultiURLCometCaller struct {
 
 // Helper to get BaseToken from any working provider
 func (m *MultiURLCometCaller) BaseToken(opts *bind.CallOpts) (common.Address, error) {
-	return trade.RetryEthCall(
+	return web3client.RetryEthCall(
+		trade.CallContext(opts),
+		"eth_call",
 		func() []*CometCallerWithURL { return m.callers },
 		func(caller *CometCallerWithURL) (common.Address, error) {
 			return caller.Caller.BaseToken(opts)
@@ -45,55 +49,158 @@ type MultiURLCometFilterer struct {
 }
 
 func (m *MultiURLCometFilterer) FilterSupply(
-	opts *bind.FilterOpts,
+	ctx context.Context,
+	fromBlock uint64,
+	toBlock uint64,
 	from []common.Address,
 	dst []common.Address,
-) (*CometSupplyIterator, error) {
-	return trade.RetryEthCall(
+) ([]CometSupply, error) {
+	return web3client.RetryEthCall(
+		ctx,
+		"eth_getLogs",
 		func() []*CometFiltererWithURL { return m.filterers },
-		func(filterer *CometFiltererWithURL) (*CometSupplyIterator, error) {
-			return filterer.filterer.FilterSupply(opts, from, dst)
+		func(f *CometFiltererWithURL) ([]CometSupply, error) {
+			return trade.FilterLogsAdaptive(f.url, fromBlock, toBlock, func(fromBlock uint64, toBlock uint64) ([]CometSupply, error) {
+				iter, err := f.filterer.FilterSupply(&bind.FilterOpts{Start: fromBlock, End: &toBlock, Context: ctx}, from, dst)
+				if err != nil {
+					return nil, err
+				}
+				defer iter.Close()
+				events := make([]CometSupply, 0)
+				for iter.Next() {
+					events = append(events, *iter.Event)
+				}
+				return events, iter.Error()
+			})
 		})
 }
 
 func (m *MultiURLCometFilterer) FilterSupplyCollateral(
-	opts *bind.FilterOpts,
+	ctx context.Context,
+	fromBlock uint64,
+	toBlock uint64,
 	from []common.Address,
 	dst []common.Address,
 	asset []common.Address,
-) (*CometSupplyCollateralIterator, error) {
-	return trade.RetryEthCall(
+) ([]CometSupplyCollateral, error) {
+	return web3client.RetryEthCall(
+		ctx,
+		"eth_getLogs",
 		func() []*CometFiltererWithURL { return m.filterers },
-		func(filterer *CometFiltererWithURL) (*CometSupplyCollateralIterator, error) {
-			return filterer.filterer.FilterSupplyCollateral(opts, from, dst, asset)
+		func(f *CometFiltererWithURL) ([]CometSupplyCollateral, error) {
+			return trade.FilterLogsAdaptive(f.url, fromBlock, toBlock, func(fromBlock uint64, toBlock uint64) ([]CometSupplyCollateral, error) {
+				iter, err := f.filterer.FilterSupplyCollateral(&bind.FilterOpts{Start: fromBlock, End: &toBlock, Context: ctx}, from, dst, asset)
+				if err != nil {
+					return nil, err
+				}
+				defer iter.Close()
+				events := make([]CometSupplyCollateral, 0)
+				for iter.Next() {
+					events = append(events, *iter.Event)
+				}
+				return events, iter.Error()
+			})
 		})
 }
 
 func (m *MultiURLCometFilterer) FilterWithdraw(
-	opts *bind.FilterOpts,
+	ctx context.Context,
+	fromBlock uint64,
+	toBlock uint64,
 	src []common.Address,
 	to []common.Address,
-) (*CometWithdrawIterator, error) {
-	return trade.RetryEthCall(
+) ([]CometWithdraw, error) {
+	return web3client.RetryEthCall(
+		ctx,
+		"eth_getLogs",
 		func() []*CometFiltererWithURL { return m.filterers },
-		func(filterer *CometFiltererWithURL) (*CometWithdrawIterator, error) {
-			return filterer.filterer.FilterWithdraw(opts, src, to)
+		func(f *CometFiltererWithURL) ([]CometWithdraw, error) {
+			return trade.FilterLogsAdaptive(f.url, fromBlock, toBlock, func(fromBlock uint64, toBlock uint64) ([]CometWithdraw, error) {
+				iter, err := f.filterer.FilterWithdraw(&bind.FilterOpts{Start: fromBlock, End: &toBlock, Context: ctx}, src, to)
+				if err != nil {
+					return nil, err
+				}
+				defer iter.Close()
+				events := make([]CometWithdraw, 0)
+				for iter.Next() {
+					events = append(events, *iter.Event)
+				}
+				return events, iter.Error()
+			})
 		})
 }
 
 func (m *MultiURLCometFilterer) FilterWithdrawCollateral(
-	opts *bind.FilterOpts,
+	ctx context.Context,
+	fromBlock uint64,
+	toBlock uint64,
 	src []common.Address,
 	to []common.Address,
 	asset []common.Address,
-) (*CometWithdrawCollateralIterator, error) {
-	return trade.RetryEthCall(
+) ([]CometWithdrawCollateral, error) {
+	return web3client.RetryEthCall(
+		ctx,
+		"eth_getLogs",
 		func() []*CometFiltererWithURL { return m.filterers },
-		func(filterer *CometFiltererWithURL) (*CometWithdrawCollateralIterator, error) {
-			return filterer.filterer.FilterWithdrawCollateral(opts, src, to, asset)
+		func(f *CometFiltererWithURL) ([]CometWithdrawCollateral, error) {
+			return trade.FilterLogsAdaptive(f.url, fromBlock, toBlock, func(fromBlock uint64, toBlock uint64) ([]CometWithdrawCollateral, error) {
+				iter, err := f.filterer.FilterWithdrawCollateral(&bind.FilterOpts{Start: fromBlock, End: &toBlock, Context: ctx}, src, to, asset)
+				if err != nil {
+					return nil, err
+				}
+				defer iter.Close()
+				events := make([]CometWithdrawCollateral, 0)
+				for iter.Next() {
+					events = append(events, *iter.Event)
+				}
+				return events, iter.Error()
+			})
 		})
 }
 
+var (
+	supplyTopic             = trade.EventTopic(CometMetaData, "Supply")
+	supplyCollateralTopic   = trade.EventTopic(CometMetaData, "SupplyCollateral")
+	withdrawTopic           = trade.EventTopic(CometMetaData, "Withdraw")
+	withdrawCollateralTopic = trade.EventTopic(CometMetaData, "WithdrawCollateral")
+)
+
+// Decodes one of the tracked Comet events; decoding needs no JSON RPC, so any filterer fits.
+// Returns nil event for logs of other events
+func (m *MultiURLCometFilterer) ParseLog(log types.Log) (any, error) {
+	parser := m.filterers[0].filterer
+	if len(log.Topics) == 0 {
+		return nil, nil
+	}
+	switch log.Topics[0] {
+	case supplyTopic:
+		event, err := parser.ParseSupply(log)
+		if err != nil {
+			return nil, err
+		}
+		return *event, nil
+	case supplyCollateralTopic:
+		event, err := parser.ParseSupplyCollateral(log)
+		if err != nil {
+			return nil, err
+		}
+		return *event, nil
+	case withdrawTopic:
+		event, err := parser.ParseWithdraw(log)
+		if err != nil {
+			return nil, err
+		}
+		return *event, nil
+	case withdrawCollateralTopic:
+		event, err := parser.ParseWithdrawCollateral(log)
+		if err != nil {
+			return nil, err
+		}
+		return *event, nil
+	}
+	return nil, nil
+}
+
 // --- Main Compound3 struct with multi-URL support ---
 
 type Compound3 struct {
@@ -104,7 +211,7 @@ type Compound3 struct {
 	MainAsset   common.Address
 }
 
-func NewCompound3(client *web3client.MultiURLClient, address string) (*Compound3, error) {
+func NewCompound3(ctx context.Context, client *web3client.MultiURLClient, address string) (*Compound3, error) {
 	checksumAddr := common.HexToAddress(address)
 
 	// Build callers
@@ -132,7 +239,7 @@ func NewCompound3(client *web3client.MultiURLClient, address string) (*Compound3
 	multiFilterer := &MultiURLCometFilterer{filterers: filterers}
 
 	// Fetch base token (MainAsset) using retry logic
-	mainAsset, err := multiCaller.BaseToken(&bind.CallOpts{})
+	mainAsset, err := multiCaller.BaseToken(&bind.CallOpts{Context: ctx})
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch BaseToken for Comet at %s: %w", address, err)
 	}
@@ -1,22 +1,24 @@
 package compound3
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"math/big"
 	"strings"
 
-	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/stryukovsky/go-backend-learn/trade"
-	"github.com/stryukovsky/go-backend-learn/trade/cache"
+	"github.com/stryukovsky/go-backend-learn/trade/prices"
+	"github.com/stryukovsky/go-backend-learn/trade/protocols"
 	"github.com/stryukovsky/go-backend-learn/trade/web3client"
 	"gorm.io/gorm"
 )
 
 type Compound3Handler struct {
 	compoundCometContract Compound3
-	cm                    *cache.CacheManager
+	cm                    protocols.Cache
 	db                    *gorm.DB
 	name                  string
 	tokens                []trade.Token
@@ -26,13 +28,14 @@ type Compound3Handler struct {
 func (h *Compound3Handler) ParallelFactor() int { return h.parallelFactor }
 
 func NewCompound3Handler(
+	ctx context.Context,
 	instance trade.DeFiPlatform,
 	client *web3client.MultiURLClient,
-	rdb *cache.CacheManager,
+	rdb protocols.Cache,
 	tokens []trade.Token,
 	parallelFactor int,
 ) (*Compound3Handler, error) {
-	compoundComet, err := NewCompound3(client, instance.Address)
+	compoundComet, err := NewCompound3(ctx, client, instance.Address)
 	if err != nil {
 		return nil, err
 	}
@@ -46,6 +49,7 @@ func NewCompound3Handler(
 }
 
 func (h *Compound3Handler) FetchBlockchainInteractions(
+	ctx context.Context,
 	chainId string,
 	participants []string,
 	fromBlock uint64,
@@ -55,18 +59,21 @@ func (h *Compound3Handler) FetchBlockchainInteractions(
 	for i, p := range participants {
 		formattedParticipants[i] = common.HexToAddress(p)
 	}
-	supplyEventsIter, err := h.compoundCometContract.filterer.FilterSupply(
-		&bind.FilterOpts{Start: fromBlock, End: &toBlock},
+	supplyEvents, err := h.compoundCometContract.filterer.FilterSupply(
+		ctx,
+		fromBlock,
+		toBlock,
 		[]common.Address{},
 		formattedParticipants,
 	)
 	if err != nil {
 		return nil, err
 	}
-	defer supplyEventsIter.Close()
 
-	collateralSupplyEventsIter, err := h.compoundCometContract.filterer.FilterSupplyCollateral(
-		&bind.FilterOpts{Start: fromBlock, End: &toBlock},
+	collateralSupplyEvents, err := h.compoundCometContract.filterer.FilterSupplyCollateral(
+		ctx,
+		fromBlock,
+		toBlock,
 		[]common.Address{},
 		formattedParticipants,
 		[]common.Address{},
@@ -74,48 +81,31 @@ func (h *Compound3Handler) FetchBlockchainInteractions(
 	if err != nil {
 		return nil, err
 	}
-	defer collateralSupplyEventsIter.Close()
 
-	withdrawEventsIter, err := h.compoundCometContract.filterer.FilterWithdraw(
-		&bind.FilterOpts{Start: fromBlock, End: &toBlock}, []common.Address{}, formattedParticipants)
+	withdrawEvents, err := h.compoundCometContract.filterer.FilterWithdraw(ctx, fromBlock, toBlock, []common.Address{}, formattedParticipants)
 	if err != nil {
 		return nil, err
 	}
-	defer withdrawEventsIter.Close()
 
-	collateralWithdrawEventsIter, err := h.compoundCometContract.filterer.FilterWithdrawCollateral(
-		&bind.FilterOpts{Start: fromBlock, End: &toBlock}, []common.Address{}, formattedParticipants, []common.Address{})
+	collateralWithdrawEvents, err := h.compoundCometContract.filterer.FilterWithdrawCollateral(
+		ctx,
+		fromBlock, toBlock, []common.Address{}, formattedParticipants, []common.Address{})
 	if err != nil {
 		return nil, err
 	}
-	defer collateralWithdrawEventsIter.Close()
 	// any is because go do not support generic methods, we have two types for each event: Supply and Withdraw
 	eventsRaw := make([]any, 0)
-	for supplyEventsIter.Next() {
-		if err = supplyEventsIter.Error(); err != nil {
-			return nil, err
-		}
-		eventsRaw = append(eventsRaw, *supplyEventsIter.Event)
+	for _, event := range supplyEvents {
+		eventsRaw = append(eventsRaw, event)
 	}
-	for collateralSupplyEventsIter.Next() {
-		if err = collateralSupplyEventsIter.Error(); err != nil {
-			return nil, err
-		}
-		eventsRaw = append(eventsRaw, *collateralSupplyEventsIter.Event)
+	for _, event := range collateralSupplyEvents {
+		eventsRaw = append(eventsRaw, event)
 	}
-	for withdrawEventsIter.Next() {
-		err := withdrawEventsIter.Error()
-		if err != nil {
-			return nil, err
-		}
-		eventsRaw = append(eventsRaw, *withdrawEventsIter.Event)
+	for _, event := range withdrawEvents {
+		eventsRaw = append(eventsRaw, event)
 	}
-	for collateralWithdrawEventsIter.Next() {
-		err := collateralWithdrawEventsIter.Error()
-		if err != nil {
-			return nil, err
-		}
-		eventsRaw = append(eventsRaw, *collateralWithdrawEventsIter.Event)
+	for _, event := range collateralWithdrawEvents {
+		eventsRaw = append(eventsRaw, event)
 	}
 	if len(eventsRaw) == 0 {
 		slog.Info(fmt.Sprintf("[%s] no events in block range %d - %d", h.Name(), fromBlock, toBlock))
@@ -123,8 +113,54 @@ func (h *Compound3Handler) FetchBlockchainInteractions(
 	} else {
 		slog.Info(fmt.Sprintf("[%s] found %d events in block range %d - %d", h.Name(), len(eventsRaw), fromBlock, toBlock))
 	}
+	return h.parseCometEvents(ctx, chainId, eventsRaw)
+}
+
+func (h *Compound3Handler) LogsAddresses() []common.Address {
+	return []common.Address{h.compoundCometContract.Address}
+}
 
+func (h *Compound3Handler) ParseLogs(ctx context.Context, chainId string, participants []string, logs []types.Log) ([]trade.Compound3Event, error) {
+	tracked := trade.AddressSet(participants)
+	eventsRaw := make([]any, 0)
+	for _, log := range logs {
+		if log.Address != h.compoundCometContract.Address {
+			continue
+		}
+		event, err := h.compoundCometContract.filterer.ParseLog(log)
+		if err != nil {
+			return nil, err
+		}
+		var participant common.Address
+		switch event := event.(type) {
+		case nil:
+			continue
+		case CometSupply:
+			participant = event.Dst
+		case CometSupplyCollateral:
+			participant = event.Dst
+		case CometWithdraw:
+			participant = event.To
+		case CometWithdrawCollateral:
+			participant = event.To
+		}
+		if tracked[participant] {
+			eventsRaw = append(eventsRaw, event)
+		}
+	}
+	if len(eventsRaw) == 0 {
+		return make([]trade.Compound3Event, 0), nil
+	}
+	return h.parseCometEvents(ctx, chainId, eventsRaw)
+}
+
+func (h *Compound3Handler) parseCometEvents(ctx context.Context, chainId string, eventsRaw []any) ([]trade.Compound3Event, error) {
+	timestamps, err := h.cm.GetCachedBlockTimestamps(ctx, trade.BlockNumbers(eventsRaw))
+	if err != nil {
+		return nil, err
+	}
 	return trade.ParseEVMEvents(
+		ctx,
 		h.ParallelFactor(),
 		h.Name(), chainId, eventsRaw, func(task trade.ParallelEVMParserTask[trade.Compound3Event], generalEvent any) error {
 			switch generalEvent := generalEvent.(type) {
@@ -132,13 +168,14 @@ func (h *Compound3Handler) FetchBlockchainInteractions(
 				slog.Info(fmt.Sprintf("[%s] Unexpected event type %s in chunk of Events", h.Name(), generalEvent))
 			case CometSupply:
 				var event CometSupply = generalEvent
-				timestamp, err := h.cm.GetCachedBlockTimestamp(event.Raw.BlockNumber)
+				timestamp, err := timestamps.At(event.Raw.BlockNumber)
 				if err != nil {
 					slog.Warn(fmt.Sprintf("[%s] Failure on parsing Supply event %s", h.Name(), err.Error()))
 					return err
 				}
 				item := trade.NewCompound3Event(
 					chainId,
+					h.compoundCometContract.Address,
 					"supply",
 					event.Dst,
 					h.compoundCometContract.MainAsset,
@@ -146,18 +183,20 @@ func (h *Compound3Handler) FetchBlockchainInteractions(
 					*timestamp,
 					event.Raw.TxHash.Hex(),
 					event.Raw.Index,
+					event.Raw.BlockNumber,
 				)
 				task.ValuesCh <- item
 
 			case CometSupplyCollateral:
 				var event CometSupplyCollateral = generalEvent
-				timestamp, err := h.cm.GetCachedBlockTimestamp(event.Raw.BlockNumber)
+				timestamp, err := timestamps.At(event.Raw.BlockNumber)
 				if err != nil {
 					slog.Warn(fmt.Sprintf("[%s] Failure on parsing Supply event %s", h.Name(), err.Error()))
 					return err
 				}
 				item := trade.NewCompound3Event(
 					chainId,
+					h.compoundCometContract.Address,
 					"supply_collateral",
 					event.Dst,
 					event.Asset,
@@ -165,18 +204,20 @@ func (h *Compound3Handler) FetchBlockchainInteractions(
 					*timestamp,
 					event.Raw.TxHash.Hex(),
 					event.Raw.Index,
+					event.Raw.BlockNumber,
 				)
 				task.ValuesCh <- item
 
 			case CometWithdrawCollateral:
 				var event CometWithdrawCollateral = generalEvent
-				timestamp, err := h.cm.GetCachedBlockTimestamp(event.Raw.BlockNumber)
+				timestamp, err := timestamps.At(event.Raw.BlockNumber)
 				if err != nil {
 					slog.Warn(fmt.Sprintf("[%s] Failure on parsing Withdraw event %s", h.Name(), err.Error()))
 					return err
 				}
 				item := trade.NewCompound3Event(
 					chainId,
+					h.compoundCometContract.Address,
 					"withdraw_collateral",
 					event.To,
 					event.Asset,
@@ -184,18 +225,20 @@ func (h *Compound3Handler) FetchBlockchainInteractions(
 					*timestamp,
 					event.Raw.TxHash.Hex(),
 					event.Raw.Index,
+					event.Raw.BlockNumber,
 				)
 				task.ValuesCh <- item
 
 			case CometWithdraw:
 				var event CometWithdraw = generalEvent
-				timestamp, err := h.cm.GetCachedBlockTimestamp(event.Raw.BlockNumber)
+				timestamp, err := timestamps.At(event.Raw.BlockNumber)
 				if err != nil {
 					slog.Warn(fmt.Sprintf("[%s] Failure on parsing Withdraw event %s", h.Name(), err.Error()))
 					return err
 				}
 				item := trade.NewCompound3Event(
 					chainId,
+					h.compoundCometContract.Address,
 					"withdraw",
 					event.To,
 					h.compoundCometContract.MainAsset,
@@ -203,6 +246,7 @@ func (h *Compound3Handler) FetchBlockchainInteractions(
 					*timestamp,
 					event.Raw.TxHash.Hex(),
 					event.Raw.Index,
+					event.Raw.BlockNumber,
 				)
 				task.ValuesCh <- item
 			}
@@ -210,26 +254,43 @@ func (h *Compound3Handler) FetchBlockchainInteractions(
 		})
 }
 
-func (h *Compound3Handler) PopulateWithFinanceInfo(interactions []trade.Compound3Event) ([]trade.Compound3Interaction, error) {
-	result := make([]trade.Compound3Interaction, 0, len(interactions))
+// Known token of handler with address, events of other tokens are skipped on pricing
+func (h *Compound3Handler) tokenOf(address common.Address) (trade.Token, bool) {
+	for _, token := range h.tokens {
+		if strings.EqualFold(token.Address, address.Hex()) {
+			return token, true
+		}
+	}
+	return trade.Token{}, false
+}
+
+// Tokens and moments priced by PopulateWithFinanceInfo, so their prices are fetched for whole batch at once
+func (h *Compound3Handler) PriceRequests(interactions []trade.Compound3Event) []prices.Request {
+	result := make([]prices.Request, 0, len(interactions))
 	for _, interaction := range interactions {
-		tokenAddress := common.HexToAddress(interaction.TokenAddress)
-		token := trade.Token{}
-		for _, t := range h.tokens {
-			if strings.EqualFold(t.Address, tokenAddress.Hex()) {
-				token = t
-			}
+		token, ok := h.tokenOf(common.HexToAddress(interaction.TokenAddress))
+		if ok {
+			result = append(result, prices.Request{Token: token, At: prices.At(interaction.Timestamp, interaction.BlockNumber)})
 		}
+	}
+	return result
+}
 
-		if len(token.Address) == 0 {
+func (h *Compound3Handler) PopulateWithFinanceInfo(ctx context.Context, interactions []trade.Compound3Event) ([]trade.Compound3Interaction, error) {
+	result := make([]trade.Compound3Interaction, 0, len(interactions))
+	for _, interaction := range interactions {
+		tokenAddress := common.HexToAddress(interaction.TokenAddress)
+		token, ok := h.tokenOf(tokenAddress)
+		if !ok {
 			slog.Warn(fmt.Sprintf("Found compound interaction with unknown token address %s", tokenAddress))
 			continue
 		}
 
-		closePrice, err := h.cm.GetCachedSymbolPriceAtTime(token.Symbol, &interaction.Timestamp)
+		quote, err := h.cm.GetCachedTokenPrice(ctx, token, prices.At(interaction.Timestamp, interaction.BlockNumber))
 		if err != nil {
 			return nil, err
 		}
+		closePrice := quote.Price
 
 		volumeToken := big.NewRat(1, 1)
 		decimalsMultiplier := new(big.Int).Exp(big.NewInt(10), token.Decimals.Int, nil)
@@ -238,6 +299,7 @@ func (h *Compound3Handler) PopulateWithFinanceInfo(interactions []trade.Compound
 		volumeUSD := new(big.Rat).Mul(volumeToken, closePrice)
 		deal := trade.Compound3Interaction{
 			Price:           trade.NewDBNumeric(closePrice),
+			PriceSource:     quote.Source,
 			VolumeTokens:    trade.NewDBNumeric(volumeToken),
 			VolumeUSD:       trade.NewDBNumeric(volumeUSD),
 			BlockchainEvent: interaction,
@@ -246,4 +308,12 @@ func (h *Compound3Handler) PopulateWithFinanceInfo(interactions []trade.Compound
 	}
 	return result, nil
 }
+func (h *Compound3Handler) OwnEvents(query *gorm.DB) *gorm.DB {
+	return query.Where("comet_address = ?", h.compoundCometContract.Address.Hex())
+}
+
+func (h *Compound3Handler) Key() string {
+	return protocols.HandlerKey(trade.Compound3, h.compoundCometContract.Address)
+}
+
 func (h *Compound3Handler) Name() string { return h.name }
@@ -0,0 +1,66 @@
+package compound3
+
+import (
+	"context"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/replay/replaytest"
+)
+
+// Supplies and withdrawals of every wallet at Compound3 USDC market on Arbitrum One
+const (
+	arbitrumChainId   = "42161"
+	arbitrumFromBlock = 250000000
+	arbitrumToBlock   = 250001999
+	arbitrumComet     = "0x9c4ec768c28520B50860ea7a15bd7213a9fF58bf"
+)
+
+var arbitrumTokens = []trade.Token{
+	{ChainId: arbitrumChainId, Symbol: "USDC", Address: "0xaf88d065e77c8cC2239327C5EDb3A432268e5831", Decimals: trade.NewDBInt(big.NewInt(6))},
+	{ChainId: arbitrumChainId, Symbol: "WETH", Address: "0x82aF49447D8a07e3bd95BD0d56f35241523fBab1", Decimals: trade.NewDBInt(big.NewInt(18))},
+	{ChainId: arbitrumChainId, Symbol: "WBTC", Address: "0x2f2a2543B76A4166549F7aaB2e75Bef0aefC5B0f", Decimals: trade.NewDBInt(big.NewInt(8))},
+	{ChainId: arbitrumChainId, Symbol: "ARB", Address: "0x912CE59144191C1204E64559FE8253a0e49E6548", Decimals: trade.NewDBInt(big.NewInt(18))},
+}
+
+func TestHandlerOnArbitrum(t *testing.T) {
+	dir := filepath.Join("testdata", "arbitrum")
+	client := replaytest.Client(t, dir)
+	cm := replaytest.NewCache(client)
+	ctx := context.Background()
+	instance := trade.DeFiPlatform{ChainId: arbitrumChainId, Address: arbitrumComet, Type: trade.Compound3}
+	handler, err := NewCompound3Handler(ctx, instance, client, cm, arbitrumTokens, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no participants match every wallet
+	events, err := handler.FetchBlockchainInteractions(ctx, arbitrumChainId, []string{}, arbitrumFromBlock, arbitrumToBlock)
+	if err != nil {
+		t.Fatalf("Cannot fetch events: %s", err.Error())
+	}
+	if len(events) == 0 {
+		t.Fatalf("No events in blocks %d - %d, fixtures should be recorded for range with events of market", arbitrumFromBlock, arbitrumToBlock)
+	}
+	events = replaytest.Sorted(t, events)
+	for _, event := range events {
+		if event.BlockNumber < arbitrumFromBlock || event.BlockNumber > arbitrumToBlock {
+			t.Errorf("Event %s is in block %d out of fetched range", event.TxId, event.BlockNumber)
+		}
+		if event.CometAddress != arbitrumComet {
+			t.Errorf("Event %s is of market %s", event.TxId, event.CometAddress)
+		}
+		if event.Timestamp.IsZero() {
+			t.Errorf("Event %s has no timestamp", event.TxId)
+		}
+	}
+	replaytest.Golden(t, filepath.Join(dir, "events.golden.json"), events)
+
+	interactions, err := handler.PopulateWithFinanceInfo(ctx, events)
+	if err != nil {
+		t.Fatalf("Cannot price events: %s", err.Error())
+	}
+	replaytest.Golden(t, filepath.Join(dir, "interactions.golden.json"), interactions)
+}
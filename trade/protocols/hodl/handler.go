@@ -1,24 +1,27 @@
 package hodl
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"math/big"
 
-	"github.com/ethereum/go-ethereum/accounts/abi/bind/v2"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/stryukovsky/go-backend-learn/trade"
-	"github.com/stryukovsky/go-backend-learn/trade/cache"
+	"github.com/stryukovsky/go-backend-learn/trade/prices"
+	"github.com/stryukovsky/go-backend-learn/trade/protocols"
 	"github.com/stryukovsky/go-backend-learn/trade/web3client"
+	"gorm.io/gorm"
 )
 
 type HODLHandler struct {
 	token          ERC20
-	cm             *cache.CacheManager
+	cm             protocols.Cache
 	parallelFactor int
 }
 
-func NewHODLHandler(client *web3client.MultiURLClient, token trade.Token, cm *cache.CacheManager, parallelFactor int) (*HODLHandler, error) {
+func NewHODLHandler(client *web3client.MultiURLClient, token trade.Token, cm protocols.Cache, parallelFactor int) (*HODLHandler, error) {
 	erc20, err := NewERC20(client, token)
 	if err != nil {
 		return nil, err
@@ -31,6 +34,7 @@ func NewHODLHandler(client *web3client.MultiURLClient, token trade.Token, cm *ca
 }
 
 func (h *HODLHandler) FetchBlockchainInteractions(
+	ctx context.Context,
 	chainId string,
 	participants []string,
 	fromBlock uint64,
@@ -40,38 +44,36 @@ func (h *HODLHandler) FetchBlockchainInteractions(
 	for i, participant := range participants {
 		formattedParticipants[i] = common.HexToAddress(participant)
 	}
-	transfersParticipantsSenders, err := h.token.filterer.FilterTransfer(&bind.FilterOpts{
-		Start: fromBlock,
-		End:   &toBlock,
-	}, formattedParticipants, []common.Address{})
+	transfersParticipantsSenders, err := h.token.filterer.FilterTransfer(ctx, fromBlock, toBlock, formattedParticipants, []common.Address{})
 	if err != nil {
 		return []trade.ERC20Transfer{}, err
 	}
-	transfersParticipantsRecipients, err := h.token.filterer.FilterTransfer(&bind.FilterOpts{
-		Start: fromBlock,
-		End:   &toBlock,
-	}, []common.Address{}, formattedParticipants)
+	transfersParticipantsRecipients, err := h.token.filterer.FilterTransfer(ctx, fromBlock, toBlock, []common.Address{}, formattedParticipants)
 	if err != nil {
 		return []trade.ERC20Transfer{}, err
 	}
-	allTransfers := make([]IERC20Transfer, 0)
-	for transfersParticipantsSenders.Next() {
-		allTransfers = append(allTransfers, *transfersParticipantsSenders.Event)
-	}
-	for transfersParticipantsRecipients.Next() {
-		allTransfers = append(allTransfers, *transfersParticipantsRecipients.Event)
-	}
+	allTransfers := make([]IERC20Transfer, 0, len(transfersParticipantsSenders)+len(transfersParticipantsRecipients))
+	allTransfers = append(allTransfers, transfersParticipantsSenders...)
+	allTransfers = append(allTransfers, transfersParticipantsRecipients...)
 	if len(allTransfers) == 0 {
 		return []trade.ERC20Transfer{}, nil
 	}
 	slog.Info(fmt.Sprintf("Scanned %d transfers", len(allTransfers)))
-	return trade.ParseEVMEvents(h.parallelFactor, h.token.Info.Symbol, chainId, allTransfers, func(task trade.ParallelEVMParserTask[trade.ERC20Transfer], event IERC20Transfer) error {
+	return h.parseTransfers(ctx, chainId, allTransfers)
+}
+
+func (h *HODLHandler) parseTransfers(ctx context.Context, chainId string, transfers []IERC20Transfer) ([]trade.ERC20Transfer, error) {
+	timestamps, err := h.cm.GetCachedBlockTimestamps(ctx, trade.BlockNumbers(transfers))
+	if err != nil {
+		return nil, err
+	}
+	return trade.ParseEVMEvents(ctx, h.parallelFactor, h.token.Info.Symbol, chainId, transfers, func(task trade.ParallelEVMParserTask[trade.ERC20Transfer], event IERC20Transfer) error {
 		sender := event.From
 		recipient := event.To
 		amount := event.Value
 		txId := event.Raw.TxHash
 		block := event.Raw.BlockNumber
-		timestamp, err := h.cm.GetCachedBlockTimestamp(block)
+		timestamp, err := timestamps.At(block)
 		if err != nil {
 			slog.Warn(fmt.Sprintf("Cannot fetch from cache or blockchain info on block %d timestamp: %s", block, err.Error()))
 			return err
@@ -83,20 +85,56 @@ func (h *HODLHandler) FetchBlockchainInteractions(
 	)
 }
 
+func (h *HODLHandler) LogsAddresses() []common.Address {
+	return []common.Address{common.HexToAddress(h.token.Info.Address)}
+}
+
+func (h *HODLHandler) ParseLogs(ctx context.Context, chainId string, participants []string, logs []types.Log) ([]trade.ERC20Transfer, error) {
+	tracked := trade.AddressSet(participants)
+	transfers := make([]IERC20Transfer, 0)
+	for _, log := range logs {
+		if log.Address != common.HexToAddress(h.token.Info.Address) || len(log.Topics) == 0 || log.Topics[0] != transferTopic {
+			continue
+		}
+		event, err := h.token.filterer.ParseTransfer(log)
+		if err != nil {
+			return nil, err
+		}
+		if tracked[event.From] || tracked[event.To] {
+			transfers = append(transfers, *event)
+		}
+	}
+	if len(transfers) == 0 {
+		return []trade.ERC20Transfer{}, nil
+	}
+	return h.parseTransfers(ctx, chainId, transfers)
+}
+
 func (h *HODLHandler) ParallelFactor() int { return h.parallelFactor }
 
-func (h *HODLHandler) PopulateWithFinanceInfo(interactions []trade.ERC20Transfer) ([]trade.Deal, error) {
+// Moments priced by PopulateWithFinanceInfo, so their prices are fetched for whole batch at once
+func (h *HODLHandler) PriceRequests(interactions []trade.ERC20Transfer) []prices.Request {
+	result := make([]prices.Request, len(interactions))
+	for i, transfer := range interactions {
+		result[i] = prices.Request{Token: h.token.Info, At: prices.At(transfer.Timestamp, transfer.Height())}
+	}
+	return result
+}
+
+func (h *HODLHandler) PopulateWithFinanceInfo(ctx context.Context, interactions []trade.ERC20Transfer) ([]trade.Deal, error) {
 	result := make([]trade.Deal, len(interactions))
 	for i, transfer := range interactions {
-		closePrice, err := h.cm.GetCachedSymbolPriceAtTime(h.token.Info.Symbol, &transfer.Timestamp)
+		quote, err := h.cm.GetCachedTokenPrice(ctx, h.token.Info, prices.At(transfer.Timestamp, transfer.Height()))
 		if err != nil {
 			return nil, err
 		}
+		closePrice := quote.Price
 		volumeToken := big.NewRat(1, 1)
 		volumeToken = volumeToken.SetFrac(transfer.Amount.Int, new(big.Int).Exp(big.NewInt(10), h.token.Info.Decimals.Int, nil))
 		volumeUSD := new(big.Rat).Mul(volumeToken, closePrice)
 		deal := trade.Deal{
 			Price:              trade.NewDBNumeric(closePrice),
+			PriceSource:        quote.Source,
 			VolumeUSD:          trade.NewDBNumeric(volumeUSD),
 			VolumeTokens:       trade.NewDBNumeric(volumeToken),
 			BlockchainTransfer: transfer,
@@ -106,6 +144,14 @@ func (h *HODLHandler) PopulateWithFinanceInfo(interactions []trade.ERC20Transfer
 	return result, nil
 }
 
+func (h *HODLHandler) OwnEvents(query *gorm.DB) *gorm.DB {
+	return query.Where("token_address = ?", h.token.Info.Address)
+}
+
+func (h *HODLHandler) Key() string {
+	return protocols.HandlerKey(protocols.ERC20, common.HexToAddress(h.token.Info.Address))
+}
+
 func (h *HODLHandler) Name() string {
 	return h.token.Info.Symbol
 }
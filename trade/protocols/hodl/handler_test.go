@@ -0,0 +1,66 @@
+package hodl
+
+import (
+	"context"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/replay/replaytest"
+)
+
+// USDT transfers of Binance hot wallet on Arbitrum One
+const (
+	arbitrumChainId   = "42161"
+	arbitrumFromBlock = 250000000
+	arbitrumToBlock   = 250000999
+	binanceHotWallet  = "0xB38e8c17e38363aF6EbdCb3dAE12e0243582891D"
+)
+
+var arbitrumUSDT = trade.Token{
+	ChainId:  arbitrumChainId,
+	Symbol:   "USDT",
+	Address:  "0xFd086bC7CD5C481DCC9C85ebE478A1C0b69FCbb9",
+	Decimals: trade.NewDBInt(big.NewInt(6)),
+}
+
+func TestHandlerOnArbitrum(t *testing.T) {
+	dir := filepath.Join("testdata", "arbitrum")
+	client := replaytest.Client(t, dir)
+	cm := replaytest.NewCache(client)
+	handler, err := NewHODLHandler(client, arbitrumUSDT, cm, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	transfers, err := handler.FetchBlockchainInteractions(ctx, arbitrumChainId, []string{binanceHotWallet}, arbitrumFromBlock, arbitrumToBlock)
+	if err != nil {
+		t.Fatalf("Cannot fetch transfers: %s", err.Error())
+	}
+	if len(transfers) == 0 {
+		t.Fatalf("No transfers in blocks %d - %d, fixtures should be recorded for range with transfers of wallet", arbitrumFromBlock, arbitrumToBlock)
+	}
+	transfers = replaytest.Sorted(t, transfers)
+	wallet := common.HexToAddress(binanceHotWallet)
+	for _, transfer := range transfers {
+		if transfer.Height() < arbitrumFromBlock || transfer.Height() > arbitrumToBlock {
+			t.Errorf("Transfer %s is in block %d out of fetched range", transfer.TxId, transfer.Height())
+		}
+		if common.HexToAddress(transfer.Sender) != wallet && common.HexToAddress(transfer.Recipient) != wallet {
+			t.Errorf("Transfer %s is from %s to %s, wallet is neither of them", transfer.TxId, transfer.Sender, transfer.Recipient)
+		}
+		if transfer.Timestamp.IsZero() {
+			t.Errorf("Transfer %s has no timestamp", transfer.TxId)
+		}
+	}
+	replaytest.Golden(t, filepath.Join(dir, "transfers.golden.json"), transfers)
+
+	deals, err := handler.PopulateWithFinanceInfo(ctx, transfers)
+	if err != nil {
+		t.Fatalf("Cannot price transfers: %s", err.Error())
+	}
+	replaytest.Golden(t, filepath.Join(dir, "deals.golden.json"), deals)
+}
@@ -1,11 +1,13 @@
 package hodl
 
 import (
+	"context"
 	"fmt"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/stryukovsky/go-backend-learn/trade"
 	"github.com/stryukovsky/go-backend-learn/trade/web3client"
 )
@@ -22,7 +24,9 @@ type MultiURLERC20Caller struct {
 }
 
 func (c *MultiURLERC20Caller) BalanceOf(opts *bind.CallOpts, account common.Address) (*big.Int, error) {
-	return trade.RetryEthCall(
+	return web3client.RetryEthCall(
+		trade.CallContext(opts),
+		"eth_call",
 		func() []*ERC20CallerWithURL { return c.callers },
 		func(caller *ERC20CallerWithURL) (*big.Int, error) { return caller.Caller.BalanceOf(opts, account) },
 	)
@@ -39,14 +43,40 @@ type MultiURLERC20Filterer struct {
 
 func (f *ERC20FiltererWithURL) URL() string { return f.url }
 
-func (m *MultiURLERC20Filterer) FilterTransfer(opts *bind.FilterOpts, from []common.Address, to []common.Address) (*IERC20TransferIterator, error) {
-	return trade.RetryEthCall(
+func (m *MultiURLERC20Filterer) FilterTransfer(
+	ctx context.Context,
+	fromBlock uint64,
+	toBlock uint64,
+	from []common.Address,
+	to []common.Address,
+) ([]IERC20Transfer, error) {
+	return web3client.RetryEthCall(
+		ctx,
+		"eth_getLogs",
 		func() []*ERC20FiltererWithURL { return m.filterers },
-		func(filterer *ERC20FiltererWithURL) (*IERC20TransferIterator, error) {
-			return filterer.filterer.FilterTransfer(opts, from, to)
+		func(f *ERC20FiltererWithURL) ([]IERC20Transfer, error) {
+			return trade.FilterLogsAdaptive(f.url, fromBlock, toBlock, func(fromBlock uint64, toBlock uint64) ([]IERC20Transfer, error) {
+				iter, err := f.filterer.FilterTransfer(&bind.FilterOpts{Start: fromBlock, End: &toBlock, Context: ctx}, from, to)
+				if err != nil {
+					return nil, err
+				}
+				defer iter.Close()
+				events := make([]IERC20Transfer, 0)
+				for iter.Next() {
+					events = append(events, *iter.Event)
+				}
+				return events, iter.Error()
+			})
 		})
 }
 
+var transferTopic = trade.EventTopic(IERC20MetaData, "Transfer")
+
+// Decoding of log needs no JSON RPC, so any filterer fits
+func (m *MultiURLERC20Filterer) ParseTransfer(log types.Log) (*IERC20Transfer, error) {
+	return m.filterers[0].filterer.ParseTransfer(log)
+}
+
 type ERC20 struct {
 	client   *web3client.MultiURLClient
 	caller   *MultiURLERC20Caller
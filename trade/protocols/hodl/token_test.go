@@ -0,0 +1,46 @@
+package hodl
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/replay/replaytest"
+)
+
+// Fixtures answer eth_getLogs of blocks 100 - 199 with block range error and its halves with one transfer each
+func TestFilterTransferFromFixtures(t *testing.T) {
+	if replaytest.Recording() {
+		t.Skip("Fixtures of block range error are written by hand")
+	}
+	client := replaytest.Client(t, filepath.Join("testdata", "fixtures"))
+	token, err := NewERC20(client, trade.Token{Address: "0xFd086bC7CD5C481DCC9C85ebE478A1C0b69FCbb9", Symbol: "USDT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	counterpart := common.HexToAddress("0x2222222222222222222222222222222222222222")
+
+	transfers, err := token.filterer.FilterTransfer(context.Background(), 100, 199, []common.Address{wallet}, []common.Address{})
+	if err != nil {
+		t.Fatalf("Cannot fetch transfers: %s", err.Error())
+	}
+	expected := []struct {
+		block uint64
+		value int64
+	}{{120, 1000000}, {170, 2500000}}
+	if len(transfers) != len(expected) {
+		t.Fatalf("Fetched %d transfers, expected %d", len(transfers), len(expected))
+	}
+	for i, transfer := range transfers {
+		if transfer.Raw.BlockNumber != expected[i].block || transfer.Value.Int64() != expected[i].value {
+			t.Errorf("Transfer %d is %d in block %d, expected %d in block %d",
+				i, transfer.Value.Int64(), transfer.Raw.BlockNumber, expected[i].value, expected[i].block)
+		}
+		if transfer.From != wallet || transfer.To != counterpart {
+			t.Errorf("Transfer %d is from %s to %s", i, transfer.From.Hex(), transfer.To.Hex())
+		}
+	}
+}
@@ -8,13 +8,14 @@ import (
 	"math"
 	"math/big"
 	"sync"
-	"time"
 
-	"github.com/ethereum/go-ethereum/accounts/abi/bind/v2"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/samber/lo"
 	"github.com/stryukovsky/go-backend-learn/trade"
-	"github.com/stryukovsky/go-backend-learn/trade/cache"
+	"github.com/stryukovsky/go-backend-learn/trade/prices"
+	"github.com/stryukovsky/go-backend-learn/trade/protocols"
 	"github.com/stryukovsky/go-backend-learn/trade/web3client"
 	"gorm.io/gorm"
 )
@@ -22,7 +23,7 @@ import (
 type UniswapV3PoolHandler struct {
 	pool            UniswapV3PoolInstance
 	positionManager NFPositionManagerInstance
-	cm              *cache.CacheManager
+	cm              protocols.Cache
 	db              *gorm.DB
 	name            string
 	tokenA          trade.Token
@@ -34,9 +35,10 @@ type UniswapV3PoolHandler struct {
 func (h *UniswapV3PoolHandler) ParallelFactor() int { return h.parallelFactor }
 
 func NewUniswapV3PoolHandler(
+	ctx context.Context,
 	instance trade.DeFiPlatform,
 	client *web3client.MultiURLClient,
-	cm *cache.CacheManager,
+	cm protocols.Cache,
 	db *gorm.DB,
 	parallelFactor int,
 ) (*UniswapV3PoolHandler, error) {
@@ -48,15 +50,16 @@ func NewUniswapV3PoolHandler(
 	if err != nil {
 		return nil, err
 	}
-	tokenAddressA, err := pool.caller.Token0(nil)
+	tokenAddressA, err := pool.caller.Token0(&bind.CallOpts{Context: ctx})
 	if err != nil {
 		return nil, err
 	}
-	tokenAddressB, err := pool.caller.Token1(nil)
+	tokenAddressB, err := pool.caller.Token1(&bind.CallOpts{Context: ctx})
 	if err != nil {
 		return nil, err
 	}
 	var tokenA trade.Token
+	db = db.WithContext(ctx)
 	db.First(&tokenA, trade.Token{ChainId: instance.ChainId, Address: tokenAddressA.Hex()})
 	var tokenB trade.Token
 	db.First(&tokenB, trade.Token{ChainId: instance.ChainId, Address: tokenAddressB.Hex()})
@@ -104,7 +107,7 @@ func SqrtPrice2Price(source *big.Int, token0 trade.Token, token1 trade.Token) (*
 	return Adjustment2HumanPrice(adjustedPrice, token0, token1), nil
 }
 
-func (h *UniswapV3PoolHandler) parseMint(event UniswapV3PoolMint) (*trade.UniswapV3Event, error) {
+func (h *UniswapV3PoolHandler) parseMint(timestamps trade.BlockTimestamps, event UniswapV3PoolMint) (*trade.UniswapV3Event, error) {
 	lowerPrice, err := Tick2Price(event.TickLower, h.tokenA, h.tokenB)
 	if err != nil {
 		slog.Warn(fmt.Sprintf("[%s] Cannot parse lower price of mint event: %s", h.Name(), err.Error()))
@@ -115,9 +118,7 @@ func (h *UniswapV3PoolHandler) parseMint(event UniswapV3PoolMint) (*trade.Uniswa
 		slog.Warn(fmt.Sprintf("[%s] Cannot parse upper price of mint event: %s", h.Name(), err.Error()))
 		return nil, err
 	}
-	timestamp, err := h.cm.GetCachedBlockTimestamp(
-		event.Raw.BlockNumber,
-	)
+	timestamp, err := timestamps.At(event.Raw.BlockNumber)
 	if err != nil {
 		slog.Warn(fmt.Sprintf("[%s] Cannot get block timestamp from cache/blockchain: %s", h.Name(), err.Error()))
 		return nil, err
@@ -142,7 +143,7 @@ func (h *UniswapV3PoolHandler) parseMint(event UniswapV3PoolMint) (*trade.Uniswa
 	return &result, nil
 }
 
-func (h *UniswapV3PoolHandler) parseBurn(event UniswapV3PoolBurn) (*trade.UniswapV3Event, error) {
+func (h *UniswapV3PoolHandler) parseBurn(timestamps trade.BlockTimestamps, event UniswapV3PoolBurn) (*trade.UniswapV3Event, error) {
 	lowerPrice, err := Tick2Price(event.TickLower, h.tokenA, h.tokenB)
 	if err != nil {
 		slog.Warn(fmt.Sprintf("[%s] Cannot parse lower price of burn event: %s", h.Name(), err.Error()))
@@ -153,9 +154,7 @@ func (h *UniswapV3PoolHandler) parseBurn(event UniswapV3PoolBurn) (*trade.Uniswa
 		slog.Warn(fmt.Sprintf("[%s] Cannot parse upper price of burn event: %s", h.Name(), err.Error()))
 		return nil, err
 	}
-	timestamp, err := h.cm.GetCachedBlockTimestamp(
-		event.Raw.BlockNumber,
-	)
+	timestamp, err := timestamps.At(event.Raw.BlockNumber)
 	if err != nil {
 		slog.Warn(fmt.Sprintf("[%s] Cannot get block timestamp from cache/blockchain: %s", h.Name(), err.Error()))
 		return nil, err
@@ -180,15 +179,13 @@ func (h *UniswapV3PoolHandler) parseBurn(event UniswapV3PoolBurn) (*trade.Uniswa
 	return &result, nil
 }
 
-func (h *UniswapV3PoolHandler) parseSwap(event UniswapV3PoolSwap) (*trade.UniswapV3Event, error) {
+func (h *UniswapV3PoolHandler) parseSwap(timestamps trade.BlockTimestamps, event UniswapV3PoolSwap) (*trade.UniswapV3Event, error) {
 	price, err := SqrtPrice2Price(event.SqrtPriceX96, h.tokenA, h.tokenB)
 	if err != nil {
 		slog.Warn(fmt.Sprintf("[%s] Cannot parse price of swap event: %s", h.Name(), err.Error()))
 		return nil, err
 	}
-	timestamp, err := h.cm.GetCachedBlockTimestamp(
-		event.Raw.BlockNumber,
-	)
+	timestamp, err := timestamps.At(event.Raw.BlockNumber)
 	if err != nil {
 		slog.Warn(fmt.Sprintf("[%s] Cannot get block timestamp from cache/blockchain: %s", h.Name(), err.Error()))
 		return nil, err
@@ -213,7 +210,7 @@ func (h *UniswapV3PoolHandler) parseSwap(event UniswapV3PoolSwap) (*trade.Uniswa
 	return &result, nil
 }
 
-func (h *UniswapV3PoolHandler) parseCollect(event UniswapV3PoolCollect) (*trade.UniswapV3Event, error) {
+func (h *UniswapV3PoolHandler) parseCollect(timestamps trade.BlockTimestamps, event UniswapV3PoolCollect) (*trade.UniswapV3Event, error) {
 	lowerPrice, err := Tick2Price(event.TickLower, h.tokenA, h.tokenB)
 	if err != nil {
 		slog.Warn(fmt.Sprintf("[%s] Cannot parse lower price of burn event: %s", h.Name(), err.Error()))
@@ -224,9 +221,7 @@ func (h *UniswapV3PoolHandler) parseCollect(event UniswapV3PoolCollect) (*trade.
 		slog.Warn(fmt.Sprintf("[%s] Cannot parse upper price of burn event: %s", h.Name(), err.Error()))
 		return nil, err
 	}
-	timestamp, err := h.cm.GetCachedBlockTimestamp(
-		event.Raw.BlockNumber,
-	)
+	timestamp, err := timestamps.At(event.Raw.BlockNumber)
 	if err != nil {
 		slog.Warn(fmt.Sprintf("[%s] Cannot get block timestamp from cache/blockchain: %s", h.Name(), err.Error()))
 		return nil, err
@@ -277,6 +272,7 @@ var addressZero = common.BigToAddress(big.NewInt(0))
 //
 // position manager liquidity events are of
 func (h *UniswapV3PoolHandler) parseEvents(
+	ctx context.Context,
 	poolEvents []any,
 	pmLiquidityEvents []any,
 	actualWalletsBurnedLiquidity map[string]common.Address,
@@ -301,7 +297,12 @@ func (h *UniswapV3PoolHandler) parseEvents(
 		}
 	}
 
-	return trade.ParseEVMEvents(h.ParallelFactor(),
+	timestamps, err := h.cm.GetCachedBlockTimestamps(ctx, trade.BlockNumbers(poolEvents))
+	if err != nil {
+		return nil, err
+	}
+	return trade.ParseEVMEvents(ctx,
+		h.ParallelFactor(),
 		h.Name(),
 		h.chainId,
 		poolEvents,
@@ -310,7 +311,7 @@ func (h *UniswapV3PoolHandler) parseEvents(
 		) error {
 			switch castedEvent := uncastedEvent.(type) {
 			case UniswapV3PoolMint:
-				parsedEvent, err := h.parseMint(castedEvent)
+				parsedEvent, err := h.parseMint(timestamps, castedEvent)
 				if err != nil {
 					return err
 				}
@@ -335,7 +336,7 @@ func (h *UniswapV3PoolHandler) parseEvents(
 				task.ValuesCh <- *parsedEvent
 
 			case UniswapV3PoolBurn:
-				parsedEvent, err := h.parseBurn(castedEvent)
+				parsedEvent, err := h.parseBurn(timestamps, castedEvent)
 				if err != nil {
 					return err
 				}
@@ -354,14 +355,14 @@ func (h *UniswapV3PoolHandler) parseEvents(
 				task.ValuesCh <- *parsedEvent
 
 			case UniswapV3PoolSwap:
-				parsedEvent, err := h.parseSwap(castedEvent)
+				parsedEvent, err := h.parseSwap(timestamps, castedEvent)
 				if err != nil {
 					return err
 				}
 				task.ValuesCh <- *parsedEvent
 
 			case UniswapV3PoolCollect:
-				parsedEvent, err := h.parseCollect(castedEvent)
+				parsedEvent, err := h.parseCollect(timestamps, castedEvent)
 				if err != nil {
 					return err
 				}
@@ -386,120 +387,81 @@ func (h *UniswapV3PoolHandler) parseEvents(
 		})
 }
 
-func (h *UniswapV3PoolHandler) fetchPoolLiquidityEvents(fromBlock uint64, toBlock uint64) ([]any, error) {
-	mintEventsIter, err := h.pool.filterer.FilterMint(
-		&bind.FilterOpts{Start: fromBlock, End: &toBlock},
-		nil,
-		nil,
-		nil,
-	)
+func (h *UniswapV3PoolHandler) fetchPoolLiquidityEvents(ctx context.Context, fromBlock uint64, toBlock uint64) ([]any, error) {
+	mintEvents, err := h.pool.filterer.FilterMint(ctx, fromBlock, toBlock, nil, nil, nil)
 	if err != nil {
 		return nil, err
 	}
-	burnEventsIter, err := h.pool.filterer.FilterBurn(
-		&bind.FilterOpts{Start: fromBlock, End: &toBlock},
-		nil,
-		nil,
-		nil,
-	)
+	burnEvents, err := h.pool.filterer.FilterBurn(ctx, fromBlock, toBlock, nil, nil, nil)
 	if err != nil {
 		return nil, err
 	}
-	swapEventsIter, err := h.pool.filterer.FilterSwap(
-		&bind.FilterOpts{Start: fromBlock, End: &toBlock},
-		nil,
-		nil,
-	)
+	swapEvents, err := h.pool.filterer.FilterSwap(ctx, fromBlock, toBlock, nil, nil)
 	if err != nil {
 		return nil, err
 	}
-	liquidityPoolEvents := make([]any, 0, 100)
-	for mintEventsIter.Next() {
-		liquidityPoolEvents = append(liquidityPoolEvents, *mintEventsIter.Event)
+	liquidityPoolEvents := make([]any, 0, len(mintEvents)+len(burnEvents)+len(swapEvents))
+	for _, event := range mintEvents {
+		liquidityPoolEvents = append(liquidityPoolEvents, event)
 	}
-	for burnEventsIter.Next() {
-		liquidityPoolEvents = append(liquidityPoolEvents, *burnEventsIter.Event)
+	for _, event := range burnEvents {
+		liquidityPoolEvents = append(liquidityPoolEvents, event)
 	}
-	for swapEventsIter.Next() {
-		liquidityPoolEvents = append(liquidityPoolEvents, *swapEventsIter.Event)
+	for _, event := range swapEvents {
+		liquidityPoolEvents = append(liquidityPoolEvents, event)
 	}
 	return liquidityPoolEvents, nil
 }
 
-func (h *UniswapV3PoolHandler) fetchPositionsManagerLiquidityEvents(fromBlock uint64, toBlock uint64) ([]any, error) {
+func (h *UniswapV3PoolHandler) fetchPositionsManagerLiquidityEvents(ctx context.Context, fromBlock uint64, toBlock uint64) ([]any, error) {
 	// Parse INonFungiblePositionsManagerIncreaseLiquidity event
-	liquidityAddedIter, err := h.positionManager.filterer.FilterIncreaseLiquidity(
-		&bind.FilterOpts{Start: fromBlock, End: &toBlock},
-		nil,
-	)
+	liquidityAdded, err := h.positionManager.filterer.FilterIncreaseLiquidity(ctx, fromBlock, toBlock, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	// Parse INonFungiblePositionsManagerDecreaseLiquidity event
-	liquidityRemovedIter, err := h.positionManager.filterer.FilterDecreaseLiquidity(
-		&bind.FilterOpts{Start: fromBlock, End: &toBlock},
-		nil,
-	)
+	liquidityRemoved, err := h.positionManager.filterer.FilterDecreaseLiquidity(ctx, fromBlock, toBlock, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	feesCollected, err := h.positionManager.filterer.FilterCollect(&bind.FilterOpts{Start: fromBlock, End: &toBlock}, nil)
+	feesCollected, err := h.positionManager.filterer.FilterCollect(ctx, fromBlock, toBlock, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	// Parse INonFungiblePositionsManagerIncreaseLiquidity event
-	liquidityPositionManagerEvents := make([]any, 0, 100)
-	for liquidityAddedIter.Next() {
-		liquidityPositionManagerEvents = append(liquidityPositionManagerEvents, *liquidityAddedIter.Event)
+	liquidityPositionManagerEvents := make([]any, 0, len(liquidityAdded)+len(liquidityRemoved)+len(feesCollected))
+	for _, event := range liquidityAdded {
+		liquidityPositionManagerEvents = append(liquidityPositionManagerEvents, event)
 	}
-	for liquidityRemovedIter.Next() {
-		liquidityPositionManagerEvents = append(liquidityPositionManagerEvents, *liquidityRemovedIter.Event)
+	for _, event := range liquidityRemoved {
+		liquidityPositionManagerEvents = append(liquidityPositionManagerEvents, event)
 	}
-	for feesCollected.Next() {
-		liquidityPositionManagerEvents = append(liquidityPositionManagerEvents, *feesCollected.Event)
+	for _, event := range feesCollected {
+		liquidityPositionManagerEvents = append(liquidityPositionManagerEvents, event)
 	}
 	return liquidityPositionManagerEvents, nil
 }
 
-func (h *UniswapV3PoolHandler) fetchERC721TransferEvents(fromBlock uint64, toBlock uint64) ([]INonFungiblePositionsManagerTransfer, error) {
-	erc721TransferEventsIter, err := h.positionManager.filterer.FilterTransfer(
-		&bind.FilterOpts{Start: fromBlock, End: &toBlock},
-		nil,
-		nil,
-		nil,
-	)
-	if err != nil {
-		return nil, err
-	}
-	transferEvents := make([]INonFungiblePositionsManagerTransfer, 0, 100)
-	for erc721TransferEventsIter.Next() {
-		transferEvents = append(transferEvents, *erc721TransferEventsIter.Event)
-	}
-	return transferEvents, nil
+func (h *UniswapV3PoolHandler) fetchERC721TransferEvents(ctx context.Context, fromBlock uint64, toBlock uint64) ([]INonFungiblePositionsManagerTransfer, error) {
+	return h.positionManager.filterer.FilterTransfer(ctx, fromBlock, toBlock, nil, nil, nil)
 }
 
-func (h *UniswapV3PoolHandler) FetchLiquidityInteractions(
-	chainId string,
-	fromBlock uint64,
-	toBlock uint64,
-) ([]trade.UniswapV3Event, []trade.UniswapV3Position, error) {
-	// Parse ERC721 Transfer events
-	transferEvents, err := h.fetchERC721TransferEvents(fromBlock, toBlock)
-	if err != nil {
-		return nil, nil, err
-	}
+// Positions minted with ERC721 transfers and owners of positions burned with them
+func (h *UniswapV3PoolHandler) positionsFromTransfers(
+	ctx context.Context,
+	transferEvents []INonFungiblePositionsManagerTransfer,
+) ([]trade.UniswapV3Position, map[string]common.Address, []trade.UniswapV3Position, error) {
 	mintedPositions := make([]trade.UniswapV3Position, 0, len(transferEvents))
 	positionBurnedEvents := make(map[string]common.Address)
 	var alreadyMintedPositions []trade.UniswapV3Position
-	err = h.db.Find(&alreadyMintedPositions, trade.UniswapV3Position{
+	err := h.db.WithContext(ctx).Find(&alreadyMintedPositions, trade.UniswapV3Position{
 		ChainId:                 h.chainId,
 		UniswapPositionsManager: h.positionManager.Address.Hex(),
 	}).Error
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	for _, event := range transferEvents {
 		if event.From == addressZero {
@@ -521,7 +483,25 @@ func (h *UniswapV3PoolHandler) FetchLiquidityInteractions(
 		}
 	}
 	allPositionsAvailableAtTheMoment := append(alreadyMintedPositions, mintedPositions...)
-	liquidityPoolEvents, err := h.fetchPoolLiquidityEvents(fromBlock, toBlock)
+	return mintedPositions, positionBurnedEvents, allPositionsAvailableAtTheMoment, nil
+}
+
+func (h *UniswapV3PoolHandler) FetchLiquidityInteractions(
+	ctx context.Context,
+	chainId string,
+	fromBlock uint64,
+	toBlock uint64,
+) ([]trade.UniswapV3Event, []trade.UniswapV3Position, error) {
+	// Parse ERC721 Transfer events
+	transferEvents, err := h.fetchERC721TransferEvents(ctx, fromBlock, toBlock)
+	if err != nil {
+		return nil, nil, err
+	}
+	mintedPositions, positionBurnedEvents, allPositionsAvailableAtTheMoment, err := h.positionsFromTransfers(ctx, transferEvents)
+	if err != nil {
+		return nil, nil, err
+	}
+	liquidityPoolEvents, err := h.fetchPoolLiquidityEvents(ctx, fromBlock, toBlock)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -532,29 +512,81 @@ func (h *UniswapV3PoolHandler) FetchLiquidityInteractions(
 		slog.Info(fmt.Sprintf("[%s] found %d events in block range %d - %d", h.Name(), len(liquidityPoolEvents), fromBlock, toBlock))
 	}
 
-	liquidityPositionManagerEvents, err := h.fetchPositionsManagerLiquidityEvents(fromBlock, toBlock)
+	liquidityPositionManagerEvents, err := h.fetchPositionsManagerLiquidityEvents(ctx, fromBlock, toBlock)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	result, err := h.parseEvents(liquidityPoolEvents, liquidityPositionManagerEvents, positionBurnedEvents, allPositionsAvailableAtTheMoment)
+	result, err := h.parseEvents(ctx, liquidityPoolEvents, liquidityPositionManagerEvents, positionBurnedEvents, allPositionsAvailableAtTheMoment)
 	if err != nil {
 		return nil, nil, err
 	}
 	return result, mintedPositions, nil
 }
 
+func (h *UniswapV3PoolHandler) LogsAddresses() []common.Address {
+	return []common.Address{h.pool.Address, h.positionManager.Address}
+}
+
+// Liquidity events are matched with position manager events of the same logs batch, so logs of a block should come together
+func (h *UniswapV3PoolHandler) ParseLogs(ctx context.Context, chainId string, participants []string, logs []types.Log) ([]trade.UniswapV3Event, error) {
+	liquidityPoolEvents := make([]any, 0)
+	liquidityPositionManagerEvents := make([]any, 0)
+	transferEvents := make([]INonFungiblePositionsManagerTransfer, 0)
+	for _, log := range logs {
+		switch log.Address {
+		case h.pool.Address:
+			event, err := h.pool.filterer.ParseLog(log)
+			if err != nil {
+				return nil, err
+			}
+			if event != nil {
+				liquidityPoolEvents = append(liquidityPoolEvents, event)
+			}
+		case h.positionManager.Address:
+			event, err := h.positionManager.filterer.ParseLog(log)
+			if err != nil {
+				return nil, err
+			}
+			switch event := event.(type) {
+			case nil:
+			case INonFungiblePositionsManagerTransfer:
+				transferEvents = append(transferEvents, event)
+			default:
+				liquidityPositionManagerEvents = append(liquidityPositionManagerEvents, event)
+			}
+		}
+	}
+	if len(liquidityPoolEvents) == 0 {
+		return make([]trade.UniswapV3Event, 0), nil
+	}
+	_, positionBurnedEvents, allPositionsAvailableAtTheMoment, err := h.positionsFromTransfers(ctx, transferEvents)
+	if err != nil {
+		return nil, err
+	}
+	return h.parseEvents(ctx, liquidityPoolEvents, liquidityPositionManagerEvents, positionBurnedEvents, allPositionsAvailableAtTheMoment)
+}
+
+func (h *UniswapV3PoolHandler) OwnEvents(query *gorm.DB) *gorm.DB {
+	return query.Where("pool_address = ?", h.pool.Address.Hex())
+}
+
+func (h *UniswapV3PoolHandler) Key() string {
+	return protocols.HandlerKey(trade.UniswapV3, h.pool.Address)
+}
+
 func (h *UniswapV3PoolHandler) Name() string {
 	return h.name
 }
 
 func (h *UniswapV3PoolHandler) FetchBlockchainInteractions(
+	ctx context.Context,
 	chainId string,
 	participants []string,
 	fromBlock uint64,
 	toBlock uint64,
 ) ([]trade.UniswapV3Event, error) {
-	events, _, err := h.FetchLiquidityInteractions(chainId, fromBlock, toBlock)
+	events, _, err := h.FetchLiquidityInteractions(ctx, chainId, fromBlock, toBlock)
 	if err != nil {
 		return nil, err
 	}
@@ -562,19 +594,30 @@ func (h *UniswapV3PoolHandler) FetchBlockchainInteractions(
 	return events, nil
 }
 
-func (h *UniswapV3PoolHandler) humanVolumeOfToken(amount *big.Int, token *trade.Token, dealTime *time.Time) (*big.Rat, *big.Rat, *big.Rat, error) {
-	closePrice, err := h.cm.GetCachedSymbolPriceAtTime(token.Symbol, dealTime)
+func (h *UniswapV3PoolHandler) humanVolumeOfToken(ctx context.Context, amount *big.Int, token *trade.Token, at prices.Moment) (*big.Rat, *big.Rat, *prices.Quote, error) {
+	quote, err := h.cm.GetCachedTokenPrice(ctx, *token, at)
 	if err != nil {
 		return nil, nil, nil, err
 	}
+	closePrice := quote.Price
 
 	decimalsMultiplier := new(big.Int).Exp(big.NewInt(10), token.Decimals.Int, nil)
 	volumeToken := new(big.Rat).SetFrac(amount, decimalsMultiplier)
 	volumeUSD := new(big.Rat).Mul(volumeToken, closePrice)
-	return volumeUSD, volumeToken, closePrice, nil
+	return volumeUSD, volumeToken, quote, nil
+}
+
+// Both tokens of pool at moments priced by PopulateWithFinanceInfo, so their prices are fetched for whole batch at once
+func (h *UniswapV3PoolHandler) PriceRequests(interactions []trade.UniswapV3Event) []prices.Request {
+	result := make([]prices.Request, 0, 2*len(interactions))
+	for _, interaction := range interactions {
+		at := prices.At(interaction.Timestamp, interaction.BlockNumber)
+		result = append(result, prices.Request{Token: h.tokenA, At: at}, prices.Request{Token: h.tokenB, At: at})
+	}
+	return result
 }
 
-func (h *UniswapV3PoolHandler) PopulateWithFinanceInfoConcurrently(interactions []trade.UniswapV3Event) ([]trade.UniswapV3Deal, error) {
+func (h *UniswapV3PoolHandler) PopulateWithFinanceInfoConcurrently(ctx context.Context, interactions []trade.UniswapV3Event) ([]trade.UniswapV3Deal, error) {
 	chunkSize := len(interactions) / h.ParallelFactor()
 	if chunkSize == 0 {
 		return []trade.UniswapV3Deal{}, nil
@@ -583,7 +626,7 @@ func (h *UniswapV3PoolHandler) PopulateWithFinanceInfoConcurrently(interactions
 	chunks := lo.Chunk(interactions, chunkSize)
 	var wg sync.WaitGroup
 	wg.Add(len(chunks))
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	for _, chunk := range chunks {
 		go func() {
@@ -593,10 +636,11 @@ func (h *UniswapV3PoolHandler) PopulateWithFinanceInfoConcurrently(interactions
 				case <-ctx.Done():
 					return
 				default:
-					volumeAInUSD, volumeA, priceAInUSD, err := h.humanVolumeOfToken(
+					volumeAInUSD, volumeA, quoteA, err := h.humanVolumeOfToken(
+						ctx,
 						interaction.AmountTokenA.Int,
 						&h.tokenA,
-						&interaction.Timestamp,
+						prices.At(interaction.Timestamp, interaction.BlockNumber),
 					)
 					if err != nil {
 						slog.Warn(fmt.Sprintf(
@@ -609,7 +653,7 @@ func (h *UniswapV3PoolHandler) PopulateWithFinanceInfoConcurrently(interactions
 						return
 					}
 
-					volumeBInUSD, volumeB, priceBInUSD, err := h.humanVolumeOfToken(interaction.AmountTokenB.Int, &h.tokenB, &interaction.Timestamp)
+					volumeBInUSD, volumeB, quoteB, err := h.humanVolumeOfToken(ctx, interaction.AmountTokenB.Int, &h.tokenB, prices.At(interaction.Timestamp, interaction.BlockNumber))
 					if err != nil {
 						slog.Warn(fmt.Sprintf("[%s] Error on token %s volume and price calculation in USD: %s", h.Name(), h.tokenB.Symbol, err.Error()))
 						cancel()
@@ -619,8 +663,10 @@ func (h *UniswapV3PoolHandler) PopulateWithFinanceInfoConcurrently(interactions
 					deal := trade.NewUniswapV3Deal(
 						h.tokenA.Symbol,
 						h.tokenB.Symbol,
-						priceAInUSD,
-						priceBInUSD,
+						quoteA.Price,
+						quoteB.Price,
+						quoteA.Source,
+						quoteB.Source,
 						volumeAInUSD,
 						volumeBInUSD,
 						volumeA,
@@ -654,15 +700,15 @@ func (h *UniswapV3PoolHandler) PopulateWithFinanceInfoConcurrently(interactions
 }
 
 // two methods exist because we possibly can reach out of binance api limits if asking it too frequent
-func (h *UniswapV3PoolHandler) PopulateWithFinanceInfo(interactions []trade.UniswapV3Event) ([]trade.UniswapV3Deal, error) {
+func (h *UniswapV3PoolHandler) PopulateWithFinanceInfo(ctx context.Context, interactions []trade.UniswapV3Event) ([]trade.UniswapV3Deal, error) {
 	result := make([]trade.UniswapV3Deal, len(interactions))
 	for i, interaction := range interactions {
-		volumeAInUSD, volumeA, priceAInUSD, err := h.humanVolumeOfToken(interaction.AmountTokenA.Int, &h.tokenA, &interaction.Timestamp)
+		volumeAInUSD, volumeA, quoteA, err := h.humanVolumeOfToken(ctx, interaction.AmountTokenA.Int, &h.tokenA, prices.At(interaction.Timestamp, interaction.BlockNumber))
 		if err != nil {
 			return nil, err
 		}
 
-		volumeBInUSD, volumeB, priceBInUSD, err := h.humanVolumeOfToken(interaction.AmountTokenB.Int, &h.tokenB, &interaction.Timestamp)
+		volumeBInUSD, volumeB, quoteB, err := h.humanVolumeOfToken(ctx, interaction.AmountTokenB.Int, &h.tokenB, prices.At(interaction.Timestamp, interaction.BlockNumber))
 		if err != nil {
 			return nil, err
 		}
@@ -670,8 +716,10 @@ func (h *UniswapV3PoolHandler) PopulateWithFinanceInfo(interactions []trade.Unis
 		deal := trade.NewUniswapV3Deal(
 			h.tokenA.Symbol,
 			h.tokenB.Symbol,
-			priceAInUSD,
-			priceBInUSD,
+			quoteA.Price,
+			quoteB.Price,
+			quoteA.Source,
+			quoteB.Source,
 			volumeAInUSD,
 			volumeBInUSD,
 			volumeA,
@@ -0,0 +1,83 @@
+package uniswapv3
+
+import (
+	"context"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/replay/replaytest"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// Swaps and liquidity of WETH / USDC 0.05% pool on Arbitrum One
+const (
+	arbitrumChainId         = "42161"
+	arbitrumFromBlock       = 250000000
+	arbitrumToBlock         = 250000199
+	arbitrumPool            = "0xC6962004f452bE9203591991D15f6b388e09E8D0"
+	arbitrumPositionManager = "0xC36442b4a4522E871399CD717aBDD847Ab11FE88"
+)
+
+var (
+	arbitrumWETH = trade.Token{ChainId: arbitrumChainId, Symbol: "WETH", Address: "0x82aF49447D8a07e3bd95BD0d56f35241523fBab1", Decimals: trade.NewDBInt(big.NewInt(18))}
+	arbitrumUSDC = trade.Token{ChainId: arbitrumChainId, Symbol: "USDC", Address: "0xaf88d065e77c8cC2239327C5EDb3A432268e5831", Decimals: trade.NewDBInt(big.NewInt(6))}
+)
+
+// Database without rows: queries are built but not sent, so they succeed and find nothing, i.e. no positions are stored yet
+func emptyDatabase(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=127.0.0.1 port=1"}), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestHandlerOnArbitrum(t *testing.T) {
+	dir := filepath.Join("testdata", "arbitrum")
+	client := replaytest.Client(t, dir)
+	cm := replaytest.NewCache(client)
+	ctx := context.Background()
+	instance := trade.DeFiPlatform{
+		ChainId:               arbitrumChainId,
+		Address:               arbitrumPool,
+		ExtraContractAddress1: arbitrumPositionManager,
+		Type:                  trade.UniswapV3,
+	}
+	handler, err := NewUniswapV3PoolHandler(ctx, instance, client, cm, emptyDatabase(t), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tokens are read from database by handler, token0 of pool is WETH
+	handler.tokenA, handler.tokenB = arbitrumWETH, arbitrumUSDC
+
+	events, positions, err := handler.FetchLiquidityInteractions(ctx, arbitrumChainId, arbitrumFromBlock, arbitrumToBlock)
+	if err != nil {
+		t.Fatalf("Cannot fetch events: %s", err.Error())
+	}
+	if len(events) == 0 {
+		t.Fatalf("No events in blocks %d - %d, fixtures should be recorded for range with events of pool", arbitrumFromBlock, arbitrumToBlock)
+	}
+	events = replaytest.Sorted(t, events)
+	for _, event := range events {
+		if event.BlockNumber < arbitrumFromBlock || event.BlockNumber > arbitrumToBlock {
+			t.Errorf("Event %s is in block %d out of fetched range", event.TxId, event.BlockNumber)
+		}
+		if event.PoolAddress != arbitrumPool {
+			t.Errorf("Event %s is of pool %s", event.TxId, event.PoolAddress)
+		}
+		if event.Timestamp.IsZero() {
+			t.Errorf("Event %s has no timestamp", event.TxId)
+		}
+	}
+	replaytest.Golden(t, filepath.Join(dir, "events.golden.json"), events)
+	replaytest.Golden(t, filepath.Join(dir, "positions.golden.json"), positions)
+
+	deals, err := handler.PopulateWithFinanceInfo(ctx, events)
+	if err != nil {
+		t.Fatalf("Cannot price events: %s", err.Error())
+	}
+	replaytest.Golden(t, filepath.Join(dir, "deals.golden.json"), deals)
+}
@@ -1,11 +1,13 @@
 package uniswapv3
 
 import (
+	"context"
 	"fmt"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/stryukovsky/go-backend-learn/trade"
 	"github.com/stryukovsky/go-backend-learn/trade/web3client"
 )
@@ -19,7 +21,9 @@ type UniswapV3PoolCallerWithURL struct {
 
 func (c *UniswapV3PoolCallerWithURL) URL() string { return c.Url }
 func (m *MultiURLUniswapV3PoolCaller) Token0(opts *bind.CallOpts) (common.Address, error) {
-	return trade.RetryEthCall(
+	return web3client.RetryEthCall(
+		trade.CallContext(opts),
+		"eth_call",
 		func() []*UniswapV3PoolCallerWithURL { return m.callers },
 		func(f *UniswapV3PoolCallerWithURL) (common.Address, error) {
 			return f.Caller.Token0(opts)
@@ -27,7 +31,9 @@ func (m *MultiURLUniswapV3PoolCaller) Token0(opts *bind.CallOpts) (common.Addres
 }
 
 func (m *MultiURLUniswapV3PoolCaller) Token1(opts *bind.CallOpts) (common.Address, error) {
-	return trade.RetryEthCall(
+	return web3client.RetryEthCall(
+		trade.CallContext(opts),
+		"eth_call",
 		func() []*UniswapV3PoolCallerWithURL { return m.callers },
 		func(f *UniswapV3PoolCallerWithURL) (common.Address, error) {
 			return f.Caller.Token1(opts)
@@ -50,43 +56,124 @@ type MultiURLUniswapV3PoolFilterer struct {
 }
 
 func (m *MultiURLUniswapV3PoolFilterer) FilterMint(
-	opts *bind.FilterOpts,
+	ctx context.Context,
+	fromBlock uint64,
+	toBlock uint64,
 	owner []common.Address,
 	tickLower []*big.Int,
 	tickUpper []*big.Int,
-) (*UniswapV3PoolMintIterator, error) {
-	return trade.RetryEthCall(
+) ([]UniswapV3PoolMint, error) {
+	return web3client.RetryEthCall(
+		ctx,
+		"eth_getLogs",
 		func() []*UniswapV3PoolFiltererWithURL { return m.filterers },
-		func(f *UniswapV3PoolFiltererWithURL) (*UniswapV3PoolMintIterator, error) {
-			return f.filterer.FilterMint(opts, owner, tickLower, tickUpper)
+		func(f *UniswapV3PoolFiltererWithURL) ([]UniswapV3PoolMint, error) {
+			return trade.FilterLogsAdaptive(f.url, fromBlock, toBlock, func(fromBlock uint64, toBlock uint64) ([]UniswapV3PoolMint, error) {
+				iter, err := f.filterer.FilterMint(&bind.FilterOpts{Start: fromBlock, End: &toBlock, Context: ctx}, owner, tickLower, tickUpper)
+				if err != nil {
+					return nil, err
+				}
+				defer iter.Close()
+				events := make([]UniswapV3PoolMint, 0)
+				for iter.Next() {
+					events = append(events, *iter.Event)
+				}
+				return events, iter.Error()
+			})
 		})
 }
 
 func (m *MultiURLUniswapV3PoolFilterer) FilterBurn(
-	opts *bind.FilterOpts,
+	ctx context.Context,
+	fromBlock uint64,
+	toBlock uint64,
 	owner []common.Address,
 	tickLower []*big.Int,
 	tickUpper []*big.Int,
-) (*UniswapV3PoolBurnIterator, error) {
-	return trade.RetryEthCall(
+) ([]UniswapV3PoolBurn, error) {
+	return web3client.RetryEthCall(
+		ctx,
+		"eth_getLogs",
 		func() []*UniswapV3PoolFiltererWithURL { return m.filterers },
-		func(f *UniswapV3PoolFiltererWithURL) (*UniswapV3PoolBurnIterator, error) {
-			return f.filterer.FilterBurn(opts, owner, tickLower, tickUpper)
+		func(f *UniswapV3PoolFiltererWithURL) ([]UniswapV3PoolBurn, error) {
+			return trade.FilterLogsAdaptive(f.url, fromBlock, toBlock, func(fromBlock uint64, toBlock uint64) ([]UniswapV3PoolBurn, error) {
+				iter, err := f.filterer.FilterBurn(&bind.FilterOpts{Start: fromBlock, End: &toBlock, Context: ctx}, owner, tickLower, tickUpper)
+				if err != nil {
+					return nil, err
+				}
+				defer iter.Close()
+				events := make([]UniswapV3PoolBurn, 0)
+				for iter.Next() {
+					events = append(events, *iter.Event)
+				}
+				return events, iter.Error()
+			})
 		})
 }
 
 func (m *MultiURLUniswapV3PoolFilterer) FilterSwap(
-	opts *bind.FilterOpts,
+	ctx context.Context,
+	fromBlock uint64,
+	toBlock uint64,
 	sender []common.Address,
 	recipient []common.Address,
-) (*UniswapV3PoolSwapIterator, error) {
-	return trade.RetryEthCall(
+) ([]UniswapV3PoolSwap, error) {
+	return web3client.RetryEthCall(
+		ctx,
+		"eth_getLogs",
 		func() []*UniswapV3PoolFiltererWithURL { return m.filterers },
-		func(f *UniswapV3PoolFiltererWithURL) (*UniswapV3PoolSwapIterator, error) {
-			return f.filterer.FilterSwap(opts, sender, recipient)
+		func(f *UniswapV3PoolFiltererWithURL) ([]UniswapV3PoolSwap, error) {
+			return trade.FilterLogsAdaptive(f.url, fromBlock, toBlock, func(fromBlock uint64, toBlock uint64) ([]UniswapV3PoolSwap, error) {
+				iter, err := f.filterer.FilterSwap(&bind.FilterOpts{Start: fromBlock, End: &toBlock, Context: ctx}, sender, recipient)
+				if err != nil {
+					return nil, err
+				}
+				defer iter.Close()
+				events := make([]UniswapV3PoolSwap, 0)
+				for iter.Next() {
+					events = append(events, *iter.Event)
+				}
+				return events, iter.Error()
+			})
 		})
 }
 
+var (
+	poolMintTopic = trade.EventTopic(UniswapV3PoolMetaData, "Mint")
+	poolBurnTopic = trade.EventTopic(UniswapV3PoolMetaData, "Burn")
+	poolSwapTopic = trade.EventTopic(UniswapV3PoolMetaData, "Swap")
+)
+
+// Decodes pool events which are fetched by FilterMint, FilterBurn and FilterSwap; decoding needs no JSON RPC, so any filterer fits.
+// Returns nil event for logs of other events
+func (m *MultiURLUniswapV3PoolFilterer) ParseLog(log types.Log) (any, error) {
+	parser := m.filterers[0].filterer
+	if len(log.Topics) == 0 {
+		return nil, nil
+	}
+	switch log.Topics[0] {
+	case poolMintTopic:
+		event, err := parser.ParseMint(log)
+		if err != nil {
+			return nil, err
+		}
+		return *event, nil
+	case poolBurnTopic:
+		event, err := parser.ParseBurn(log)
+		if err != nil {
+			return nil, err
+		}
+		return *event, nil
+	case poolSwapTopic:
+		event, err := parser.ParseSwap(log)
+		if err != nil {
+			return nil, err
+		}
+		return *event, nil
+	}
+	return nil, nil
+}
+
 type UniswapV3PoolInstance struct {
 	client   *web3client.MultiURLClient
 	caller   *MultiURLUniswapV3PoolCaller
@@ -148,48 +235,154 @@ type MultiURLNFPositionManagerFilterer struct {
 }
 
 func (m *MultiURLNFPositionManagerFilterer) FilterIncreaseLiquidity(
-	opts *bind.FilterOpts,
+	ctx context.Context,
+	fromBlock uint64,
+	toBlock uint64,
 	tokenId []*big.Int,
-) (*INonFungiblePositionsManagerIncreaseLiquidityIterator, error) {
-	return trade.RetryEthCall(
+) ([]INonFungiblePositionsManagerIncreaseLiquidity, error) {
+	return web3client.RetryEthCall(
+		ctx,
+		"eth_getLogs",
 		func() []*NFPositionManagerFiltererWithURL { return m.filterers },
-		func(f *NFPositionManagerFiltererWithURL) (*INonFungiblePositionsManagerIncreaseLiquidityIterator, error) {
-			return f.filterer.FilterIncreaseLiquidity(opts, tokenId)
+		func(f *NFPositionManagerFiltererWithURL) ([]INonFungiblePositionsManagerIncreaseLiquidity, error) {
+			return trade.FilterLogsAdaptive(f.url, fromBlock, toBlock, func(fromBlock uint64, toBlock uint64) ([]INonFungiblePositionsManagerIncreaseLiquidity, error) {
+				iter, err := f.filterer.FilterIncreaseLiquidity(&bind.FilterOpts{Start: fromBlock, End: &toBlock, Context: ctx}, tokenId)
+				if err != nil {
+					return nil, err
+				}
+				defer iter.Close()
+				events := make([]INonFungiblePositionsManagerIncreaseLiquidity, 0)
+				for iter.Next() {
+					events = append(events, *iter.Event)
+				}
+				return events, iter.Error()
+			})
 		})
 }
 
 func (m *MultiURLNFPositionManagerFilterer) FilterDecreaseLiquidity(
-	opts *bind.FilterOpts,
+	ctx context.Context,
+	fromBlock uint64,
+	toBlock uint64,
 	tokenId []*big.Int,
-) (*INonFungiblePositionsManagerDecreaseLiquidityIterator, error) {
-	return trade.RetryEthCall(
+) ([]INonFungiblePositionsManagerDecreaseLiquidity, error) {
+	return web3client.RetryEthCall(
+		ctx,
+		"eth_getLogs",
 		func() []*NFPositionManagerFiltererWithURL { return m.filterers },
-		func(f *NFPositionManagerFiltererWithURL) (*INonFungiblePositionsManagerDecreaseLiquidityIterator, error) {
-			return f.filterer.FilterDecreaseLiquidity(opts, tokenId)
+		func(f *NFPositionManagerFiltererWithURL) ([]INonFungiblePositionsManagerDecreaseLiquidity, error) {
+			return trade.FilterLogsAdaptive(f.url, fromBlock, toBlock, func(fromBlock uint64, toBlock uint64) ([]INonFungiblePositionsManagerDecreaseLiquidity, error) {
+				iter, err := f.filterer.FilterDecreaseLiquidity(&bind.FilterOpts{Start: fromBlock, End: &toBlock, Context: ctx}, tokenId)
+				if err != nil {
+					return nil, err
+				}
+				defer iter.Close()
+				events := make([]INonFungiblePositionsManagerDecreaseLiquidity, 0)
+				for iter.Next() {
+					events = append(events, *iter.Event)
+				}
+				return events, iter.Error()
+			})
 		})
 }
 
 func (m *MultiURLNFPositionManagerFilterer) FilterCollect(
-	opts *bind.FilterOpts,
+	ctx context.Context,
+	fromBlock uint64,
+	toBlock uint64,
 	tokenId []*big.Int,
-) (*INonFungiblePositionsManagerCollectIterator, error) {
-	return trade.RetryEthCall(
+) ([]INonFungiblePositionsManagerCollect, error) {
+	return web3client.RetryEthCall(
+		ctx,
+		"eth_getLogs",
 		func() []*NFPositionManagerFiltererWithURL { return m.filterers },
-		func(f *NFPositionManagerFiltererWithURL) (*INonFungiblePositionsManagerCollectIterator, error) {
-			return f.filterer.FilterCollect(opts, tokenId)
+		func(f *NFPositionManagerFiltererWithURL) ([]INonFungiblePositionsManagerCollect, error) {
+			return trade.FilterLogsAdaptive(f.url, fromBlock, toBlock, func(fromBlock uint64, toBlock uint64) ([]INonFungiblePositionsManagerCollect, error) {
+				iter, err := f.filterer.FilterCollect(&bind.FilterOpts{Start: fromBlock, End: &toBlock, Context: ctx}, tokenId)
+				if err != nil {
+					return nil, err
+				}
+				defer iter.Close()
+				events := make([]INonFungiblePositionsManagerCollect, 0)
+				for iter.Next() {
+					events = append(events, *iter.Event)
+				}
+				return events, iter.Error()
+			})
 		})
 }
 
 func (m *MultiURLNFPositionManagerFilterer) FilterTransfer(
-	opts *bind.FilterOpts, from []common.Address, to []common.Address, tokenId []*big.Int,
-) (*INonFungiblePositionsManagerTransferIterator, error) {
-	return trade.RetryEthCall(
+	ctx context.Context,
+	fromBlock uint64,
+	toBlock uint64,
+	from []common.Address,
+	to []common.Address,
+	tokenId []*big.Int,
+) ([]INonFungiblePositionsManagerTransfer, error) {
+	return web3client.RetryEthCall(
+		ctx,
+		"eth_getLogs",
 		func() []*NFPositionManagerFiltererWithURL { return m.filterers },
-		func(f *NFPositionManagerFiltererWithURL) (*INonFungiblePositionsManagerTransferIterator, error) {
-			return f.filterer.FilterTransfer(opts, from, to, tokenId)
+		func(f *NFPositionManagerFiltererWithURL) ([]INonFungiblePositionsManagerTransfer, error) {
+			return trade.FilterLogsAdaptive(f.url, fromBlock, toBlock, func(fromBlock uint64, toBlock uint64) ([]INonFungiblePositionsManagerTransfer, error) {
+				iter, err := f.filterer.FilterTransfer(&bind.FilterOpts{Start: fromBlock, End: &toBlock, Context: ctx}, from, to, tokenId)
+				if err != nil {
+					return nil, err
+				}
+				defer iter.Close()
+				events := make([]INonFungiblePositionsManagerTransfer, 0)
+				for iter.Next() {
+					events = append(events, *iter.Event)
+				}
+				return events, iter.Error()
+			})
 		})
 }
 
+var (
+	positionsIncreaseLiquidityTopic = trade.EventTopic(INonFungiblePositionsManagerMetaData, "IncreaseLiquidity")
+	positionsDecreaseLiquidityTopic = trade.EventTopic(INonFungiblePositionsManagerMetaData, "DecreaseLiquidity")
+	positionsCollectTopic           = trade.EventTopic(INonFungiblePositionsManagerMetaData, "Collect")
+	positionsTransferTopic          = trade.EventTopic(INonFungiblePositionsManagerMetaData, "Transfer")
+)
+
+// Decodes position manager events fetched by filterer methods above; decoding needs no JSON RPC, so any filterer fits.
+// Returns nil event for logs of other events
+func (m *MultiURLNFPositionManagerFilterer) ParseLog(log types.Log) (any, error) {
+	parser := m.filterers[0].filterer
+	if len(log.Topics) == 0 {
+		return nil, nil
+	}
+	switch log.Topics[0] {
+	case positionsIncreaseLiquidityTopic:
+		event, err := parser.ParseIncreaseLiquidity(log)
+		if err != nil {
+			return nil, err
+		}
+		return *event, nil
+	case positionsDecreaseLiquidityTopic:
+		event, err := parser.ParseDecreaseLiquidity(log)
+		if err != nil {
+			return nil, err
+		}
+		return *event, nil
+	case positionsCollectTopic:
+		event, err := parser.ParseCollect(log)
+		if err != nil {
+			return nil, err
+		}
+		return *event, nil
+	case positionsTransferTopic:
+		event, err := parser.ParseTransfer(log)
+		if err != nil {
+			return nil, err
+		}
+		return *event, nil
+	}
+	return nil, nil
+}
+
 type NFPositionManagerInstance struct {
 	client   *web3client.MultiURLClient
 	caller   *MultiURLNFPositionManagerCaller
@@ -0,0 +1,288 @@
+package replay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stryukovsky/go-backend-learn/trade/binance"
+	"github.com/stryukovsky/go-backend-learn/trade/web3client"
+)
+
+const (
+	// Requests are sent to network and saved with their responses as fixtures
+	Record = "record"
+	// Requests are answered with saved fixtures, network is not touched
+	Replay = "replay"
+)
+
+var ErrNoFixture = errors.New("No fixture recorded for request")
+
+// Routes JSON RPC and Binance requests of process through transport recording or replaying fixtures in dir
+func Install(mode string, dir string) error {
+	transport, err := NewTransport(mode, dir, nil)
+	if err != nil {
+		return err
+	}
+	client := transport.Client()
+	web3client.HTTPClient = client
+	binance.HTTPClient = client
+	slog.Info(fmt.Sprintf("JSON RPC and Binance requests are in %s mode with fixtures in %s", mode, dir))
+	return nil
+}
+
+// Request and response pair saved to disk. JSON RPC ids are stripped, so fixture matches request regardless of its id
+type Fixture struct {
+	Method       string          `json:"method"`
+	Host         string          `json:"host"`
+	Request      json.RawMessage `json:"request,omitempty"`
+	Status       int             `json:"status"`
+	ContentType  string          `json:"contentType"`
+	Response     json.RawMessage `json:"response,omitempty"`
+	ResponseText string          `json:"responseText,omitempty"`
+}
+
+// HTTP transport recording or replaying request and response pairs of JSON RPC providers and Binance
+type Transport struct {
+	mode string
+	dir  string
+	next http.RoundTripper
+}
+
+func NewTransport(mode string, dir string, next http.RoundTripper) (*Transport, error) {
+	if mode != Record && mode != Replay {
+		return nil, fmt.Errorf("Unknown fixtures mode %s, expected %s or %s", mode, Record, Replay)
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if mode == Record {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &Transport{mode: mode, dir: dir, next: next}, nil
+}
+
+// HTTP client using transport, to be given to ethclient and binance
+func (t *Transport) Client() *http.Client {
+	return &http.Client{Transport: t}
+}
+
+func (t *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	var body []byte
+	if request.Body != nil {
+		var err error
+		body, err = io.ReadAll(request.Body)
+		request.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	normalized, ids := stripIds(body)
+	path := filepath.Join(t.dir, fixtureName(request, normalized))
+	if t.mode == Replay {
+		return t.replay(request, path, ids)
+	}
+	return t.record(request, path, normalized)
+}
+
+func (t *Transport) replay(request *http.Request, path string, ids []json.RawMessage) (*http.Response, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s %s", ErrNoFixture, request.Method, request.URL.Redacted())
+	}
+	if err != nil {
+		return nil, err
+	}
+	var fixture Fixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("Malformed fixture %s: %w", path, err)
+	}
+	responseBody := []byte(fixture.ResponseText)
+	if len(fixture.Response) > 0 {
+		responseBody = restoreIds(fixture.Response, ids)
+	}
+	return &http.Response{
+		Status:        http.StatusText(fixture.Status),
+		StatusCode:    fixture.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{fixture.ContentType}},
+		Body:          io.NopCloser(bytes.NewReader(responseBody)),
+		ContentLength: int64(len(responseBody)),
+		Request:       request,
+	}, nil
+}
+
+func (t *Transport) record(request *http.Request, path string, normalized []byte) (*http.Response, error) {
+	response, err := t.next.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	responseBody, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	response.Body = io.NopCloser(bytes.NewReader(responseBody))
+	fixture := Fixture{
+		Method:      request.Method,
+		Host:        request.URL.Host,
+		Status:      response.StatusCode,
+		ContentType: response.Header.Get("Content-Type"),
+	}
+	if json.Valid(normalized) && len(normalized) > 0 {
+		fixture.Request = normalized
+	}
+	if stripped, _ := stripIds(responseBody); json.Valid(stripped) && len(stripped) > 0 {
+		fixture.Response = orderByIds(responseBody, request)
+	} else {
+		fixture.ResponseText = string(responseBody)
+	}
+	data, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		slog.Warn(fmt.Sprintf("Cannot save fixture %s: %s", path, err.Error()))
+	}
+	return response, nil
+}
+
+// Fixture file is named by hash of method, URL and request body without ids. URL may contain API key, so it is not saved as is.
+// JSON RPC requests are answered the same by every provider, so their fixtures are named regardless of URL:
+// replay then succeeds with whichever URL the pool routes the request to
+func fixtureName(request *http.Request, normalized []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(request.Method))
+	if isJSONRPC(normalized) {
+		hash.Write(normalized)
+		return fmt.Sprintf("jsonrpc-%s.json", hex.EncodeToString(hash.Sum(nil))[:24])
+	}
+	hash.Write([]byte(request.URL.String()))
+	hash.Write(normalized)
+	host := strings.NewReplacer(":", "_", "/", "_").Replace(request.URL.Host)
+	return fmt.Sprintf("%s-%s.json", host, hex.EncodeToString(hash.Sum(nil))[:24])
+}
+
+// Whether body is JSON RPC request or batch of them
+func isJSONRPC(body []byte) bool {
+	type message struct {
+		Version string `json:"jsonrpc"`
+	}
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var batch []message
+		return json.Unmarshal(trimmed, &batch) == nil && len(batch) > 0 && batch[0].Version != ""
+	}
+	var single message
+	return json.Unmarshal(trimmed, &single) == nil && single.Version != ""
+}
+
+// Removes ids of JSON RPC request or batch. Returns body without ids and ids in order of messages
+func stripIds(body []byte) ([]byte, []json.RawMessage) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return body, nil
+	}
+	if trimmed[0] == '[' {
+		var batch []map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &batch); err != nil {
+			return body, nil
+		}
+		ids := make([]json.RawMessage, len(batch))
+		for i, message := range batch {
+			ids[i] = message["id"]
+			delete(message, "id")
+		}
+		normalized, _ := json.Marshal(batch)
+		return normalized, ids
+	}
+	var message map[string]json.RawMessage
+	if err := json.Unmarshal(trimmed, &message); err != nil {
+		return body, nil
+	}
+	id := message["id"]
+	delete(message, "id")
+	normalized, _ := json.Marshal(message)
+	return normalized, []json.RawMessage{id}
+}
+
+// Batch responses may come in any order, they are saved in order of requests with ids removed
+func orderByIds(responseBody []byte, request *http.Request) json.RawMessage {
+	stripped, _ := stripIds(responseBody)
+	trimmed := bytes.TrimSpace(responseBody)
+	if len(trimmed) == 0 || trimmed[0] != '[' || request.GetBody == nil {
+		return stripped
+	}
+	requestBody, err := request.GetBody()
+	if err != nil {
+		return stripped
+	}
+	defer requestBody.Close()
+	data, err := io.ReadAll(requestBody)
+	if err != nil {
+		return stripped
+	}
+	_, requestIds := stripIds(data)
+	var responses []map[string]json.RawMessage
+	if err := json.Unmarshal(trimmed, &responses); err != nil {
+		return stripped
+	}
+	byId := make(map[string]map[string]json.RawMessage, len(responses))
+	for _, response := range responses {
+		byId[string(response["id"])] = response
+		delete(response, "id")
+	}
+	ordered := make([]map[string]json.RawMessage, 0, len(requestIds))
+	for _, id := range requestIds {
+		if response, ok := byId[string(id)]; ok {
+			ordered = append(ordered, response)
+		}
+	}
+	if len(ordered) != len(responses) {
+		return stripped
+	}
+	result, _ := json.Marshal(ordered)
+	return result
+}
+
+// Puts ids of replayed request into saved response, in order of batch messages
+func restoreIds(response json.RawMessage, ids []json.RawMessage) []byte {
+	if len(ids) == 0 {
+		return response
+	}
+	trimmed := bytes.TrimSpace(response)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var batch []map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &batch); err != nil {
+			return response
+		}
+		for i := range batch {
+			if i < len(ids) && ids[i] != nil {
+				batch[i]["id"] = ids[i]
+			}
+		}
+		result, _ := json.Marshal(batch)
+		return result
+	}
+	var message map[string]json.RawMessage
+	if err := json.Unmarshal(trimmed, &message); err != nil || ids[0] == nil {
+		return response
+	}
+	message["id"] = ids[0]
+	result, _ := json.Marshal(message)
+	return result
+}
@@ -0,0 +1,170 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Node answering eth_getBalance with the last digit of address, counting requests which reach it
+func fakeNode(t *testing.T, hits *atomic.Int32) *httptest.Server {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Cannot read request: %s", err.Error())
+		}
+		type message struct {
+			Id     json.RawMessage `json:"id"`
+			Params []string        `json:"params"`
+		}
+		answer := func(request message) string {
+			address := request.Params[0]
+			return fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":"0x%c"}`, request.Id, address[len(address)-1])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		var batch []message
+		if json.Unmarshal(body, &batch) == nil {
+			// answered in reverse order, as providers may do
+			fmt.Fprint(w, "[")
+			for i := len(batch) - 1; i >= 0; i-- {
+				fmt.Fprint(w, answer(batch[i]))
+				if i > 0 {
+					fmt.Fprint(w, ",")
+				}
+			}
+			fmt.Fprint(w, "]")
+			return
+		}
+		var single message
+		if err := json.Unmarshal(body, &single); err != nil {
+			t.Errorf("Malformed request %s", body)
+		}
+		fmt.Fprint(w, answer(single))
+	}))
+	t.Cleanup(node.Close)
+	return node
+}
+
+func balances(ctx context.Context, client *rpc.Client) ([]string, error) {
+	var single string
+	err := client.CallContext(ctx, &single, "eth_getBalance", "0x0000000000000000000000000000000000000001", "latest")
+	if err != nil {
+		return nil, err
+	}
+	batched := make([]string, 2)
+	elems := []rpc.BatchElem{
+		{Method: "eth_getBalance", Args: []any{"0x0000000000000000000000000000000000000002", "latest"}, Result: &batched[0]},
+		{Method: "eth_getBalance", Args: []any{"0x0000000000000000000000000000000000000003", "latest"}, Result: &batched[1]},
+	}
+	err = client.BatchCallContext(ctx, elems)
+	if err != nil {
+		return nil, err
+	}
+	for _, elem := range elems {
+		if elem.Error != nil {
+			return nil, elem.Error
+		}
+	}
+	return append([]string{single}, batched...), nil
+}
+
+func dial(t *testing.T, url string, transport *Transport) *rpc.Client {
+	client, err := rpc.DialOptions(context.Background(), url, rpc.WithHTTPClient(transport.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+// Responses recorded from one provider are replayed for another one without touching network
+func TestRecordReplayRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	var hits atomic.Int32
+	node := fakeNode(t, &hits)
+
+	recorder, err := NewTransport(Record, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := balances(ctx, dial(t, node.URL, recorder))
+	if err != nil {
+		t.Fatalf("Cannot record: %s", err.Error())
+	}
+	recordedHits := hits.Load()
+
+	player, err := NewTransport(Replay, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := balances(ctx, dial(t, "https://another-provider.invalid/rpc", player))
+	if err != nil {
+		t.Fatalf("Cannot replay: %s", err.Error())
+	}
+	if hits.Load() != recordedHits {
+		t.Errorf("Replay sent %d requests to node", hits.Load()-recordedHits)
+	}
+	expected := []string{"0x1", "0x2", "0x3"}
+	for i := range expected {
+		if recorded[i] != expected[i] || replayed[i] != expected[i] {
+			t.Errorf("Balance %d is recorded as %s and replayed as %s, expected %s", i, recorded[i], replayed[i], expected[i])
+		}
+	}
+
+	var missing string
+	err = dial(t, node.URL, player).CallContext(ctx, &missing, "eth_getBalance", "0x0000000000000000000000000000000000000004", "latest")
+	if !errors.Is(err, ErrNoFixture) {
+		t.Errorf("Request without fixture failed with %v, expected %v", err, ErrNoFixture)
+	}
+}
+
+// Requests other than JSON RPC, e.g. of Binance, are told apart by URL
+func TestReplayMatchesURLOfPlainRequests(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"symbol":%q}`, r.URL.Query().Get("symbol"))
+	}))
+	t.Cleanup(server.Close)
+	get := func(client *http.Client, symbol string) (string, error) {
+		response, err := client.Get(server.URL + "/api/v3/klines?symbol=" + symbol)
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		return string(body), err
+	}
+	recorder, err := NewTransport(Record, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, symbol := range []string{"ETHUSDT", "BTCUSDT"} {
+		if _, err := get(recorder.Client(), symbol); err != nil {
+			t.Fatal(err)
+		}
+	}
+	player, err := NewTransport(Replay, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, symbol := range []string{"ETHUSDT", "BTCUSDT"} {
+		body, err := get(player.Client(), symbol)
+		if err != nil {
+			t.Fatalf("Cannot replay %s: %s", symbol, err.Error())
+		}
+		var replayed struct{ Symbol string }
+		if err := json.Unmarshal([]byte(body), &replayed); err != nil || replayed.Symbol != symbol {
+			t.Errorf("Replayed %s for %s", body, symbol)
+		}
+	}
+}
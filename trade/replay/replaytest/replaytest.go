@@ -0,0 +1,140 @@
+// Helpers of tests running handlers against JSON RPC fixtures recorded from real chains
+package replaytest
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/prices"
+	"github.com/stryukovsky/go-backend-learn/trade/replay"
+	"github.com/stryukovsky/go-backend-learn/trade/web3client"
+)
+
+// Environment variable with URL of archive node. When it is set, tests send their requests there and save them as fixtures
+// along with golden files of results, e.g.
+//
+//	RECORD_FIXTURES=https://arb1.arbitrum.io/rpc go test ./trade/protocols/...
+const RecordEnv = "RECORD_FIXTURES"
+
+// URL replayed requests are sent to, fixtures of JSON RPC requests do not depend on URL
+const replayURL = "https://replay.invalid/rpc"
+
+// Whether tests record fixtures instead of replaying them
+func Recording() bool {
+	return os.Getenv(RecordEnv) != ""
+}
+
+// Client whose requests are answered with fixtures of dir, or recorded to dir in record mode. Test without fixtures is skipped.
+// Transport, pool of endpoints and known logs spans of process are replaced for the test and restored after it,
+// so limits and block range errors of fixtures do not leak to other tests
+func Client(t *testing.T, dir string) *web3client.MultiURLClient {
+	t.Helper()
+	mode, url := replay.Replay, replayURL
+	if Recording() {
+		mode, url = replay.Record, os.Getenv(RecordEnv)
+	} else if _, err := os.Stat(dir); os.IsNotExist(err) {
+		t.Skipf("No fixtures in %s, record them with %s=<archive node URL> go test -run '^%s$'", dir, RecordEnv, t.Name())
+	}
+	transport, err := replay.NewTransport(mode, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpClient, pool, spans := web3client.HTTPClient, web3client.SharedPool, trade.KnownLogsSpans
+	t.Cleanup(func() {
+		web3client.HTTPClient, web3client.SharedPool, trade.KnownLogsSpans = httpClient, pool, spans
+	})
+	web3client.HTTPClient = transport.Client()
+	web3client.SharedPool = web3client.NewPool()
+	trade.KnownLogsSpans = trade.NewLogsSpans()
+	client, err := web3client.NewMultiURLClient([]string{url}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// Compares value encoded to JSON with golden file, golden file is written instead in record mode
+func Golden(t *testing.T, path string, value any) {
+	t.Helper()
+	actual, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Recording() {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, append(actual, '\n'), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Cannot read golden file, record fixtures again: %s", err.Error())
+	}
+	var expectedValue, actualValue any
+	if err := json.Unmarshal(expected, &expectedValue); err != nil {
+		t.Fatalf("Malformed golden file %s: %s", path, err.Error())
+	}
+	if err := json.Unmarshal(actual, &actualValue); err != nil {
+		t.Fatal(err)
+	}
+	expected, _ = json.Marshal(expectedValue)
+	actual, _ = json.Marshal(actualValue)
+	if string(expected) != string(actual) {
+		t.Errorf("Result differs from golden file %s\nexpected: %s\nactual:   %s", path, expected, actual)
+	}
+}
+
+// Cache of handlers under test. Block timestamps are read from headers, so they come from fixtures too;
+// every token costs Price, so volumes in USD are checked without Binance and Chainlink
+type Cache struct {
+	Client *web3client.MultiURLClient
+	Price  *big.Rat
+}
+
+func NewCache(client *web3client.MultiURLClient) *Cache {
+	return &Cache{Client: client, Price: big.NewRat(2, 1)}
+}
+
+func (c *Cache) GetCachedBlockTimestamps(ctx context.Context, blocks []uint64) (trade.BlockTimestamps, error) {
+	headers, err := c.Client.BlockHeaders(ctx, blocks)
+	if err != nil {
+		return nil, err
+	}
+	result := make(trade.BlockTimestamps, len(headers))
+	for _, header := range headers {
+		// UTC keeps golden files independent of time zone of machine
+		result[uint64(header.Number)] = time.Unix(int64(header.Time), 0).UTC()
+	}
+	return result, nil
+}
+
+func (c *Cache) GetCachedTokenPrice(ctx context.Context, token trade.Token, at prices.Moment) (*prices.Quote, error) {
+	return &prices.Quote{Price: c.Price, Source: "fixture"}, nil
+}
+
+// Events sorted by transaction and log index, since handlers parse them concurrently. Test fails on event found twice
+func Sorted[Event interface{ Key() trade.EventKey }](t *testing.T, events []Event) []Event {
+	t.Helper()
+	sorted := slices.Clone(events)
+	slices.SortFunc(sorted, func(a, b Event) int {
+		return cmp.Or(strings.Compare(a.Key().TxId, b.Key().TxId), cmp.Compare(a.Key().LogIndex, b.Key().LogIndex))
+	})
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].Key() == sorted[i-1].Key() {
+			t.Errorf("Event %s:%d is found twice", sorted[i].Key().TxId, sorted[i].Key().LogIndex)
+		}
+	}
+	return sorted
+}
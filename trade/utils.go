@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"log/slog"
 	"math/rand"
+	"time"
 
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/samber/lo"
-	"github.com/samber/lo/mutable"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -15,6 +17,35 @@ func RandomChoice[T any](slice []T) T {
 	return slice[rand.Intn(len(slice))]
 }
 
+// Sleeps for duration unless context is done earlier, in which case context error is returned
+func Sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Context of contract call options, generated bindings accept nil options
+func CallContext(opts *bind.CallOpts) context.Context {
+	if opts == nil || opts.Context == nil {
+		return context.Background()
+	}
+	return opts.Context
+}
+
+// Set of addresses for membership checks of decoded event participants
+func AddressSet(addresses []string) map[common.Address]bool {
+	result := make(map[common.Address]bool, len(addresses))
+	for _, address := range addresses {
+		result[common.HexToAddress(address)] = true
+	}
+	return result
+}
+
 func Chunks[T any](slice []T, chunksCount int) [][]T {
 	chunkSize := len(slice) / chunksCount
 	if chunkSize == 0 {
@@ -32,6 +63,7 @@ type ParallelEVMParserTask[ParsedEvent any] struct {
 }
 
 func ParseEVMEvents[RawEvent, ParsedEvent any](
+	ctx context.Context,
 	parallelFactor int,
 	workerName string,
 	chainId string,
@@ -43,7 +75,7 @@ func ParseEVMEvents[RawEvent, ParsedEvent any](
 	}
 	eventChunks := Chunks(events, parallelFactor)
 	valuesCh := make(chan ParsedEvent, len(events))
-	wg, ctx := errgroup.WithContext(context.Background())
+	wg, ctx := errgroup.WithContext(ctx)
 	task := ParallelEVMParserTask[ParsedEvent]{
 		ParallelFactor: parallelFactor,
 		WorkerName:     workerName,
@@ -59,7 +91,13 @@ func ParseEVMEvents[RawEvent, ParsedEvent any](
 					return ctx.Err()
 				default:
 					if err := parseFn(task, generalEvent); err != nil {
-						return err
+						failures := logFailuresOf(ctx)
+						log, ok := RawLog(generalEvent)
+						if failures == nil || !ok || ctx.Err() != nil {
+							return err
+						}
+						slog.Warn(fmt.Sprintf("[%s] Cannot parse log %d of tx %s, set it aside: %s", workerName, log.Index, log.TxHash.Hex(), err.Error()))
+						failures.add(log, err)
 					}
 				}
 			}
@@ -81,42 +119,3 @@ func ParseEVMEvents[RawEvent, ParsedEvent any](
 	}
 	return result, nil
 }
-
-type WithURL interface {
-	URL() string
-}
-
-func RetryEthCall[CallerPtr WithURL, R any](listCallers func() []CallerPtr, call func(CallerPtr) (R, error)) (R, error) {
-	originalCallers := listCallers()
-	shuffledCallers := make([]CallerPtr, len(originalCallers))
-	copy(shuffledCallers, originalCallers)
-	mutable.Shuffle(shuffledCallers)
-	var zero R
-	if len(shuffledCallers) == 0 {
-		return zero, fmt.Errorf("No callers provided")
-	}
-	// firstly attempt random client
-
-	firstAttemptCaller := RandomChoice(shuffledCallers)
-	result, err := call(firstAttemptCaller)
-	if err == nil {
-		// skip any next attempts of calling
-		return result, err
-	}
-	for _, client := range shuffledCallers {
-		r, e := call(client)
-		result = r
-		err = e
-		if e != nil {
-			slog.Warn(fmt.Sprintf("Client with url %s failed to get  %s", client.URL(), err.Error()))
-		} else {
-			err = nil
-			// finally get value; leave the cycle
-			break
-		}
-	}
-	if err != nil {
-		return zero, fmt.Errorf("All clients could not perform call")
-	}
-	return result, nil
-}
@@ -0,0 +1,350 @@
+package web3client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/samber/lo/mutable"
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/metrics"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// Weight of the latest call in moving averages of latency and error rate
+	healthSmoothing = 0.2
+	// Consecutive failures opening circuit of endpoint
+	failuresToOpen = 3
+	// Open circuit time is doubled on every consecutive trip up to the max one
+	minOpenDuration = 15 * time.Second
+	maxOpenDuration = 5 * time.Minute
+	// Latency added to score of endpoint failing every call, so slow but working endpoints win over failing ones
+	errorPenalty = 5 * time.Second
+	// JSON RPC error code used by providers for exceeded request limits
+	limitExceededCode = -32005
+	// JSON RPC error code of reverted eth_call
+	executionRevertedCode = 3
+)
+
+var ErrCircuitsOpen = errors.New("Circuits of all JSON RPC URLs are open")
+
+// Health of a single JSON RPC URL
+type endpoint struct {
+	latency   time.Duration
+	errorRate float64
+	failures  int
+	trips     int
+	// Zero when circuit is closed. Once passed, circuit is half-open and lets a single probe call through
+	openUntil time.Time
+	probing   bool
+	// Limits of provider; nil limiter and slots mean no limit
+	limit   trade.RpcLimit
+	limiter *rate.Limiter
+	slots   chan struct{}
+}
+
+func (e *endpoint) score() float64 {
+	return e.latency.Seconds() + e.errorRate*errorPenalty.Seconds()
+}
+
+// Whether call to endpoint would have to wait for its limits
+func (e *endpoint) busy() bool {
+	if e.slots != nil && len(e.slots) == cap(e.slots) {
+		return true
+	}
+	return e.limiter != nil && e.limiter.Tokens() < 1
+}
+
+// Health of JSON RPC URLs shared by all clients of process, so endpoint found dead by one handler is avoided by others
+type Pool struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpoint
+}
+
+func NewPool() *Pool {
+	return &Pool{endpoints: make(map[string]*endpoint)}
+}
+
+var SharedPool = NewPool()
+
+func (p *Pool) endpoint(url string) *endpoint {
+	e, ok := p.endpoints[url]
+	if !ok {
+		e = &endpoint{}
+		p.endpoints[url] = e
+	}
+	return e
+}
+
+// Applies limits of providers to their URLs. URLs without given limits keep the ones set before
+func (p *Pool) SetLimits(limits trade.RpcLimits) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for url, limit := range limits {
+		e := p.endpoint(url)
+		if e.limit == limit {
+			continue
+		}
+		e.limit = limit
+		e.limiter = nil
+		if limit.RequestsPerSecond > 0 {
+			e.limiter = rate.NewLimiter(rate.Limit(limit.RequestsPerSecond), max(1, int(math.Ceil(limit.RequestsPerSecond))))
+		}
+		// calls holding slots of replaced channel free them there
+		e.slots = nil
+		if limit.MaxConcurrency > 0 {
+			e.slots = make(chan struct{}, limit.MaxConcurrency)
+		}
+	}
+}
+
+// Orders URLs from the healthiest one, URLs which can be called without waiting for their limits go first.
+// URLs with open circuit are left out; equally healthy URLs are shuffled to spread load
+func (p *Pool) route(urls []string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	available := make([]string, 0, len(urls))
+	for _, url := range urls {
+		e := p.endpoint(url)
+		if !e.openUntil.IsZero() && (now.Before(e.openUntil) || e.probing) {
+			continue
+		}
+		available = append(available, url)
+	}
+	mutable.Shuffle(available)
+	sort.SliceStable(available, func(i, j int) bool {
+		left, right := p.endpoints[available[i]], p.endpoints[available[j]]
+		if left.busy() != right.busy() {
+			return right.busy()
+		}
+		return left.score() < right.score()
+	})
+	return available
+}
+
+// Reserves call to URL. Call through half-open circuit becomes its only probe; false means circuit is open
+func (p *Pool) acquire(url string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.endpoint(url)
+	if e.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(e.openUntil) || e.probing {
+		return false
+	}
+	e.probing = true
+	return true
+}
+
+// Waits until call to URL fits into its requests per second and concurrency limits.
+// Returned function frees concurrency slot once call is done
+func (p *Pool) wait(ctx context.Context, url string) (func(), error) {
+	p.mu.Lock()
+	e := p.endpoint(url)
+	limiter, slots := e.limiter, e.slots
+	p.mu.Unlock()
+	release := func() {}
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+			release = func() { <-slots }
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if limiter != nil {
+		if err := limiter.Wait(ctx); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
+
+// Limits of HTTP URLs are applied to every request by their transport, since a single call may send many of them,
+// e.g. bisected eth_getLogs
+func limitedPerRequest(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+// Transport waiting for limits of provider before each request to its URL
+type limitedTransport struct {
+	url  string
+	next http.RoundTripper
+}
+
+func (t *limitedTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	done, err := SharedPool.wait(request.Context(), t.url)
+	if err != nil {
+		return nil, err
+	}
+	response, err := t.next.RoundTrip(request)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	// concurrency slot is held until response is read
+	response.Body = &releasingBody{ReadCloser: response.Body, release: sync.OnceFunc(done)}
+	return response, nil
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
+
+// Copy of client sending requests to URL within limits of its provider
+func limitedHTTPClient(client *http.Client, url string) *http.Client {
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	limited := *client
+	limited.Transport = &limitedTransport{url: url, next: next}
+	return &limited
+}
+
+// Gives up reservation of call whose outcome does not tell anything about health of URL
+func (p *Pool) release(url string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endpoint(url).probing = false
+}
+
+// Updates health of URL with outcome of a call
+func (p *Pool) record(url string, latency time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.endpoint(url)
+	e.probing = false
+	if err == nil {
+		e.latency = time.Duration(healthSmoothing*float64(latency) + (1-healthSmoothing)*float64(e.latency))
+		e.errorRate = (1 - healthSmoothing) * e.errorRate
+		e.failures = 0
+		if !e.openUntil.IsZero() {
+			slog.Info(fmt.Sprintf("Circuit of JSON RPC %s is closed", url))
+			e.openUntil = time.Time{}
+			e.trips = 0
+			metrics.RPCCircuit(url, false)
+		}
+		return
+	}
+	e.errorRate = healthSmoothing + (1-healthSmoothing)*e.errorRate
+	e.failures++
+	rateLimited := isRateLimited(err)
+	if rateLimited {
+		metrics.RPCRateLimited(url)
+	}
+	// rate limit opens circuit at once: calls sent meanwhile only prolong the limit
+	if rateLimited || e.failures >= failuresToOpen || !e.openUntil.IsZero() {
+		openFor := time.Duration(float64(minOpenDuration) * math.Pow(2, float64(e.trips)))
+		openFor = min(openFor, maxOpenDuration)
+		e.trips++
+		e.openUntil = time.Now().Add(openFor)
+		slog.Warn(fmt.Sprintf("Circuit of JSON RPC %s is open for %s after %d failures: %s", url, openFor, e.failures, err.Error()))
+		metrics.RPCCircuit(url, true)
+	}
+}
+
+func isRateLimited(err error) bool {
+	var httpErr rpc.HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == limitExceededCode {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "rate limit") || strings.Contains(message, "too many requests")
+}
+
+// Reverted call is a valid answer of healthy endpoint, every other endpoint answers the same
+func IsReverted(err error) bool {
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == executionRevertedCode {
+		return true
+	}
+	return strings.Contains(err.Error(), "execution reverted")
+}
+
+type WithURL interface {
+	URL() string
+}
+
+// Calls JSON RPC method with the healthiest caller, then with the next ones until one succeeds.
+// Callers with open circuit are skipped, reverted calls are not retried. HTTP requests wait for limits of provider one by one,
+// calls over other transports wait once per attempt.
+// Every attempt updates health of caller URL and is recorded in metrics by URL and method
+func RetryEthCall[CallerPtr WithURL, R any](ctx context.Context, method string, listCallers func() []CallerPtr, call func(CallerPtr) (R, error)) (R, error) {
+	var zero R
+	callers := listCallers()
+	if len(callers) == 0 {
+		return zero, fmt.Errorf("No callers provided")
+	}
+	byURL := make(map[string]CallerPtr, len(callers))
+	urls := make([]string, 0, len(callers))
+	for _, caller := range callers {
+		byURL[caller.URL()] = caller
+		urls = append(urls, caller.URL())
+	}
+	var lastErr error = ErrCircuitsOpen
+	for _, url := range SharedPool.route(urls) {
+		// cancelled call fails on every client, so there is no point to try them
+		if err := ctx.Err(); err != nil {
+			return zero, err
+		}
+		if !SharedPool.acquire(url) {
+			continue
+		}
+		done := func() {}
+		if !limitedPerRequest(url) {
+			var err error
+			done, err = SharedPool.wait(ctx, url)
+			if err != nil {
+				SharedPool.release(url)
+				return zero, err
+			}
+		}
+		started := time.Now()
+		result, err := call(byURL[url])
+		done()
+		metrics.ObserveRPC(url, method, started, err)
+		if ctx.Err() != nil {
+			// failure caused by cancellation says nothing about endpoint
+			SharedPool.release(url)
+			return zero, ctx.Err()
+		}
+		if err != nil && IsReverted(err) {
+			SharedPool.record(url, time.Since(started), nil)
+			return zero, err
+		}
+		SharedPool.record(url, time.Since(started), err)
+		if err == nil {
+			return result, nil
+		}
+		slog.Warn(fmt.Sprintf("Client with url %s failed to get %s: %s", url, method, err.Error()))
+		lastErr = err
+	}
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	return zero, fmt.Errorf("All clients could not perform %s: %w", method, lastErr)
+}
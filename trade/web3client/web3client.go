@@ -5,11 +5,21 @@ import (
 	"fmt"
 	"log/slog"
 	"math/big"
+	"net/http"
+	"slices"
 
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/stryukovsky/go-backend-learn/trade"
 )
 
+// HTTP client of JSON RPC calls, replaced to record or replay fixtures
+var HTTPClient = http.DefaultClient
+
 type ClientWithURL struct {
 	Client *ethclient.Client
 	Url    string
@@ -21,14 +31,16 @@ type MultiURLClient struct {
 	clients []*ClientWithURL
 }
 
-func NewMultiURLClient(urls []string) (*MultiURLClient, error) {
+// Client calling given URLs through the shared pool, limits of providers are applied to the pool
+func NewMultiURLClient(urls []string, limits trade.RpcLimits) (*MultiURLClient, error) {
+	SharedPool.SetLimits(limits)
 	clients := make([]*ClientWithURL, 0, len(urls))
 	for _, url := range urls {
-		client, err := ethclient.Dial(url)
+		client, err := rpc.DialOptions(context.Background(), url, rpc.WithHTTPClient(limitedHTTPClient(HTTPClient, url)))
 		if err != nil {
 			slog.Warn(fmt.Sprintf("Failed to connect to JSON RPC %s: %v", url, err))
 		} else {
-			clients = append(clients, &ClientWithURL{Client: client, Url: url})
+			clients = append(clients, &ClientWithURL{Client: ethclient.NewClient(client), Url: url})
 		}
 	}
 	if len(clients) == 0 {
@@ -37,20 +49,129 @@ func NewMultiURLClient(urls []string) (*MultiURLClient, error) {
 	return &MultiURLClient{clients}, nil
 }
 
-func (c *MultiURLClient) ChainID() (*big.Int, error) {
-	return trade.RetryEthCall(
+func (c *MultiURLClient) ChainID(ctx context.Context) (*big.Int, error) {
+	return RetryEthCall(
+		ctx,
+		"eth_chainId",
+		func() []*ClientWithURL { return c.clients },
+		func(client *ClientWithURL) (*big.Int, error) { return client.Client.ChainID(ctx) })
+}
+
+func (c *MultiURLClient) BlockNumber(ctx context.Context) (uint64, error) {
+	return RetryEthCall(
+		ctx,
+		"eth_blockNumber",
 		func() []*ClientWithURL { return c.clients },
-		func(client *ClientWithURL) (*big.Int, error) { return client.Client.ChainID(context.Background()) })
+		func(client *ClientWithURL) (uint64, error) { return client.Client.BlockNumber(ctx) })
 }
 
-func (c *MultiURLClient) BlockNumber() (uint64, error) {
-	return trade.RetryEthCall(
+func (c *MultiURLClient) HeaderByNumber(ctx context.Context, number uint64) (*types.Header, error) {
+	return RetryEthCall(
+		ctx,
+		"eth_getBlockByNumber",
 		func() []*ClientWithURL { return c.clients },
-		func(client *ClientWithURL) (uint64, error) { return client.Client.BlockNumber(context.Background()) })
+		func(client *ClientWithURL) (*types.Header, error) {
+			return client.Client.HeaderByNumber(ctx, new(big.Int).SetUint64(number))
+		})
+}
+
+// Header of block referenced by tag such as safe or finalized one
+func (c *MultiURLClient) HeaderByTag(ctx context.Context, tag rpc.BlockNumber) (*types.Header, error) {
+	return RetryEthCall(
+		ctx,
+		"eth_getBlockByNumber",
+		func() []*ClientWithURL { return c.clients },
+		func(client *ClientWithURL) (*types.Header, error) {
+			return client.Client.HeaderByNumber(ctx, big.NewInt(tag.Int64()))
+		})
+}
+
+// Calls contract method packed in msg at block, nil block means the latest one
+func (c *MultiURLClient) CallContract(ctx context.Context, msg ethereum.CallMsg, block *big.Int) ([]byte, error) {
+	return RetryEthCall(
+		ctx,
+		"eth_call",
+		func() []*ClientWithURL { return c.clients },
+		func(client *ClientWithURL) ([]byte, error) { return client.Client.CallContract(ctx, msg, block) })
+}
+
+// Blocks requested in a single JSON RPC batch
+const blocksBatchSize = 100
+
+// Fields of block header needed to store block, chain specific fields of header are not decoded
+type BlockHeader struct {
+	Number     hexutil.Uint64 `json:"number"`
+	Hash       common.Hash    `json:"hash"`
+	ParentHash common.Hash    `json:"parentHash"`
+	Time       hexutil.Uint64 `json:"timestamp"`
+}
+
+// Headers of blocks fetched with batched eth_getBlockByNumber, one round trip per batch of blocks
+func (c *MultiURLClient) BlockHeaders(ctx context.Context, blocks []uint64) ([]BlockHeader, error) {
+	result := make([]BlockHeader, 0, len(blocks))
+	for batch := range slices.Chunk(blocks, blocksBatchSize) {
+		headers, err := RetryEthCall(
+			ctx,
+			"eth_getBlockByNumber",
+			func() []*ClientWithURL { return c.clients },
+			func(client *ClientWithURL) ([]BlockHeader, error) { return batchBlockHeaders(ctx, client, batch) })
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, headers...)
+	}
+	return result, nil
 }
 
-func (c *MultiURLClient) RandomClient() *ClientWithURL {
-	return trade.RandomChoice(c.clients)
+func batchBlockHeaders(ctx context.Context, client *ClientWithURL, blocks []uint64) ([]BlockHeader, error) {
+	headers := make([]*BlockHeader, len(blocks))
+	elems := make([]rpc.BatchElem, len(blocks))
+	for i, block := range blocks {
+		elems[i] = rpc.BatchElem{
+			Method: "eth_getBlockByNumber",
+			Args:   []any{hexutil.EncodeUint64(block), false},
+			Result: &headers[i],
+		}
+	}
+	err := client.Client.Client().BatchCallContext(ctx, elems)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]BlockHeader, len(blocks))
+	for i, elem := range elems {
+		if elem.Error != nil {
+			return nil, fmt.Errorf("Cannot get block %d: %w", blocks[i], elem.Error)
+		}
+		if headers[i] == nil || headers[i].Time == 0 {
+			return nil, fmt.Errorf("Block %d is not found", blocks[i])
+		}
+		result[i] = *headers[i]
+	}
+	return result, nil
+}
+
+// Subscribes to logs with the first URL supporting eth_subscribe, i.e. websocket or IPC one.
+// Unlike other calls it is not retried: caller is expected to fall back to polling when no subscription is possible
+func (c *MultiURLClient) SubscribeLogs(ctx context.Context, query ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, string, error) {
+	var lastErr error = fmt.Errorf("No JSON RPC URL supports subscriptions")
+	byURL := make(map[string]*ClientWithURL, len(c.clients))
+	urls := make([]string, 0, len(c.clients))
+	for _, client := range c.clients {
+		byURL[client.Url] = client
+		urls = append(urls, client.Url)
+	}
+	// URLs with open circuit are not subscribed to, polling covers them once they recover
+	for _, url := range SharedPool.route(urls) {
+		client := byURL[url]
+		sub, err := client.Client.SubscribeFilterLogs(ctx, query, ch)
+		if err != nil {
+			slog.Debug(fmt.Sprintf("Cannot subscribe to logs on %s: %s", client.Url, err.Error()))
+			lastErr = err
+			continue
+		}
+		return sub, client.Url, nil
+	}
+	return nil, "", lastErr
 }
 
 func (c *MultiURLClient) Length() int {
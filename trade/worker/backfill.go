@@ -0,0 +1,156 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/cache"
+	"github.com/stryukovsky/go-backend-learn/trade/web3client"
+	"golang.org/x/sync/errgroup"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Splits inclusive block range to consecutive shards of at most shardSize blocks
+func splitRange(fromBlock uint64, toBlock uint64, shardSize uint64) [][2]uint64 {
+	shardSize = max(shardSize, 1)
+	shards := make([][2]uint64, 0, (toBlock-fromBlock)/shardSize+1)
+	for start := fromBlock; start <= toBlock; start += shardSize {
+		end := min(start+shardSize-1, toBlock)
+		shards = append(shards, [2]uint64{start, end})
+		if end == toBlock {
+			break
+		}
+	}
+	return shards
+}
+
+// Fetches history of wallets in block range with every handler of the chain.
+// Range is split to shards processed concurrently, finished shards are persisted so interrupted backfill resumes where it stopped,
+// and checkpoints of tracked wallets are moved over them, so indexing does not fetch the range again.
+// Once ctx is done no new shards are started, shards in progress are finished or rolled back
+func Backfill(ctx context.Context, db *gorm.DB, cm *cache.CacheManager, chainId string, wallets []string, fromBlock uint64, toBlock uint64, parallelism int) error {
+	if fromBlock > toBlock {
+		return fmt.Errorf("Block range %d - %d is empty", fromBlock, toBlock)
+	}
+	if len(wallets) == 0 {
+		return fmt.Errorf("No wallets to backfill")
+	}
+	db = db.WithContext(ctx)
+	var config trade.Worker
+	err := db.First(&config, &trade.Worker{ChainId: chainId}).Error
+	if err != nil {
+		return fmt.Errorf("No worker config for chain %s: %w", chainId, err)
+	}
+	client, err := web3client.NewMultiURLClient(config.BlockchainUrlsForEvents, config.RpcLimits)
+	if err != nil {
+		return err
+	}
+	handlers, err := NewHandlerSet(ctx, db, cm, client, chainId)
+	if err != nil {
+		return err
+	}
+	runs := handlers.Runs(db, chainId)
+
+	participants := make([]string, len(wallets))
+	for i, wallet := range wallets {
+		participants[i] = common.HexToAddress(wallet).Hex()
+	}
+	ranges := splitRange(fromBlock, toBlock, config.BlocksInterval)
+	planned := make([]trade.BackfillShard, 0, len(ranges)*len(runs)*len(participants))
+	for _, wallet := range participants {
+		for handlerKey := range runs {
+			for _, r := range ranges {
+				planned = append(planned, trade.NewBackfillShard(chainId, wallet, handlerKey, r[0], r[1]))
+			}
+		}
+	}
+	err = db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&planned, 500).Error
+	if err != nil {
+		return err
+	}
+
+	var pending []trade.BackfillShard
+	err = db.Where(
+		"chain_id = ? AND wallet IN ? AND from_block >= ? AND to_block <= ? AND done = ?",
+		chainId, participants, fromBlock, toBlock, false,
+	).Order("from_block").Find(&pending).Error
+	if err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("[Backfill] %d of %d shards on chain %s are left to process", len(pending), len(planned), chainId))
+
+	// wallets sharing handler and range are fetched with single call
+	type shardKey struct {
+		handler   string
+		fromBlock uint64
+		toBlock   uint64
+	}
+	keys := make([]shardKey, 0)
+	grouped := make(map[shardKey][]trade.BackfillShard)
+	for _, shard := range pending {
+		key := shardKey{shard.Handler, shard.FromBlock, shard.ToBlock}
+		if _, ok := grouped[key]; !ok {
+			keys = append(keys, key)
+		}
+		grouped[key] = append(grouped[key], shard)
+	}
+
+	var failed atomic.Int64
+	var g errgroup.Group
+	g.SetLimit(max(parallelism, 1))
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		run, ok := runs[key.handler]
+		if !ok {
+			slog.Warn(fmt.Sprintf("[Backfill] Handler %s is not configured anymore, skip its shard %d - %d", key.handler, key.fromBlock, key.toBlock))
+			continue
+		}
+		shards := grouped[key]
+		name := handlers.Name(key.handler)
+		g.Go(func() error {
+			shardWallets := make([]string, len(shards))
+			ids := make([]uint, len(shards))
+			for i, shard := range shards {
+				shardWallets[i] = shard.Wallet
+				ids[i] = shard.ID
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			err := run(ctx, key.fromBlock, key.toBlock, shardWallets, false, func(tx *gorm.DB, failed []trade.LogFailure) error {
+				err := deadLetterLogs(tx, chainId, key.handler, shardWallets, failed)
+				if err != nil {
+					return err
+				}
+				err = tx.Model(&trade.BackfillShard{}).Where("id IN ?", ids).Update("done", true).Error
+				if err != nil {
+					return err
+				}
+				return advanceOverDoneShards(tx, chainId, key.handler, shardWallets)
+			})
+			if err != nil {
+				slog.Warn(fmt.Sprintf("[Backfill] [%s] Shard %d - %d failed: %s", name, key.fromBlock, key.toBlock, err.Error()))
+				failed.Add(int64(len(shards)))
+				return nil
+			}
+			slog.Info(fmt.Sprintf("[Backfill] [%s] Shard %d - %d of %d wallets done", name, key.fromBlock, key.toBlock, len(shards)))
+			return nil
+		})
+	}
+	g.Wait()
+	if ctx.Err() != nil {
+		return fmt.Errorf("Backfill interrupted, run it again to resume: %w", ctx.Err())
+	}
+	if failed.Load() > 0 {
+		return fmt.Errorf("%d shards failed, run backfill again to retry them", failed.Load())
+	}
+	slog.Info(fmt.Sprintf("[Backfill] Blocks %d - %d on chain %s are backfilled, events are priced by enrichment of index command", fromBlock, toBlock, chainId))
+	return nil
+}
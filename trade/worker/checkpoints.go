@@ -0,0 +1,187 @@
+package worker
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Block range fetched by handler for wallets sharing the same checkpoint
+type lane struct {
+	startBlock uint64
+	endBlock   uint64
+	wallets    []string
+	backfill   bool
+}
+
+// Last indexed block of each tracked wallet for handler. Wallets never indexed by handler start from their LastBlock.
+// Checkpoints are moved over done backfill shards contiguous from them, so lanes do not crawl these ranges again
+func loadCheckpoints(db *gorm.DB, chainId string, handler string, wallets []trade.TrackedWallet) (map[string]uint64, error) {
+	var stored []trade.Checkpoint
+	err := db.Find(&stored, &trade.Checkpoint{ChainId: chainId, Handler: handler}).Error
+	if err != nil {
+		return nil, err
+	}
+	byWallet := make(map[string]uint64, len(stored))
+	for _, checkpoint := range stored {
+		byWallet[checkpoint.Wallet] = checkpoint.LastBlock
+	}
+	result := make(map[string]uint64, len(wallets))
+	for _, wallet := range wallets {
+		lastBlock, ok := byWallet[wallet.Address]
+		if !ok {
+			lastBlock = wallet.LastBlock
+		}
+		result[wallet.Address] = lastBlock
+	}
+	if len(result) == 0 {
+		return result, nil
+	}
+	var shards []trade.BackfillShard
+	err = db.Where("chain_id = ? AND handler = ? AND done AND to_block > ?", chainId, handler, slices.Min(slices.Collect(maps.Values(result)))).
+		Order("from_block").
+		Find(&shards).Error
+	if err != nil {
+		return nil, err
+	}
+	// backfill stores wallets checksummed, tracked wallets may be stored otherwise
+	shardsByWallet := make(map[common.Address][]trade.BackfillShard)
+	for _, shard := range shards {
+		wallet := common.HexToAddress(shard.Wallet)
+		shardsByWallet[wallet] = append(shardsByWallet[wallet], shard)
+	}
+	for wallet, lastBlock := range result {
+		result[wallet] = skipDoneShards(lastBlock, shardsByWallet[common.HexToAddress(wallet)])
+	}
+	return result, nil
+}
+
+// Last block after done shards starting at or right after last block, shards are sorted by their first block
+func skipDoneShards(lastBlock uint64, shards []trade.BackfillShard) uint64 {
+	for _, shard := range shards {
+		if shard.FromBlock > lastBlock+1 {
+			break
+		}
+		lastBlock = max(lastBlock, shard.ToBlock)
+	}
+	return lastBlock
+}
+
+// Stores checkpoints of tracked wallets moved over done backfill shards. Checkpoints never go back,
+// since indexing may have passed them meanwhile
+func advanceOverDoneShards(db *gorm.DB, chainId string, handler string, wallets []string) error {
+	lowered := make([]string, len(wallets))
+	for i, wallet := range wallets {
+		lowered[i] = strings.ToLower(wallet)
+	}
+	var tracked []trade.TrackedWallet
+	err := db.Where("chain_id = ? AND LOWER(address) IN ?", chainId, lowered).Find(&tracked).Error
+	if err != nil {
+		return err
+	}
+	if len(tracked) == 0 {
+		return nil
+	}
+	lastBlocks, err := loadCheckpoints(db, chainId, handler, tracked)
+	if err != nil {
+		return err
+	}
+	checkpoints := make([]trade.Checkpoint, 0, len(lastBlocks))
+	// rows are locked in the same order by concurrent shards
+	for _, wallet := range slices.Sorted(maps.Keys(lastBlocks)) {
+		checkpoints = append(checkpoints, trade.NewCheckpoint(chainId, handler, wallet, lastBlocks[wallet]))
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "chain_id"}, {Name: "handler"}, {Name: "wallet"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"last_block": gorm.Expr("GREATEST(checkpoints.last_block, excluded.last_block)"),
+			"updated_at": gorm.Expr("excluded.updated_at"),
+		}),
+	}).Create(&checkpoints).Error
+}
+
+// Head lane moves wallets which are up to date towards chain head.
+// Backfill lane moves wallets with the oldest checkpoint towards the next checkpoint, so they join other wallets
+// without fetching again ranges which are already indexed for them
+func planLanes(checkpoints map[string]uint64, blocksInterval uint64, head uint64) []lane {
+	walletsByBlock := make(map[uint64][]string)
+	for wallet, lastBlock := range checkpoints {
+		walletsByBlock[lastBlock] = append(walletsByBlock[lastBlock], wallet)
+	}
+	blocks := make([]uint64, 0, len(walletsByBlock))
+	for block := range walletsByBlock {
+		blocks = append(blocks, block)
+	}
+	slices.Sort(blocks)
+
+	lanes := make([]lane, 0, 2)
+	if len(blocks) == 0 {
+		return lanes
+	}
+	latest := blocks[len(blocks)-1]
+	if latest < head {
+		lanes = append(lanes, lane{
+			startBlock: latest,
+			endBlock:   min(latest+blocksInterval, head),
+			wallets:    walletsByBlock[latest],
+		})
+	}
+	if len(blocks) > 1 {
+		oldest := blocks[0]
+		lanes = append(lanes, lane{
+			startBlock: oldest,
+			endBlock:   min(oldest+blocksInterval, blocks[1]),
+			wallets:    walletsByBlock[oldest],
+			backfill:   true,
+		})
+	}
+	return lanes
+}
+
+func advanceCheckpoints(db *gorm.DB, chainId string, handler string, wallets []string, lastBlock uint64) error {
+	checkpoints := make([]trade.Checkpoint, len(wallets))
+	for i, wallet := range wallets {
+		checkpoints[i] = trade.NewCheckpoint(chainId, handler, wallet, lastBlock)
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "chain_id"}, {Name: "handler"}, {Name: "wallet"}},
+		DoUpdates: clause.AssignmentColumns([]string{"last_block", "updated_at"}),
+	}).Create(&checkpoints).Error
+}
+
+// TrackedWallet.LastBlock reflects the slowest handler of the wallet
+func syncTrackedWallets(db *gorm.DB, chainId string, handlers []string, wallets []trade.TrackedWallet) error {
+	var rows []struct {
+		Wallet    string
+		LastBlock uint64
+	}
+	err := db.Model(&trade.Checkpoint{}).
+		Select("wallet, MIN(last_block) AS last_block").
+		Where("chain_id = ? AND handler IN ?", chainId, handlers).
+		Group("wallet").
+		Having("COUNT(*) = ?", len(handlers)).
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	lastBlocks := make(map[string]uint64, len(rows))
+	for _, row := range rows {
+		lastBlocks[row.Wallet] = row.LastBlock
+	}
+	for _, wallet := range wallets {
+		lastBlock, ok := lastBlocks[wallet.Address]
+		if !ok || lastBlock <= wallet.LastBlock {
+			continue
+		}
+		err = db.Model(&wallet).Update("last_block", lastBlock).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
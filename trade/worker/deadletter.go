@@ -0,0 +1,128 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"gorm.io/gorm"
+)
+
+const (
+	// Backoff of dead letter is doubled on every failed retry up to the max one
+	minRetryBackoff = time.Minute
+	maxRetryBackoff = 6 * time.Hour
+	// Dead letters retried in a single cycle, so retries do not starve regular indexing
+	deadLettersPerCycle = 20
+)
+
+func retryBackoff(attempts uint) time.Duration {
+	backoff := minRetryBackoff
+	for i := uint(1); i < attempts && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxRetryBackoff)
+}
+
+// Sets block range failed to be indexed aside
+func deadLetterRange(tx *gorm.DB, chainId string, handler string, fromBlock uint64, toBlock uint64, wallets []string, cause error) error {
+	letter := trade.NewDeadLetter(chainId, handler, trade.DeadLetterRange, fromBlock, toBlock, wallets, cause)
+	letter.NextRetryAt = time.Now().Add(retryBackoff(letter.Attempts))
+	return tx.Create(&letter).Error
+}
+
+// Sets logs failed to be parsed aside, each is retried later by indexing its block alone
+func deadLetterLogs(tx *gorm.DB, chainId string, handler string, wallets []string, failed []trade.LogFailure) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	letters := make([]trade.DeadLetter, len(failed))
+	for i, failure := range failed {
+		letter := trade.NewDeadLetter(chainId, handler, trade.DeadLetterLog, failure.Log.BlockNumber, failure.Log.BlockNumber, wallets, failure.Err)
+		letter.TxId = failure.Log.TxHash.Hex()
+		letter.LogIndex = failure.Log.Index
+		letter.NextRetryAt = time.Now().Add(retryBackoff(letter.Attempts))
+		letters[i] = letter
+	}
+	return tx.Create(&letters).Error
+}
+
+// Retries dead letters of chain whose time has come. Succeeded ones are removed, failed ones are postponed with longer backoff
+func (f *FetchEnvironment) RetryDeadLetters(ctx context.Context) error {
+	var due []trade.DeadLetter
+	err := f.db.WithContext(ctx).
+		Where("chain_id = ? AND next_retry_at <= ?", f.chainId, time.Now()).
+		Order("next_retry_at").
+		Limit(deadLettersPerCycle).
+		Find(&due).Error
+	if err != nil || len(due) == 0 {
+		return err
+	}
+	runs := f.handlers.Runs(f.db, f.chainId)
+	for _, letter := range due {
+		name := f.handlers.Name(letter.Handler)
+		run, ok := runs[letter.Handler]
+		if !ok {
+			slog.Warn(fmt.Sprintf("%s [%s] Handler of dead letter %d is not configured anymore, skip it", f.logPrefix, name, letter.ID))
+			continue
+		}
+		err := run(ctx, letter.FromBlock, letter.ToBlock, letter.Wallets, false, func(tx *gorm.DB, failed []trade.LogFailure) error {
+			if letter.Kind == trade.DeadLetterLog {
+				for _, failure := range failed {
+					if failure.Log.TxHash.Hex() == letter.TxId && failure.Log.Index == letter.LogIndex {
+						return failure.Err
+					}
+				}
+			} else {
+				err := deadLetterLogs(tx, f.chainId, letter.Handler, letter.Wallets, failed)
+				if err != nil {
+					return err
+				}
+			}
+			return tx.Delete(&letter).Error
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			attempts := letter.Attempts + 1
+			slog.Warn(fmt.Sprintf("%s [%s] Retry %d of dead letter %d failed: %s", f.logPrefix, name, attempts, letter.ID, err.Error()))
+			err = f.db.WithContext(ctx).Model(&letter).Updates(map[string]any{
+				"attempts":      attempts,
+				"error":         err.Error(),
+				"next_retry_at": time.Now().Add(retryBackoff(attempts)),
+			}).Error
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		slog.Info(fmt.Sprintf("%s [%s] Dead letter %d of blocks %d - %d is indexed", f.logPrefix, name, letter.ID, letter.FromBlock, letter.ToBlock))
+	}
+	return nil
+}
+
+// Dead letters of chain, or of all chains when chain id is empty
+func ListDeadLetters(db *gorm.DB, chainId string) ([]trade.DeadLetter, error) {
+	query := db.Order("id")
+	if chainId != "" {
+		query = query.Where("chain_id = ?", chainId)
+	}
+	var letters []trade.DeadLetter
+	err := query.Find(&letters).Error
+	return letters, err
+}
+
+// Makes dead letters due, so they are retried on the next cycle of their worker
+func RetryDeadLetters(db *gorm.DB, ids []uint) (int64, error) {
+	result := db.Model(&trade.DeadLetter{}).Where("id IN ?", ids).Update("next_retry_at", time.Now())
+	return result.RowsAffected, result.Error
+}
+
+// Drops dead letters for good, their blocks are not indexed anymore
+func DiscardDeadLetters(db *gorm.DB, ids []uint) (int64, error) {
+	result := db.Where("id IN ?", ids).Delete(&trade.DeadLetter{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,186 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/cache"
+	"github.com/stryukovsky/go-backend-learn/trade/protocols"
+	"github.com/stryukovsky/go-backend-learn/trade/web3client"
+	"gorm.io/gorm"
+)
+
+const (
+	// Delay between enrichment rounds once there is nothing to price
+	EnrichmentInterval  = 10 * time.Second
+	enrichmentBatchSize = 100
+	// Backoff of event failed to be priced is doubled on every attempt up to the max one
+	minPricingBackoff = time.Minute
+	maxPricingBackoff = 6 * time.Hour
+)
+
+// Prices a batch of due unpriced events of a single handler. Returns number of events taken from the batch
+type enrichRun func(ctx context.Context) (int, error)
+
+func addEnrichRun[BlockchainInteraction keyedEvent, FinancialInteraction any, FinancialInteractionPtr linkedInteraction[BlockchainInteraction, FinancialInteraction]](
+	runs map[string]enrichRun,
+	db *gorm.DB,
+	cm *cache.CacheManager,
+	chainId string,
+	handler protocols.DeFiProtocolHandler[BlockchainInteraction, FinancialInteraction],
+) {
+	runs[handler.Key()] = func(ctx context.Context) (int, error) {
+		var events []BlockchainInteraction
+		query := db.WithContext(ctx).Where("chain_id = ? AND unpriced AND next_pricing_at <= ?", chainId, time.Now())
+		err := handler.OwnEvents(query).Order("id").Limit(enrichmentBatchSize).Find(&events).Error
+		if err != nil || len(events) == 0 {
+			return 0, err
+		}
+		// prices of the whole batch are fetched in bulk first, so pricing events one by one mostly hits cache
+		if requester, ok := handler.(protocols.PriceRequester[BlockchainInteraction]); ok {
+			err = cm.PrefetchPrices(ctx, requester.PriceRequests(events))
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			if err != nil {
+				slog.Warn(fmt.Sprintf("[%s] Cannot prefetch prices of %d events: %s", handler.Name(), len(events), err.Error()))
+			}
+		}
+		// events are priced one by one, so single failure does not hold back the rest of batch
+		priced := make([]BlockchainInteraction, 0, len(events))
+		failed := make([]BlockchainInteraction, 0)
+		financial := make([]FinancialInteraction, 0, len(events))
+		for _, event := range events {
+			interactions, err := handler.PopulateWithFinanceInfo(ctx, []BlockchainInteraction{event})
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			if err != nil {
+				slog.Warn(fmt.Sprintf("[%s] Cannot price event %s: %s", handler.Name(), event.Key().TxId, err.Error()))
+				failed = append(failed, event)
+				continue
+			}
+			priced = append(priced, event)
+			financial = append(financial, interactions...)
+		}
+		err = db.WithContext(context.WithoutCancel(ctx)).Transaction(func(tx *gorm.DB) error {
+			if len(priced) > 0 {
+				ids, err := eventIds(tx, chainId, priced)
+				if err != nil {
+					return err
+				}
+				err = saveInteractions[BlockchainInteraction, FinancialInteraction, FinancialInteractionPtr](tx, ids, financial)
+				if err != nil {
+					return err
+				}
+				err = tx.Model(new(BlockchainInteraction)).Where("id IN ?", idsOf(ids, priced)).Update("unpriced", false).Error
+				if err != nil {
+					return err
+				}
+			}
+			if len(failed) > 0 {
+				ids, err := eventIds(tx, chainId, failed)
+				if err != nil {
+					return err
+				}
+				return tx.Model(new(BlockchainInteraction)).Where("id IN ?", idsOf(ids, failed)).Updates(map[string]any{
+					"pricing_attempts": gorm.Expr("pricing_attempts + 1"),
+					"next_pricing_at": gorm.Expr(
+						"NOW() + LEAST(? * POWER(2, pricing_attempts), ?) * INTERVAL '1 second'",
+						minPricingBackoff.Seconds(),
+						maxPricingBackoff.Seconds(),
+					),
+				}).Error
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Warn(fmt.Sprintf("[%s] Cannot save financial interactions: %s", handler.Name(), err.Error()))
+			return 0, err
+		}
+		slog.Info(fmt.Sprintf("[%s] Priced %d events, %d failed and will be retried", handler.Name(), len(priced), len(failed)))
+		return len(events), nil
+	}
+}
+
+func idsOf[Event keyedEvent](ids map[trade.EventKey]uint, events []Event) []uint {
+	result := make([]uint, 0, len(events))
+	for _, event := range events {
+		result = append(result, ids[event.Key()])
+	}
+	return result
+}
+
+// Enrichment runs of all handlers keyed by handler key
+func (s *HandlerSet) EnrichRuns(db *gorm.DB, cm *cache.CacheManager, chainId string) map[string]enrichRun {
+	runs := make(map[string]enrichRun)
+	for _, handler := range s.erc20Handlers {
+		addEnrichRun[trade.ERC20Transfer, trade.Deal](runs, db, cm, chainId, handler)
+	}
+	for _, handler := range s.aaveHandlers {
+		addEnrichRun[trade.AaveEvent, trade.AaveInteraction](runs, db, cm, chainId, handler)
+	}
+	for _, handler := range s.compoundHandlers {
+		addEnrichRun[trade.Compound3Event, trade.Compound3Interaction](runs, db, cm, chainId, handler)
+	}
+	for _, handler := range s.uniswapv3Handlers {
+		addEnrichRun[trade.UniswapV3Event, trade.UniswapV3Deal](runs, db, cm, chainId, handler)
+	}
+	return runs
+}
+
+// Creates financial interactions of stored unpriced events of worker chain until ctx is done.
+// Runs apart from indexing, so outage of price source only delays pricing while events keep being indexed
+func Enrich(ctx context.Context, db *gorm.DB, cm *cache.CacheManager, id uint, prefix string) {
+	for ctx.Err() == nil {
+		err := recovered(func() error { return enrich(ctx, db, cm, id, prefix) })
+		if ctx.Err() != nil {
+			break
+		}
+		slog.Warn(fmt.Sprintf("%s [Enrichment] Failed, restarting in %s: %s", prefix, EnrichmentInterval, err.Error()))
+		trade.Sleep(ctx, EnrichmentInterval)
+	}
+}
+
+func enrich(ctx context.Context, db *gorm.DB, cm *cache.CacheManager, id uint, prefix string) error {
+	var config trade.Worker
+	err := db.WithContext(ctx).First(&config, id).Error
+	if err != nil {
+		return fmt.Errorf("No config with id %d: %w", id, err)
+	}
+	client, err := web3client.NewMultiURLClient(config.BlockchainUrlsForEvents, config.RpcLimits)
+	if err != nil {
+		return err
+	}
+	chainId, err := client.ChainID(ctx)
+	if err != nil {
+		return err
+	}
+	for ctx.Err() == nil {
+		// handlers are rebuilt every round, so tokens and platforms added meanwhile are picked up
+		handlers, err := NewHandlerSet(ctx, db, cm, client, chainId.String())
+		if err != nil {
+			return err
+		}
+		runs := handlers.EnrichRuns(db, cm, chainId.String())
+		for {
+			processed := 0
+			for key, run := range runs {
+				count, err := run(ctx)
+				if err != nil {
+					slog.Warn(fmt.Sprintf("%s [Enrichment] [%s] Round failed: %s", prefix, handlers.Name(key), err.Error()))
+					continue
+				}
+				processed += count
+			}
+			if processed == 0 || ctx.Err() != nil {
+				break
+			}
+		}
+		trade.Sleep(ctx, EnrichmentInterval)
+	}
+	return ctx.Err()
+}
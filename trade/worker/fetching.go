@@ -2,234 +2,183 @@ package worker
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"log/slog"
-	"sync"
+	"time"
 
-	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/stryukovsky/go-backend-learn/trade"
 	"github.com/stryukovsky/go-backend-learn/trade/protocols"
+	"github.com/stryukovsky/go-backend-learn/trade/web3client"
 	"golang.org/x/sync/errgroup"
 	"gorm.io/gorm"
 )
 
+const (
+	// Attempts of a lane before its range is moved to dead letters, the backoff between them is doubled every time
+	laneAttempts   = 3
+	minLaneBackoff = 5 * time.Second
+)
+
 type FetchEnvironment struct {
-	chainId           string
-	db                *gorm.DB
-	trackedWallets    []trade.TrackedWallet
-	participants      []string
-	erc20Handlers     []protocols.DeFiProtocolHandler[trade.ERC20Transfer, trade.Deal]
-	aaveHandlers      []protocols.DeFiProtocolHandler[trade.AaveEvent, trade.AaveInteraction]
-	compoundHandlers  []protocols.DeFiProtocolHandler[trade.Compound3Event, trade.Compound3Interaction]
-	uniswapv3Handlers []protocols.DeFiProtocolHandler[trade.UniswapV3Event, trade.UniswapV3Deal]
+	chainId        string
+	db             *gorm.DB
+	trackedWallets []trade.TrackedWallet
+	blocksInterval uint64
+	handlers       *HandlerSet
+	logPrefix      string
 }
 
 func NewFetchEnvironment(
 	chainId string,
 	db *gorm.DB,
 	wallets []trade.TrackedWallet,
-	participants []string,
-	erc20Handlers []protocols.DeFiProtocolHandler[trade.ERC20Transfer, trade.Deal],
-	aaveHandlers []protocols.DeFiProtocolHandler[trade.AaveEvent, trade.AaveInteraction],
-	compoundHandlers []protocols.DeFiProtocolHandler[trade.Compound3Event, trade.Compound3Interaction],
-	uniswapv3Handlers []protocols.DeFiProtocolHandler[trade.UniswapV3Event, trade.UniswapV3Deal],
+	blocksInterval uint64,
+	handlers *HandlerSet,
+	logPrefix string,
 ) *FetchEnvironment {
 	return &FetchEnvironment{
 		chainId,
 		db,
 		wallets,
-		participants,
-		erc20Handlers,
-		aaveHandlers,
-		compoundHandlers,
-		uniswapv3Handlers,
+		blocksInterval,
+		handlers,
+		logPrefix,
 	}
 }
 
-func fetchInteractionsFromEthJSONRPC[BlockchainInteractions any, FinancialInteractions any](
+// Fetches raw events only; pricing them is left to enrichment, so price source outage does not block indexing
+func fetchEventsFromEthJSONRPC[BlockchainInteractions any, FinancialInteractions any](
+	ctx context.Context,
 	chainId string,
 	startBlock uint64,
 	endBlock uint64,
-	handlers []protocols.DeFiProtocolHandler[BlockchainInteractions, FinancialInteractions],
+	handler protocols.DeFiProtocolHandler[BlockchainInteractions, FinancialInteractions],
 	participants []string,
-) ([]FinancialInteractions, error) {
-	resultsBlockchain := make([]BlockchainInteractions, 0)
-	resultsFinancial := make([]FinancialInteractions, 0)
-	chBlockchain := make(chan BlockchainInteractions)
-	chFinancial := make(chan FinancialInteractions)
-	eg, ctx := errgroup.WithContext(context.Background())
-	for _, handler := range handlers {
-		eg.Go(func() error {
-			select {
-			case <-ctx.Done():
-				slog.Warn("Cancelled fetchInteractionsFromEthJSONRPC")
-				return ctx.Err()
-			default:
-
-				blockchainInteractions, err := handler.FetchBlockchainInteractions(
-					chainId,
-					participants,
-					startBlock,
-					endBlock,
-				)
-				if err != nil {
-					slog.Warn(fmt.Sprintf("[%s] Cannot fetch blockchain interactions: %s", handler.Name(), err.Error()))
-					return err
-				}
-				if len(blockchainInteractions) == 0 {
-					slog.Info(fmt.Sprintf("[%s] No blockchain interactions found", handler.Name()))
-					return nil
-				}
-				for _, interaction := range blockchainInteractions {
-					chBlockchain <- interaction
-				}
-
-				slog.Info(fmt.Sprintf(
-					"[%s] Found %d blockchain interactions where tracked wallets participated",
-					handler.Name(),
-					len(blockchainInteractions)))
-				financialInteractions, err := handler.PopulateWithFinanceInfo(blockchainInteractions)
-				if err != nil {
-					slog.Warn(fmt.Sprintf("[%s] Cannot fetch financial interactions: %s", handler.Name(), err.Error()))
-					return err
-				}
-				slog.Info(fmt.Sprintf("[%s] Fetched %d financial interactions for corresponding %d blockchain interactions", handler.Name(), len(financialInteractions), len(blockchainInteractions)))
-
-				for _, interaction := range financialInteractions {
-					chFinancial <- interaction
-				}
-				return nil
-			}
-		})
-	}
-
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		for value := range chBlockchain {
-			resultsBlockchain = append(resultsBlockchain, value)
-		}
-	}()
-	go func() {
-		defer wg.Done()
-		for value := range chFinancial {
-			resultsFinancial = append(resultsFinancial, value)
-		}
-	}()
-	err := eg.Wait()
-	close(chBlockchain)
-	close(chFinancial)
-	wg.Wait()
+) ([]BlockchainInteractions, error) {
+	blockchainInteractions, err := handler.FetchBlockchainInteractions(
+		ctx,
+		chainId,
+		participants,
+		startBlock,
+		endBlock,
+	)
 	if err != nil {
+		slog.Warn(fmt.Sprintf("[%s] Cannot fetch blockchain interactions: %s", handler.Name(), err.Error()))
 		return nil, err
 	}
-
-	return resultsFinancial, nil
+	if len(blockchainInteractions) == 0 {
+		slog.Info(fmt.Sprintf("[%s] No blockchain interactions found", handler.Name()))
+		return []BlockchainInteractions{}, nil
+	}
+	slog.Info(fmt.Sprintf(
+		"[%s] Found %d blockchain interactions where tracked wallets participated",
+		handler.Name(),
+		len(blockchainInteractions)))
+	return blockchainInteractions, nil
 }
 
-func saveInteractions[T any](db *gorm.DB, interactions []T, handlerName string) {
-	for _, item := range interactions {
-		err := db.Create(&item).Error
-		if err != nil {
-			var pgErr *pgconn.PgError
-			if errors.As(err, &pgErr) {
-				slog.Warn(fmt.Sprintf("[%s] Error on postgres, possibly duplicate: %v", handlerName, err))
-				// Duplicate key – ignore
-				continue
-			}
-			slog.Warn(fmt.Sprintf("[%s] Cannot save interaction: %v", handlerName, err))
+// Retries failed lane in place with backoff, so short outage of providers does not move its range to dead letters.
+// Reverted calls fail the same way on every endpoint and every attempt, so they are not retried
+func (f *FetchEnvironment) retryLane(ctx context.Context, handlerName string, l lane, run func() error) error {
+	backoff := minLaneBackoff
+	for attempt := 1; ; attempt++ {
+		err := run()
+		if err == nil || ctx.Err() != nil || attempt == laneAttempts || web3client.IsReverted(err) {
+			return err
 		}
+		slog.Warn(fmt.Sprintf(
+			"%s [%s] Blocks %d - %d failed on attempt %d of %d, retrying in %s: %s",
+			f.logPrefix, handlerName, l.startBlock, l.endBlock, attempt, laneAttempts, backoff, err.Error()))
+		trade.Sleep(ctx, backoff)
+		backoff *= 2
 	}
 }
 
-func (f *FetchEnvironment) Fetch(startBlock, endBlock uint64) {
-	type task struct {
-		name     string
-		handlers any
-		run      func() error
-	}
-
-	tasks := []task{
-		{
-			name:     "ERC20",
-			handlers: f.erc20Handlers,
-			run: func() error {
-				financial, err := fetchInteractionsFromEthJSONRPC(
-					f.chainId, startBlock, endBlock, f.erc20Handlers, f.participants)
-				if err != nil {
-					return err
-				}
-				saveInteractions(f.db, financial, "ERC20")
-				return nil
-			},
-		},
-		{
-			name:     "Aave",
-			handlers: f.aaveHandlers,
-			run: func() error {
-				financial, err := fetchInteractionsFromEthJSONRPC(
-					f.chainId, startBlock, endBlock, f.aaveHandlers, f.participants)
-				if err != nil {
-					return err
-				}
-				saveInteractions(f.db, financial, "Aave")
-				return nil
-			},
-		},
-		{
-			name:     "Compound3",
-			handlers: f.compoundHandlers,
-			run: func() error {
-				financial, err := fetchInteractionsFromEthJSONRPC(
-					f.chainId, startBlock, endBlock, f.compoundHandlers, f.participants)
-				if err != nil {
-					return err
-				}
-				saveInteractions(f.db, financial, "Compound3")
-				return nil
-			},
-		},
-		{
-			name:     "UniswapV3",
-			handlers: f.uniswapv3Handlers,
-			run: func() error {
-				financial, err := fetchInteractionsFromEthJSONRPC(
-					f.chainId, startBlock, endBlock, f.uniswapv3Handlers, f.participants)
-				if err != nil {
-					return err
-				}
-				saveInteractions(f.db, financial, "UniswapV3")
-				return nil
-			},
-		},
+// Advances all lanes of handler; each lane moves its own wallets checkpoints independently of other lanes and handlers
+func (f *FetchEnvironment) indexWithHandler(ctx context.Context, handlerKey string, run handlerRun, head uint64) error {
+	handlerName := f.handlers.Name(handlerKey)
+	checkpoints, err := loadCheckpoints(f.db.WithContext(ctx), f.chainId, handlerKey, f.trackedWallets)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("%s [%s] Cannot load checkpoints: %s", f.logPrefix, handlerName, err.Error()))
+		return err
 	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 	g, ctx := errgroup.WithContext(ctx)
-	for _, t := range tasks {
+	for _, l := range planLanes(checkpoints, f.blocksInterval, head) {
 		g.Go(func() error {
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			default:
+			if l.backfill {
+				slog.Info(fmt.Sprintf("%s [%s] Backfilling %d wallets in blocks %d - %d", f.logPrefix, handlerName, len(l.wallets), l.startBlock, l.endBlock))
 			}
-
-			if err := t.run(); err != nil {
-				slog.Warn(fmt.Sprintf("Cannot fetch interactions at task %s: %v", t.name, err))
+			err := f.retryLane(ctx, handlerName, l, func() error {
+				return run(ctx, l.startBlock, l.endBlock, l.wallets, false, func(tx *gorm.DB, failed []trade.LogFailure) error {
+					err := deadLetterLogs(tx, f.chainId, handlerKey, l.wallets, failed)
+					if err != nil {
+						return err
+					}
+					return advanceCheckpoints(tx, f.chainId, handlerKey, l.wallets, l.endBlock)
+				})
+			})
+			if err != nil && ctx.Err() == nil {
+				// range failing again and again is set aside and retried apart, so it does not block the lane
+				slog.Warn(fmt.Sprintf("%s [%s] Blocks %d - %d moved to dead letters: %s", f.logPrefix, handlerName, l.startBlock, l.endBlock, err.Error()))
+				err = f.db.WithContext(context.WithoutCancel(ctx)).Transaction(func(tx *gorm.DB) error {
+					err := deadLetterRange(tx, f.chainId, handlerKey, l.startBlock, l.endBlock, l.wallets, err)
+					if err != nil {
+						return err
+					}
+					return advanceCheckpoints(tx, f.chainId, handlerKey, l.wallets, l.endBlock)
+				})
+			}
+			if err != nil {
 				return err
 			}
+			slog.Info(fmt.Sprintf("%s [%s] Marked %d wallets as indexed on block %d", f.logPrefix, handlerName, len(l.wallets), l.endBlock))
 			return nil
 		})
 	}
+	return g.Wait()
+}
 
-	if err := g.Wait(); err == nil {
-		for i := range f.trackedWallets {
-			f.trackedWallets[i].LastBlock = endBlock
-		}
-		slog.Info(fmt.Sprintf("Successfully fetched blockchain events so mark wallets as indexed on block %d", endBlock))
-		f.db.Save(f.trackedWallets)
+// Runs every handler on its own, so failure of one handler does not hold back the others
+func (f *FetchEnvironment) Fetch(ctx context.Context, head uint64) error {
+	var g errgroup.Group
+	runs := f.handlers.Runs(f.db, f.chainId)
+	if len(runs) == 0 {
+		return nil
+	}
+	handlerKeys := make([]string, 0, len(runs))
+	for key, run := range runs {
+		handlerKeys = append(handlerKeys, key)
+		g.Go(func() error { return f.indexWithHandler(ctx, key, run, head) })
+	}
+	fetchErr := g.Wait()
+	if fetchErr != nil {
+		slog.Warn(fmt.Sprintf("%s Some handlers failed to fetch interactions: %v", f.logPrefix, fetchErr))
+	}
+	err := syncTrackedWallets(f.db.WithContext(context.WithoutCancel(ctx)), f.chainId, handlerKeys, f.trackedWallets)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("%s Cannot update last blocks of tracked wallets: %s", f.logPrefix, err.Error()))
+		return err
+	}
+	return fetchErr
+}
+
+// Provisionally indexes blocks above the final head for all tracked wallets. Checkpoints stay where they are,
+// so the range is indexed again as confirmed once the final head passes it
+func (f *FetchEnvironment) FetchUnconfirmed(ctx context.Context, startBlock uint64, endBlock uint64) error {
+	participants := make([]string, len(f.trackedWallets))
+	for i, wallet := range f.trackedWallets {
+		participants[i] = wallet.Address
+	}
+	var g errgroup.Group
+	for key, run := range f.handlers.Runs(f.db, f.chainId) {
+		g.Go(func() error {
+			err := run(ctx, startBlock, endBlock, participants, true, nil)
+			if err != nil {
+				return err
+			}
+			slog.Info(fmt.Sprintf("%s [%s] Indexed unconfirmed blocks %d - %d", f.logPrefix, f.handlers.Name(key), startBlock, endBlock))
+			return nil
+		})
 	}
+	return g.Wait()
 }
@@ -0,0 +1,60 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/web3client"
+	"gorm.io/gorm"
+)
+
+// Header of the newest block worker treats as final; confirmed indexing stops there
+func finalHeader(ctx context.Context, client *web3client.MultiURLClient, config trade.Worker, latest uint64) (*types.Header, error) {
+	switch config.Finality {
+	case trade.FinalitySafe:
+		return client.HeaderByTag(ctx, rpc.SafeBlockNumber)
+	case trade.FinalityFinalized:
+		return client.HeaderByTag(ctx, rpc.FinalizedBlockNumber)
+	case "", trade.FinalityDepth:
+		if latest < config.ConfirmationDepth {
+			return nil, fmt.Errorf("Chain has %d blocks only, less than confirmation depth %d", latest, config.ConfirmationDepth)
+		}
+		return client.HeaderByNumber(ctx, latest-config.ConfirmationDepth)
+	default:
+		return nil, fmt.Errorf("Unknown finality %s, expected one of %s, %s, %s", config.Finality, trade.FinalityDepth, trade.FinalitySafe, trade.FinalityFinalized)
+	}
+}
+
+// Removes unconfirmed events at or below the final block. Canonical ones were confirmed when their range was indexed,
+// so the rest belongs to orphaned blocks or to ranges not indexed yet, which are fetched again anyway
+func purgeUnconfirmed(db *gorm.DB, chainId string, finalBlock uint64) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		provisional := []struct {
+			name  string
+			query string
+		}{
+			{"deals", "DELETE FROM deals WHERE blockchain_transfer_id IN (SELECT id FROM erc20_transfers WHERE chain_id = ? AND block <= ? AND unconfirmed)"},
+			{"erc20_transfers", "DELETE FROM erc20_transfers WHERE chain_id = ? AND block <= ? AND unconfirmed"},
+			{"aave_interactions", "DELETE FROM aave_interactions WHERE blockchain_event_id IN (SELECT id FROM aave_events WHERE chain_id = ? AND block_number <= ? AND unconfirmed)"},
+			{"aave_events", "DELETE FROM aave_events WHERE chain_id = ? AND block_number <= ? AND unconfirmed"},
+			{"compound3_interactions", "DELETE FROM compound3_interactions WHERE blockchain_event_id IN (SELECT id FROM compound3_events WHERE chain_id = ? AND block_number <= ? AND unconfirmed)"},
+			{"compound3_events", "DELETE FROM compound3_events WHERE chain_id = ? AND block_number <= ? AND unconfirmed"},
+			{"uniswap_v3_deals", "DELETE FROM uniswap_v3_deals WHERE blockchain_event_id IN (SELECT id FROM uniswap_v3_events WHERE chain_id = ? AND block_number <= ? AND unconfirmed)"},
+			{"uniswap_v3_events", "DELETE FROM uniswap_v3_events WHERE chain_id = ? AND block_number <= ? AND unconfirmed"},
+		}
+		for _, table := range provisional {
+			result := tx.Exec(table.query, chainId, finalBlock)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected > 0 {
+				slog.Info(fmt.Sprintf("Removed %d stale unconfirmed rows from %s on chain %s", result.RowsAffected, table.name, chainId))
+			}
+		}
+		return nil
+	})
+}
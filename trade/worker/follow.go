@@ -0,0 +1,139 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/cache"
+	"github.com/stryukovsky/go-backend-learn/trade/web3client"
+	"gorm.io/gorm"
+)
+
+const (
+	// Polling interval while subscription is alive: polling only advances checkpoints and picks up missed logs then
+	FollowPollingInterval = time.Minute
+	// Logs arrived within this delay are processed together, so events of one block and transaction meet each other
+	followBatchDelay = time.Second
+	// Delay before subscribing again after subscription dropped
+	followResubscribeDelay = 10 * time.Second
+)
+
+// Keeps log subscription of the worker chain alive until ctx is done. Live flag is set while subscription works,
+// so caller polls rarely then and falls back to regular polling from checkpoints once it drops
+func Follow(ctx context.Context, db *gorm.DB, cm *cache.CacheManager, id uint, live *atomic.Bool, prefix string) {
+	for ctx.Err() == nil {
+		err := recovered(func() error { return follow(ctx, db, cm, id, live, prefix) })
+		live.Store(false)
+		if ctx.Err() != nil {
+			break
+		}
+		slog.Warn(fmt.Sprintf("%s [Follow] Logs subscription stopped, falling back to polling: %s", prefix, err.Error()))
+		trade.Sleep(ctx, followResubscribeDelay)
+	}
+}
+
+func follow(ctx context.Context, db *gorm.DB, cm *cache.CacheManager, id uint, live *atomic.Bool, prefix string) error {
+	db = db.WithContext(ctx)
+	var config trade.Worker
+	err := db.First(&config, id).Error
+	if err != nil {
+		return fmt.Errorf("No config with id %d: %w", id, err)
+	}
+	client, err := web3client.NewMultiURLClient(config.BlockchainUrlsForEvents, config.RpcLimits)
+	if err != nil {
+		return err
+	}
+	chainId, err := client.ChainID(ctx)
+	if err != nil {
+		return err
+	}
+	handlers, err := NewHandlerSet(ctx, db, cm, client, chainId.String())
+	if err != nil {
+		return err
+	}
+	lives := handlers.LiveRuns(db, chainId.String(), !config.FinalAtLatest())
+	addresses := make([]common.Address, 0)
+	seen := make(map[common.Address]bool)
+	for _, run := range lives {
+		for _, address := range run.addresses {
+			if !seen[address] {
+				seen[address] = true
+				addresses = append(addresses, address)
+			}
+		}
+	}
+	if len(addresses) == 0 {
+		return fmt.Errorf("No contracts to subscribe on chain %s", chainId.String())
+	}
+
+	logsCh := make(chan types.Log, 1024)
+	sub, url, err := client.SubscribeLogs(ctx, ethereum.FilterQuery{Addresses: addresses}, logsCh)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+	live.Store(true)
+	slog.Info(fmt.Sprintf("%s [Follow] Subscribed to logs of %d contracts on chain %s via %s", prefix, len(addresses), chainId.String(), url))
+
+	batch := make([]types.Log, 0)
+	timer := time.NewTimer(followBatchDelay)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// pending batch is dropped, polling picks these logs up after restart
+			return ctx.Err()
+		case err := <-sub.Err():
+			processLiveLogs(ctx, db, chainId.String(), lives, batch, prefix)
+			if err == nil {
+				err = fmt.Errorf("subscription closed")
+			}
+			return err
+		case log := <-logsCh:
+			// removed logs belong to orphaned blocks, polling rolls them back on reorg detection
+			if log.Removed {
+				continue
+			}
+			if len(batch) == 0 {
+				timer.Reset(followBatchDelay)
+			}
+			batch = append(batch, log)
+		case <-timer.C:
+			processLiveLogs(ctx, db, chainId.String(), lives, batch, prefix)
+			batch = make([]types.Log, 0)
+		}
+	}
+}
+
+func processLiveLogs(ctx context.Context, db *gorm.DB, chainId string, lives map[string]liveRun, logs []types.Log, prefix string) {
+	if len(logs) == 0 {
+		return
+	}
+	// wallets are read on every batch, so wallets added while subscription is alive are picked up
+	var trackedWallets []trade.TrackedWallet
+	err := db.Find(&trackedWallets, &trade.TrackedWallet{ChainId: chainId}).Error
+	if err != nil {
+		slog.Warn(fmt.Sprintf("%s [Follow] Failed to get tracked wallets: %s", prefix, err.Error()))
+		return
+	}
+	if len(trackedWallets) == 0 {
+		return
+	}
+	participants := make([]string, len(trackedWallets))
+	for i, wallet := range trackedWallets {
+		participants[i] = wallet.Address
+	}
+	slog.Info(fmt.Sprintf("%s [Follow] Processing %d live logs on chain %s", prefix, len(logs), chainId))
+	for _, run := range lives {
+		// failures are logged by run; polling will fetch the same logs again
+		run.process(ctx, logs, participants)
+	}
+}
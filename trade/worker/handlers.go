@@ -0,0 +1,265 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/cache"
+	"github.com/stryukovsky/go-backend-learn/trade/metrics"
+	"github.com/stryukovsky/go-backend-learn/trade/protocols"
+	"github.com/stryukovsky/go-backend-learn/trade/protocols/aave"
+	"github.com/stryukovsky/go-backend-learn/trade/protocols/compound3"
+	"github.com/stryukovsky/go-backend-learn/trade/protocols/hodl"
+	"github.com/stryukovsky/go-backend-learn/trade/protocols/uniswapv3"
+	"github.com/stryukovsky/go-backend-learn/trade/web3client"
+	"gorm.io/gorm"
+)
+
+// All protocol handlers configured for a chain
+type HandlerSet struct {
+	erc20Handlers     []protocols.DeFiProtocolHandler[trade.ERC20Transfer, trade.Deal]
+	aaveHandlers      []protocols.DeFiProtocolHandler[trade.AaveEvent, trade.AaveInteraction]
+	compoundHandlers  []protocols.DeFiProtocolHandler[trade.Compound3Event, trade.Compound3Interaction]
+	uniswapv3Handlers []protocols.DeFiProtocolHandler[trade.UniswapV3Event, trade.UniswapV3Deal]
+	// display names of handlers by their keys
+	names map[string]string
+}
+
+// Display name of handler with key, for logs
+func (s *HandlerSet) Name(key string) string {
+	if name, ok := s.names[key]; ok {
+		return name
+	}
+	return key
+}
+
+// Keeps the first handler of each key, so a contract configured twice is not indexed twice
+func uniqueHandlers[BlockchainInteraction any, FinancialInteraction any](
+	names map[string]string,
+	handlers []protocols.DeFiProtocolHandler[BlockchainInteraction, FinancialInteraction],
+) []protocols.DeFiProtocolHandler[BlockchainInteraction, FinancialInteraction] {
+	result := make([]protocols.DeFiProtocolHandler[BlockchainInteraction, FinancialInteraction], 0, len(handlers))
+	for _, handler := range handlers {
+		if name, ok := names[handler.Key()]; ok {
+			slog.Warn(fmt.Sprintf("[%s] Handler %s of the same contract is configured already, skip it", name, handler.Name()))
+			continue
+		}
+		names[handler.Key()] = handler.Name()
+		result = append(result, handler)
+	}
+	return result
+}
+
+func NewHandlerSet(ctx context.Context, db *gorm.DB, cm *cache.CacheManager, client *web3client.MultiURLClient, chainId string) (*HandlerSet, error) {
+	var tokensFromDB []trade.Token
+	err := db.Find(&tokensFromDB, &trade.Token{ChainId: chainId}).Error
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Cannot get tokens of config: %s", err.Error()))
+		return nil, err
+	}
+	var erc20Handlers []protocols.DeFiProtocolHandler[trade.ERC20Transfer, trade.Deal]
+	for _, token := range tokensFromDB {
+		erc20, err := hodl.NewHODLHandler(client, token, cm, ParallelFactor)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Cannot create token %s: %e", token.Address, err))
+			continue
+		}
+		var casted protocols.DeFiProtocolHandler[trade.ERC20Transfer, trade.Deal]
+		casted = erc20
+		erc20Handlers = append(erc20Handlers, casted)
+	}
+
+	var aaveInstances []trade.DeFiPlatform
+	err = db.Find(&aaveInstances, &trade.DeFiPlatform{ChainId: chainId, Type: trade.Aave}).Error
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Cannot get aave platform instances: %s", err.Error()))
+		return nil, err
+	}
+	var aaveHandlers []protocols.DeFiProtocolHandler[trade.AaveEvent, trade.AaveInteraction]
+	for _, aaveInstance := range aaveInstances {
+		var tokens []trade.Token
+		db.Find(&tokens, trade.Token{ChainId: aaveInstance.ChainId})
+		aaveHandler, err := aave.NewAaveHandler(aaveInstance, client, cm, tokens, ParallelFactor)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Cannot get aave platform handler: %s", err.Error()))
+			continue
+		}
+		var casted protocols.DeFiProtocolHandler[trade.AaveEvent, trade.AaveInteraction]
+		casted = aaveHandler
+		aaveHandlers = append(aaveHandlers, casted)
+	}
+
+	var compoundInstances []trade.DeFiPlatform
+	err = db.Find(&compoundInstances, &trade.DeFiPlatform{ChainId: chainId, Type: trade.Compound3}).Error
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Cannot get compound platform instances: %s", err.Error()))
+		return nil, err
+	}
+	var compoundHandlers []protocols.DeFiProtocolHandler[trade.Compound3Event, trade.Compound3Interaction]
+	for _, compoundInstance := range compoundInstances {
+		var tokens []trade.Token
+		db.Find(&tokens, trade.Token{ChainId: compoundInstance.ChainId})
+		compoundHandler, err := compound3.NewCompound3Handler(ctx, compoundInstance, client, cm, tokens, ParallelFactor)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Cannot get compound platform handler: %s", err.Error()))
+			continue
+		}
+		var casted protocols.DeFiProtocolHandler[trade.Compound3Event, trade.Compound3Interaction]
+		casted = compoundHandler
+		compoundHandlers = append(compoundHandlers, casted)
+	}
+
+	var uniswapV3Pools []trade.DeFiPlatform
+	err = db.Find(&uniswapV3Pools, &trade.DeFiPlatform{ChainId: chainId, Type: trade.UniswapV3}).Error
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Cannot get UniswapV3 pools: %s", err.Error()))
+		return nil, err
+	}
+	var uniswapv3Handlers []protocols.DeFiProtocolHandler[trade.UniswapV3Event, trade.UniswapV3Deal]
+	for _, uniswapv3Instance := range uniswapV3Pools {
+		uniswapv3Handler, err := uniswapv3.NewUniswapV3PoolHandler(
+			ctx,
+			uniswapv3Instance,
+			client,
+			cm,
+			db,
+			ParallelFactor,
+		)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Cannot get uniswapv3 platform handler: %s", err.Error()))
+			continue
+		}
+		var casted protocols.DeFiProtocolHandler[trade.UniswapV3Event, trade.UniswapV3Deal]
+		casted = uniswapv3Handler
+		uniswapv3Handlers = append(uniswapv3Handlers, casted)
+	}
+	names := make(map[string]string)
+	return &HandlerSet{
+		erc20Handlers:     uniqueHandlers(names, erc20Handlers),
+		aaveHandlers:      uniqueHandlers(names, aaveHandlers),
+		compoundHandlers:  uniqueHandlers(names, compoundHandlers),
+		uniswapv3Handlers: uniqueHandlers(names, uniswapv3Handlers),
+		names:             names,
+	}, nil
+}
+
+// Fetches events of a single handler in block range for given participants and saves them unpriced in one transaction
+// together with whatever progress commit does, e.g. checkpoints update; commit is nil when there is no progress to save.
+// Logs failed to be parsed do not fail the range, they are passed to commit instead.
+// Transaction is not bound to ctx: once range is fetched it is committed or rolled back as a whole even on shutdown
+type handlerRun func(ctx context.Context, startBlock uint64, endBlock uint64, participants []string, unconfirmed bool, commit func(tx *gorm.DB, failed []trade.LogFailure) error) error
+
+func addRun[BlockchainInteraction keyedEvent, BlockchainInteractionPtr stateEvent[BlockchainInteraction], FinancialInteraction any](
+	runs map[string]handlerRun,
+	db *gorm.DB,
+	chainId string,
+	handler protocols.DeFiProtocolHandler[BlockchainInteraction, FinancialInteraction],
+) {
+	runs[handler.Key()] = func(ctx context.Context, startBlock uint64, endBlock uint64, participants []string, unconfirmed bool, commit func(tx *gorm.DB, failed []trade.LogFailure) error) error {
+		ctx, failures := trade.WithLogFailures(ctx)
+		events, err := fetchEventsFromEthJSONRPC(ctx, chainId, startBlock, endBlock, handler, participants)
+		if err != nil {
+			return err
+		}
+		metrics.EventsParsed(chainId, handler.Key(), len(events))
+		err = db.WithContext(context.WithoutCancel(ctx)).Transaction(func(tx *gorm.DB) error {
+			_, err := saveEvents[BlockchainInteraction, BlockchainInteractionPtr](tx, chainId, events, unconfirmed)
+			if err != nil || commit == nil {
+				return err
+			}
+			return commit(tx, failures.Items())
+		})
+		if err != nil {
+			slog.Warn(fmt.Sprintf("[%s] Cannot save events of blocks %d - %d: %s", handler.Name(), startBlock, endBlock, err.Error()))
+			return err
+		}
+		metrics.EventsSaved(chainId, handler.Key(), len(events))
+		return nil
+	}
+}
+
+// Runs of all handlers keyed by handler key
+func (s *HandlerSet) Runs(db *gorm.DB, chainId string) map[string]handlerRun {
+	runs := make(map[string]handlerRun)
+	for _, handler := range s.erc20Handlers {
+		addRun[trade.ERC20Transfer](runs, db, chainId, handler)
+	}
+	for _, handler := range s.aaveHandlers {
+		addRun[trade.AaveEvent](runs, db, chainId, handler)
+	}
+	for _, handler := range s.compoundHandlers {
+		addRun[trade.Compound3Event](runs, db, chainId, handler)
+	}
+	for _, handler := range s.uniswapv3Handlers {
+		addRun[trade.UniswapV3Event](runs, db, chainId, handler)
+	}
+	return runs
+}
+
+// Saves unpriced events decoded from logs pushed by subscription. Checkpoints are not moved since subscription
+// may silently miss logs, polling still covers the range and skips what is already saved.
+// Logs come from the chain tip, so they are saved unconfirmed unless the latest block is final for the worker
+type liveRun struct {
+	addresses []common.Address
+	process   func(ctx context.Context, logs []types.Log, participants []string) error
+}
+
+func addLiveRun[BlockchainInteraction keyedEvent, BlockchainInteractionPtr stateEvent[BlockchainInteraction], FinancialInteraction any](
+	lives map[string]liveRun,
+	db *gorm.DB,
+	chainId string,
+	unconfirmed bool,
+	handler protocols.DeFiProtocolHandler[BlockchainInteraction, FinancialInteraction],
+) {
+	subscriber, ok := handler.(protocols.LogsSubscriber[BlockchainInteraction])
+	if !ok {
+		return
+	}
+	lives[handler.Key()] = liveRun{
+		addresses: subscriber.LogsAddresses(),
+		process: func(ctx context.Context, logs []types.Log, participants []string) error {
+			events, err := subscriber.ParseLogs(ctx, chainId, participants, logs)
+			if err != nil {
+				slog.Warn(fmt.Sprintf("[%s] Cannot parse logs: %s", handler.Name(), err.Error()))
+				return err
+			}
+			metrics.EventsParsed(chainId, handler.Key(), len(events))
+			if len(events) == 0 {
+				return nil
+			}
+			err = db.WithContext(context.WithoutCancel(ctx)).Transaction(func(tx *gorm.DB) error {
+				_, err := saveEvents[BlockchainInteraction, BlockchainInteractionPtr](tx, chainId, events, unconfirmed)
+				return err
+			})
+			if err != nil {
+				slog.Warn(fmt.Sprintf("[%s] Cannot save live events: %s", handler.Name(), err.Error()))
+				return err
+			}
+			metrics.EventsSaved(chainId, handler.Key(), len(events))
+			slog.Info(fmt.Sprintf("[%s] Saved %d live events", handler.Name(), len(events)))
+			return nil
+		},
+	}
+}
+
+// Live runs of handlers supporting log subscriptions keyed by handler key
+func (s *HandlerSet) LiveRuns(db *gorm.DB, chainId string, unconfirmed bool) map[string]liveRun {
+	lives := make(map[string]liveRun)
+	for _, handler := range s.erc20Handlers {
+		addLiveRun[trade.ERC20Transfer](lives, db, chainId, unconfirmed, handler)
+	}
+	for _, handler := range s.aaveHandlers {
+		addLiveRun[trade.AaveEvent](lives, db, chainId, unconfirmed, handler)
+	}
+	for _, handler := range s.compoundHandlers {
+		addLiveRun[trade.Compound3Event](lives, db, chainId, unconfirmed, handler)
+	}
+	for _, handler := range s.uniswapv3Handlers {
+		addLiveRun[trade.UniswapV3Event](lives, db, chainId, unconfirmed, handler)
+	}
+	return lives
+}
@@ -0,0 +1,147 @@
+package worker
+
+import (
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const persistBatchSize = 500
+
+// Blockchain event table row identified by its log
+type keyedEvent interface {
+	Key() trade.EventKey
+	Height() uint64
+}
+
+// Pointer to event row whose processing state can be set before insert
+type stateEvent[Event keyedEvent] interface {
+	*Event
+	MarkUnconfirmed()
+	MarkUnpriced()
+	LinkBlock(id uint)
+}
+
+// Financial interaction row referencing the blockchain event it was derived from
+type linkedInteraction[Event keyedEvent, Interaction any] interface {
+	*Interaction
+	SourceEvent() Event
+	LinkSourceEvent(id uint)
+}
+
+// Inserts raw events of a block range as unpriced, skipping already stored ones, so range may be written again
+// after crash or reorg. Unconfirmed events get flagged, confirmed ones clear the flag of events stored provisionally before.
+// Events reference their blocks, which are stored when block timestamps are resolved during parsing.
+// Returns ids of all given events, both new and existing
+func saveEvents[Event keyedEvent, EventPtr stateEvent[Event]](
+	tx *gorm.DB,
+	chainId string,
+	events []Event,
+	unconfirmed bool,
+) (map[trade.EventKey]uint, error) {
+	if len(events) == 0 {
+		return make(map[trade.EventKey]uint), nil
+	}
+	blockIds, err := storedBlockIds(tx, chainId, events)
+	if err != nil {
+		return nil, err
+	}
+	for i := range events {
+		EventPtr(&events[i]).MarkUnpriced()
+		if unconfirmed {
+			EventPtr(&events[i]).MarkUnconfirmed()
+		}
+		if id, ok := blockIds[events[i].Height()]; ok {
+			EventPtr(&events[i]).LinkBlock(id)
+		}
+	}
+	err = tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&events, persistBatchSize).Error
+	if err != nil {
+		return nil, err
+	}
+	ids, err := eventIds(tx, chainId, events)
+	if err != nil {
+		return nil, err
+	}
+	if !unconfirmed {
+		confirmed := make([]uint, 0, len(events))
+		for _, event := range events {
+			confirmed = append(confirmed, ids[event.Key()])
+		}
+		err = tx.Model(new(Event)).Where("id IN ? AND unconfirmed", confirmed).Update("unconfirmed", false).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// Ids of stored blocks of events keyed by block number
+func storedBlockIds[Event keyedEvent](tx *gorm.DB, chainId string, events []Event) (map[uint64]uint, error) {
+	numbers := make([]uint64, 0, len(events))
+	seen := make(map[uint64]bool, len(events))
+	for _, event := range events {
+		if !seen[event.Height()] {
+			seen[event.Height()] = true
+			numbers = append(numbers, event.Height())
+		}
+	}
+	var blocks []trade.Block
+	err := tx.Select("id", "number").Where("chain_id = ? AND number IN ?", chainId, numbers).Find(&blocks).Error
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[uint64]uint, len(blocks))
+	for _, block := range blocks {
+		ids[block.Number] = block.ID
+	}
+	return ids, nil
+}
+
+// Ids of stored events resolved by uniqueness index, since rows skipped on conflict get no id from RETURNING
+func eventIds[Event keyedEvent](tx *gorm.DB, chainId string, events []Event) (map[trade.EventKey]uint, error) {
+	ids := make(map[trade.EventKey]uint, len(events))
+	txIds := make([]string, 0, len(events))
+	seen := make(map[string]bool, len(events))
+	for _, event := range events {
+		key := event.Key()
+		if !seen[key.TxId] {
+			seen[key.TxId] = true
+			txIds = append(txIds, key.TxId)
+		}
+	}
+	var stored []struct {
+		ID       uint
+		TxId     string
+		LogIndex uint
+	}
+	err := tx.Unscoped().Model(new(Event)).
+		Select("id", "tx_id", "log_index").
+		Where("chain_id = ? AND tx_id IN ?", chainId, txIds).
+		Scan(&stored).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range stored {
+		ids[trade.EventKey{TxId: row.TxId, LogIndex: row.LogIndex}] = row.ID
+	}
+	return ids, nil
+}
+
+// Writes interactions of already stored events, interactions stored before are skipped
+func saveInteractions[Event keyedEvent, Interaction any, InteractionPtr linkedInteraction[Event, Interaction]](
+	tx *gorm.DB,
+	ids map[trade.EventKey]uint,
+	interactions []Interaction,
+) error {
+	if len(interactions) == 0 {
+		return nil
+	}
+	for i := range interactions {
+		interaction := InteractionPtr(&interactions[i])
+		interaction.LinkSourceEvent(ids[interaction.SourceEvent().Key()])
+	}
+	return tx.Omit(clause.Associations).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		CreateInBatches(&interactions, persistBatchSize).Error
+}
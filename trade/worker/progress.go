@@ -0,0 +1,48 @@
+package worker
+
+import (
+	"context"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/metrics"
+	"github.com/stryukovsky/go-backend-learn/trade/web3client"
+	"gorm.io/gorm"
+)
+
+// Remembers how far worker has got after successful cycle, so status API does not need to touch the chain
+func saveProgress(ctx context.Context, db *gorm.DB, client *web3client.MultiURLClient, id uint, chainId string, head uint64, final *types.Header) error {
+	var indexed uint64
+	err := db.Model(&trade.TrackedWallet{}).Select("COALESCE(MIN(last_block), 0)").Where("chain_id = ?", chainId).Scan(&indexed).Error
+	if err != nil {
+		return err
+	}
+	indexedHeader := final
+	if indexed != final.Number.Uint64() {
+		indexedHeader, err = client.HeaderByNumber(ctx, indexed)
+		if err != nil {
+			return err
+		}
+	}
+	indexedTime := time.Unix(int64(indexedHeader.Time), 0)
+	metrics.LagBlocks(metrics.IndexWorker, chainId, final.Number.Uint64()-min(indexed, final.Number.Uint64()))
+	metrics.LagSeconds(metrics.IndexWorker, chainId, time.Since(indexedTime))
+	now := time.Now()
+	return db.Model(&trade.Worker{}).Where("id = ?", id).Updates(map[string]any{
+		"head_block":         head,
+		"final_block":        final.Number.Uint64(),
+		"indexed_block":      indexed,
+		"indexed_block_time": &indexedTime,
+		"last_cycle_at":      &now,
+	}).Error
+}
+
+// Remembers error of failed cycle for status API
+func saveCycleError(db *gorm.DB, id uint, cycleErr error) error {
+	now := time.Now()
+	return db.Model(&trade.Worker{}).Where("id = ?", id).Updates(map[string]any{
+		"last_error":    cycleErr.Error(),
+		"last_error_at": &now,
+	}).Error
+}
@@ -0,0 +1,159 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/cache"
+	"github.com/stryukovsky/go-backend-learn/trade/web3client"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// how many of the latest remembered blocks are compared with the canonical chain when searching for the fork point
+	ReorgLookback = 64
+)
+
+func saveIndexedBlock(db *gorm.DB, chainId string, header *types.Header) error {
+	block := trade.NewBlock(chainId, header.Number.Uint64(), header.Hash(), header.ParentHash, header.Time)
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "chain_id"}, {Name: "number"}},
+		DoUpdates: clause.AssignmentColumns([]string{"hash", "parent_hash", "timestamp", "updated_at"}),
+	}).Create(&block).Error
+}
+
+// Compares remembered block hashes with the canonical chain starting from the latest one.
+// Returns the number of the highest remembered block which is still canonical (the fork point)
+// and whether a reorganization happened at all
+func detectReorg(ctx context.Context, db *gorm.DB, client *web3client.MultiURLClient, chainId string) (uint64, bool, error) {
+	var remembered []trade.Block
+	err := db.Where("chain_id = ?", chainId).Order("number DESC").Limit(ReorgLookback).Find(&remembered).Error
+	if err != nil {
+		return 0, false, err
+	}
+	if len(remembered) == 0 {
+		return 0, false, nil
+	}
+	for i, block := range remembered {
+		header, err := client.HeaderByNumber(ctx, block.Number)
+		if err != nil {
+			return 0, false, err
+		}
+		if header.Hash().Hex() == block.Hash {
+			return block.Number, i > 0, nil
+		}
+		slog.Warn(fmt.Sprintf(
+			"Block %d on chain %s was indexed with hash %s, but canonical chain has %s with parent %s",
+			block.Number,
+			chainId,
+			block.Hash,
+			header.Hash().Hex(),
+			header.ParentHash.Hex(),
+		))
+	}
+	oldest := remembered[len(remembered)-1].Number
+	slog.Error(fmt.Sprintf(
+		"None of %d remembered blocks on chain %s is canonical anymore, rolling back below block %d",
+		len(remembered),
+		chainId,
+		oldest,
+	))
+	if oldest == 0 {
+		return 0, true, nil
+	}
+	return oldest - 1, true, nil
+}
+
+// Removes everything indexed above fork block and rewinds checkpoints, tracked wallets, backfill shards and dead letters
+// so the range is indexed again.
+// Returns numbers of removed blocks
+func rollbackAboveBlock(db *gorm.DB, chainId string, forkBlock uint64) ([]uint64, error) {
+	var orphanedBlocks []uint64
+	err := db.Model(&trade.Block{}).Where("chain_id = ? AND number > ?", chainId, forkBlock).Pluck("number", &orphanedBlocks).Error
+	if err != nil {
+		return nil, err
+	}
+	return orphanedBlocks, db.Transaction(func(tx *gorm.DB) error {
+		orphaned := []struct {
+			name  string
+			query string
+		}{
+			{"deals", "DELETE FROM deals WHERE blockchain_transfer_id IN (SELECT id FROM erc20_transfers WHERE chain_id = ? AND block > ?)"},
+			{"erc20_transfers", "DELETE FROM erc20_transfers WHERE chain_id = ? AND block > ?"},
+			{"aave_interactions", "DELETE FROM aave_interactions WHERE blockchain_event_id IN (SELECT id FROM aave_events WHERE chain_id = ? AND block_number > ?)"},
+			{"aave_events", "DELETE FROM aave_events WHERE chain_id = ? AND block_number > ?"},
+			{"compound3_interactions", "DELETE FROM compound3_interactions WHERE blockchain_event_id IN (SELECT id FROM compound3_events WHERE chain_id = ? AND block_number > ?)"},
+			{"compound3_events", "DELETE FROM compound3_events WHERE chain_id = ? AND block_number > ?"},
+			{"uniswap_v3_deals", "DELETE FROM uniswap_v3_deals WHERE blockchain_event_id IN (SELECT id FROM uniswap_v3_events WHERE chain_id = ? AND block_number > ?)"},
+			{"uniswap_v3_events", "DELETE FROM uniswap_v3_events WHERE chain_id = ? AND block_number > ?"},
+			{"blocks", "DELETE FROM blocks WHERE chain_id = ? AND number > ?"},
+		}
+		for _, table := range orphaned {
+			result := tx.Exec(table.query, chainId, forkBlock)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected > 0 {
+				slog.Warn(fmt.Sprintf("Removed %d orphaned rows from %s on chain %s", result.RowsAffected, table.name, chainId))
+			}
+		}
+		err := tx.Model(&trade.Checkpoint{}).
+			Where("chain_id = ? AND last_block > ?", chainId, forkBlock).
+			Update("last_block", forkBlock).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&trade.TrackedWallet{}).
+			Where("chain_id = ? AND last_block > ?", chainId, forkBlock).
+			Update("last_block", forkBlock).Error
+		if err != nil {
+			return err
+		}
+		// shards reaching orphaned blocks are backfilled again on the next run
+		err = tx.Model(&trade.BackfillShard{}).
+			Where("chain_id = ? AND to_block > ? AND done", chainId, forkBlock).
+			Update("done", false).Error
+		if err != nil {
+			return err
+		}
+		// orphaned part of failed ranges is indexed again from rewound checkpoints, so only the canonical part is retried
+		result := tx.Unscoped().Where("chain_id = ? AND from_block > ?", chainId, forkBlock).Delete(&trade.DeadLetter{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			slog.Warn(fmt.Sprintf("Removed %d dead letters of orphaned blocks on chain %s", result.RowsAffected, chainId))
+		}
+		return tx.Model(&trade.DeadLetter{}).
+			Where("chain_id = ? AND to_block > ?", chainId, forkBlock).
+			Update("to_block", forkBlock).Error
+	})
+}
+
+// Detects chain reorganization since the previous cycle and removes orphaned events and blocks if any
+func handleReorg(ctx context.Context, db *gorm.DB, cm *cache.CacheManager, client *web3client.MultiURLClient, chainId string) error {
+	var tip trade.Block
+	err := db.Where("chain_id = ?", chainId).Order("number DESC").Limit(1).Find(&tip).Error
+	if err != nil {
+		return err
+	}
+	forkBlock, reorged, err := detectReorg(ctx, db, client, chainId)
+	if err != nil || !reorged {
+		return err
+	}
+	slog.Warn(fmt.Sprintf(
+		"Chain reorganization detected on chain %s: fork point is block %d, depth is %d blocks",
+		chainId,
+		forkBlock,
+		tip.Number-forkBlock,
+	))
+	orphanedBlocks, err := rollbackAboveBlock(db.WithContext(context.WithoutCancel(ctx)), chainId, forkBlock)
+	if err != nil {
+		return err
+	}
+	return cm.ForgetBlocks(ctx, orphanedBlocks)
+}
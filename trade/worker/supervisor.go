@@ -0,0 +1,93 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/stryukovsky/go-backend-learn/trade"
+	"github.com/stryukovsky/go-backend-learn/trade/cache"
+	"github.com/stryukovsky/go-backend-learn/trade/metrics"
+	"gorm.io/gorm"
+)
+
+const (
+	PollingInterval = 5 * time.Second
+	// Backoff of failed cycles is doubled on every consecutive failure up to the max one
+	minCycleBackoff = 5 * time.Second
+	maxCycleBackoff = 5 * time.Minute
+)
+
+// Prefix of log messages of a single worker, so logs of chains running concurrently can be told apart
+func LogPrefix(config trade.Worker) string {
+	if config.ChainId == "" {
+		return fmt.Sprintf("[Worker %d]", config.ID)
+	}
+	return fmt.Sprintf("[Chain %s]", config.ChainId)
+}
+
+// Turns panic of fn into error, so crash of one chain does not bring the whole process down
+func recovered(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return fn()
+}
+
+// Runs indexing cycles of a single worker until ctx is done. Failed and crashed cycles are retried with backoff of this worker only,
+// so the other chains keep going. Stored events are priced by enrichment running alongside.
+// With follow, events are received via logs subscription and polling is rare while it is alive
+func Supervise(ctx context.Context, db *gorm.DB, cm *cache.CacheManager, config trade.Worker, follow bool) {
+	// Legacy workers have no chain id stored until their first cycle, cache has it resolved already
+	if config.ChainId == "" {
+		config.ChainId = cm.ChainId()
+	}
+	prefix := LogPrefix(config)
+	var live atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		Enrich(ctx, db, cm, config.ID, prefix)
+	}()
+	if follow {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Follow(ctx, db, cm, config.ID, &live, prefix)
+		}()
+	}
+	defer wg.Wait()
+	backoff := minCycleBackoff
+	var lastCycle time.Time
+	for ctx.Err() == nil {
+		if live.Load() && time.Since(lastCycle) < FollowPollingInterval {
+			trade.Sleep(ctx, PollingInterval)
+			continue
+		}
+		lastCycle = time.Now()
+		err := recovered(func() error { return Cycle(ctx, db, cm, config.ID, prefix) })
+		if ctx.Err() != nil {
+			break
+		}
+		metrics.Cycle(metrics.IndexWorker, config.ChainId, lastCycle, err)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("%s Cycle failed, retrying in %s: %s", prefix, backoff, err.Error()))
+			if saveErr := saveCycleError(db, config.ID, err); saveErr != nil {
+				slog.Warn(fmt.Sprintf("%s Cannot save error of cycle: %s", prefix, saveErr.Error()))
+			}
+			trade.Sleep(ctx, backoff)
+			backoff = min(backoff*2, maxCycleBackoff)
+			continue
+		}
+		backoff = minCycleBackoff
+		trade.Sleep(ctx, PollingInterval)
+	}
+	slog.Info(fmt.Sprintf("%s Worker stopped", prefix))
+}
@@ -1,18 +1,12 @@
 package worker
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
-	"math"
-	"strconv"
 
 	"github.com/stryukovsky/go-backend-learn/trade"
 	"github.com/stryukovsky/go-backend-learn/trade/cache"
-	"github.com/stryukovsky/go-backend-learn/trade/protocols"
-	"github.com/stryukovsky/go-backend-learn/trade/protocols/aave"
-	"github.com/stryukovsky/go-backend-learn/trade/protocols/compound3"
-	"github.com/stryukovsky/go-backend-learn/trade/protocols/hodl"
-	"github.com/stryukovsky/go-backend-learn/trade/protocols/uniswapv3"
 	"github.com/stryukovsky/go-backend-learn/trade/web3client"
 	"gorm.io/gorm"
 )
@@ -21,141 +15,93 @@ const (
 	ParallelFactor = 16
 )
 
-
-func Cycle(db *gorm.DB, cm *cache.CacheManager, id uint) {
-	slog.Info("Starting worker")
+// Runs a single indexing cycle of worker: checks chain for reorganization and fetches events of tracked wallets
+// up to the final head, then optionally the blocks above it as unconfirmed
+func Cycle(ctx context.Context, db *gorm.DB, cm *cache.CacheManager, id uint, prefix string) error {
+	slog.Info(fmt.Sprintf("%s Starting worker", prefix))
+	db = db.WithContext(ctx)
 	var config trade.Worker
 	result := db.First(&config, id)
 	if result.Error != nil {
-		slog.Warn("No config with id " + strconv.Itoa(int(id)))
-		return
+		return fmt.Errorf("No config with id %d: %w", id, result.Error)
 	}
 
-	client, err := web3client.NewMultiURLClient(config.BlockchainUrlsForEvents)
+	client, err := web3client.NewMultiURLClient(config.BlockchainUrlsForEvents, config.RpcLimits)
 	if err != nil {
-		slog.Error(fmt.Sprintf("Failed to connect to Ethereum node: %s", err.Error()))
-		return
+		return fmt.Errorf("Failed to connect to Ethereum node: %w", err)
+	}
+
+	chainId, err := client.ChainID(ctx)
+	if err != nil {
+		return fmt.Errorf("Cannot fetch chain id: %w", err)
+	}
+
+	if config.ChainId != chainId.String() {
+		config.ChainId = chainId.String()
+		db.Save(&config)
 	}
 
-	chainId, err := client.ChainID()
+	err = handleReorg(ctx, db, cm, client, chainId.String())
 	if err != nil {
-		slog.Warn(fmt.Sprintf("Cannot fetch chain id: %s", err.Error()))
-		return
+		return fmt.Errorf("Cannot check chain for reorganization: %w", err)
 	}
 
 	var trackedWallets []trade.TrackedWallet
 	err = db.Find(&trackedWallets, &trade.TrackedWallet{ChainId: chainId.String()}).Error
 	if err != nil {
-		slog.Warn("Failed to get tracked wallets")
-		return
+		return fmt.Errorf("Failed to get tracked wallets: %w", err)
 	}
 
-	currentBlockchainBlock, err := client.BlockNumber()
+	currentBlockchainBlock, err := client.BlockNumber(ctx)
 	if err != nil {
-		slog.Warn(fmt.Sprintf("Cannot get last blockchain block: %s", err.Error()))
-		return
+		return fmt.Errorf("Cannot get last blockchain block: %w", err)
 	}
 
-	var tokensFromDB []trade.Token
-	err = db.Find(&tokensFromDB, &trade.Token{ChainId: chainId.String()}).Error
-	if err != nil {
-		slog.Warn(fmt.Sprintf("Cannot get tokens of config: %s", err.Error()))
-		return
+	if len(trackedWallets) == 0 {
+		slog.Warn(fmt.Sprintf("%s Cannot determine where to start indexing. Maybe there is no tracked wallets?", prefix))
+		return nil
 	}
-	var participants []string
-	var minBlockOfWalletsToFetchFromNode uint64 = math.MaxUint64
 	for _, wallet := range trackedWallets {
-		slog.Info(fmt.Sprintf("Wallet %s will be updated with transfers fetched from blockchain", wallet.Address))
-		participants = append(participants, wallet.Address)
-		minBlockOfWalletsToFetchFromNode = min(wallet.LastBlock, minBlockOfWalletsToFetchFromNode)
+		slog.Info(fmt.Sprintf("%s Wallet %s will be updated with transfers fetched from blockchain", prefix, wallet.Address))
 	}
-	if minBlockOfWalletsToFetchFromNode == math.MaxUint64 {
-		slog.Warn("Cannot determine where to start indexing. Maybe there is no tracked wallets?")
-		return
+	// header is taken before events so reorg happened during fetching is noticed on the next cycle
+	headHeader, err := finalHeader(ctx, client, config, currentBlockchainBlock)
+	if err != nil {
+		return fmt.Errorf("Cannot get final block header: %w", err)
 	}
-	startBlock := minBlockOfWalletsToFetchFromNode
-	endBlock := min(startBlock+config.BlocksInterval, currentBlockchainBlock)
+	finalBlock := headHeader.Number.Uint64()
 
-	var erc20Handlers []protocols.DeFiProtocolHandler[trade.ERC20Transfer, trade.Deal]
-	for _, token := range tokensFromDB {
-		erc20, err := hodl.NewHODLHandler(client, token, cm, ParallelFactor)
-		if err != nil {
-			slog.Warn(fmt.Sprintf("Cannot create token %s: %e", token.Address, err))
-			continue
-		}
-		var casted protocols.DeFiProtocolHandler[trade.ERC20Transfer, trade.Deal]
-		casted = erc20
-		erc20Handlers = append(erc20Handlers, casted)
+	handlers, err := NewHandlerSet(ctx, db, cm, client, chainId.String())
+	if err != nil {
+		return err
 	}
-
-	var aaveInstances []trade.DeFiPlatform
-	err = db.Find(&aaveInstances, &trade.DeFiPlatform{ChainId: chainId.String(), Type: trade.Aave}).Error
+	// Environment is ready to setup
+	env := NewFetchEnvironment(chainId.String(), db, trackedWallets, config.BlocksInterval, handlers, prefix)
+	// failure of some handlers is already logged; head is remembered anyway so reorg detection keeps working for others
+	fetchErr := env.Fetch(ctx, finalBlock)
+	err = saveIndexedBlock(db.WithContext(context.WithoutCancel(ctx)), chainId.String(), headHeader)
 	if err != nil {
-		slog.Warn(fmt.Sprintf("Cannot get aave platform instances: %s", err.Error()))
-		return
-	}
-	var aaveHandlers []protocols.DeFiProtocolHandler[trade.AaveEvent, trade.AaveInteraction]
-	for _, aaveInstance := range aaveInstances {
-		var tokens []trade.Token
-		db.Find(&tokens, trade.Token{ChainId: aaveInstance.ChainId})
-		aaveHandler, err := aave.NewAaveHandler(aaveInstance, client, cm, tokens, ParallelFactor)
-		if err != nil {
-			slog.Warn(fmt.Sprintf("Cannot get aave platform handler: %s", err.Error()))
-			continue
-		}
-		var casted protocols.DeFiProtocolHandler[trade.AaveEvent, trade.AaveInteraction]
-		casted = aaveHandler
-		aaveHandlers = append(aaveHandlers, casted)
+		return fmt.Errorf("Cannot remember header of block %d: %w", finalBlock, err)
 	}
-
-	var compoundInstances []trade.DeFiPlatform
-	err = db.Find(&compoundInstances, &trade.DeFiPlatform{ChainId: chainId.String(), Type: trade.Compound3}).Error
+	err = env.RetryDeadLetters(ctx)
 	if err != nil {
-		slog.Warn(fmt.Sprintf("Cannot get compound platform instances: %s", err.Error()))
-		return
-	}
-	var compoundHandlers []protocols.DeFiProtocolHandler[trade.Compound3Event, trade.Compound3Interaction]
-	for _, compoundInstance := range compoundInstances {
-		var tokens []trade.Token
-		db.Find(&tokens, trade.Token{ChainId: compoundInstance.ChainId})
-		compoundHandler, err := compound3.NewCompound3Handler(compoundInstance, client, cm, tokens, ParallelFactor)
-		if err != nil {
-			slog.Warn(fmt.Sprintf("Cannot get compound platform handler: %s", err.Error()))
-			continue
-		}
-		var casted protocols.DeFiProtocolHandler[trade.Compound3Event, trade.Compound3Interaction]
-		casted = compoundHandler
-		compoundHandlers = append(compoundHandlers, casted)
+		slog.Warn(fmt.Sprintf("%s Cannot retry dead letters: %s", prefix, err.Error()))
 	}
-
-	var uniswapV3Pools []trade.DeFiPlatform
-	err = db.Find(&uniswapV3Pools, &trade.DeFiPlatform{ChainId: chainId.String(), Type: trade.UniswapV3}).Error
+	err = purgeUnconfirmed(db.WithContext(context.WithoutCancel(ctx)), chainId.String(), finalBlock)
 	if err != nil {
-		slog.Warn(fmt.Sprintf("Cannot get UniswapV3 pools: %s", err.Error()))
-		return
-	}
-	var uniswapv3Handlers []protocols.DeFiProtocolHandler[trade.UniswapV3Event, trade.UniswapV3Deal]
-	for _, uniswapv3Instance := range uniswapV3Pools {
-		uniswapv3Handler, err := uniswapv3.NewUniswapV3PoolHandler(
-			uniswapv3Instance,
-			client,
-			cm,
-			db,
-			ParallelFactor,
-		)
-		if err != nil {
-			slog.Warn(fmt.Sprintf("Cannot get uniswapv3 platform handler: %s", err.Error()))
-			continue
-		}
-		var casted protocols.DeFiProtocolHandler[trade.UniswapV3Event, trade.UniswapV3Deal]
-		casted = uniswapv3Handler
-		uniswapv3Handlers = append(uniswapv3Handlers, casted)
-	}
-	if len(participants) == 0 {
-		return
+		return fmt.Errorf("Cannot remove stale unconfirmed events: %w", err)
 	}
-
-	// Environment is ready to setup
-	env := NewFetchEnvironment(chainId.String(), db, trackedWallets, participants, erc20Handlers, aaveHandlers, compoundHandlers, uniswapv3Handlers)
-	env.Fetch(startBlock, endBlock)
+	if config.IndexUnconfirmed && currentBlockchainBlock > finalBlock && fetchErr == nil {
+		// only the latest blocks interval of the tip is indexed provisionally when final head lags far behind
+		startBlock := max(finalBlock+1, currentBlockchainBlock-min(config.BlocksInterval, currentBlockchainBlock)+1)
+		fetchErr = env.FetchUnconfirmed(ctx, startBlock, currentBlockchainBlock)
+	}
+	if fetchErr != nil {
+		return fetchErr
+	}
+	err = saveProgress(ctx, db, client, config.ID, chainId.String(), currentBlockchainBlock, headHeader)
+	if err != nil {
+		return fmt.Errorf("Cannot save progress of worker: %w", err)
+	}
+	return nil
 }